@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kInviteCodeLength = 12
+)
+
+/**
+ * Access control of service, checked by join-service
+ *	a. denies: never join/connect, allows: only them join if not empty
+ *	b. invite: code for join instead of password, single-use or expiring
+ *	c. approval: join-request event to owner, and accept-join/reject-join
+ */
+type ServiceInvite struct {
+	Expire int64 // ms, 0: never
+	Uses   int   // left uses, 0: unlimited
+}
+
+type ServiceAclInfo struct {
+	Allows   []string
+	Denies   []string
+	Approval bool
+	Invites  []*ServiceInvite
+	Requests []string // pending join requests
+}
+
+func (s *SignalService) initAcl() {
+	if s.Allows == nil {
+		s.Allows = make(map[string]bool)
+	}
+	if s.Denies == nil {
+		s.Denies = make(map[string]bool)
+	}
+	if s.Invites == nil {
+		s.Invites = make(map[string]*ServiceInvite)
+	}
+	if s.Requests == nil {
+		s.Requests = make(map[string]int64)
+	}
+}
+
+// check peer by allows/denies
+func (s *SignalService) CheckAcl(id string) error {
+	if s.Denies[id] {
+		return errServiceDenied
+	}
+	if len(s.Allows) > 0 && !s.Allows[id] {
+		return errServiceNotAllowed
+	}
+	return nil
+}
+
+// password or invite code(md5), the invite is consumed
+func (s *SignalService) CheckCredential(pwdMd5 string) bool {
+	if util.MD5SumVerify([]string{pwdMd5, s.Salt}, s.PwdMd5) {
+		return true
+	}
+
+	return ConsumeInvite(s.Invites, util.MD5SumGenerate([]string{pwdMd5, s.Salt}))
+}
+
+// remove expired invites
+func PruneInvites(invites map[string]*ServiceInvite) {
+	now := util.NowMs()
+	for key, invite := range invites {
+		if invite.Expire > 0 && now > invite.Expire {
+			delete(invites, key)
+		}
+	}
+}
+
+// check and use invite once, remove it if no uses left
+func ConsumeInvite(invites map[string]*ServiceInvite, key string) bool {
+	PruneInvites(invites)
+	if invite, ok := invites[key]; ok {
+		if invite.Uses > 0 {
+			if invite.Uses -= 1; invite.Uses == 0 {
+				delete(invites, key)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// invite must expire or be limited by uses
+func CheckInviteLimit(ttl int64, uses int) error {
+	if ttl < 0 || uses < 0 {
+		return errFnInvalidParamters([]string{fmt.Sprint(ttl), fmt.Sprint(uses)})
+	}
+	if ttl == 0 && uses == 0 {
+		return errInviteUnlimited
+	}
+	return nil
+}
+
+// new invite with ttl(seconds) and uses, return the code
+func NewInvite(invites map[string]*ServiceInvite, ttl int64, uses int, salt string) string {
+	invite := &ServiceInvite{Uses: uses}
+	if ttl > 0 {
+		invite.Expire = util.NowMs() + ttl*1000
+	}
+
+	// client sends md5 of code
+	code := util.RandomString(kInviteCodeLength)
+	codeMd5 := util.MD5SumGenerate([]string{code})
+	PruneInvites(invites)
+	invites[util.MD5SumGenerate([]string{codeMd5, salt})] = invite
+	return code
+}
+
+/// signal server operations
+
+// join by password or invite, pending if approval required
+func (ss *SignalServer) JoinService(service *SignalService, peer *SignalPeer, req *SignalRequest, resp *SignalResponse) error {
+	if err := service.CheckAcl(peer.Id); err != nil {
+		return err
+	}
+
+	// never consume invite of joined or pending peer
+	if peer.InServices[service.Name] {
+		resp.ResultL = append(resp.ResultL, "service had joined")
+		return nil
+	}
+	if _, ok := service.Requests[peer.Id]; ok && service.Approval {
+		resp.ResultL = append(resp.ResultL, "join request is pending for approval of owner")
+		return nil
+	}
+
+	key := "service:" + service.Name
+	if err := ss.CheckAuthLock(key, req.conn); err != nil {
+		return err
+	}
+	if !service.CheckCredential(req.ServicePwdMd5) {
+		ss.Warnf("service:%s, wrong password or invite from %s\n", service.Name, peer.Id)
+		ss.OnAuthResult(key, req.conn, false)
+		return errWrongPassword
+	}
+	ss.OnAuthResult(key, req.conn, true)
+
+	if service.Approval && !service.Allows[peer.Id] {
+		service.initAcl()
+		service.Requests[peer.Id] = util.NowMs()
+		ss.NotifyServiceEvent(service.Owner, kActionEventJoinRequest, peer.Id, service.Name)
+		resp.ResultL = append(resp.ResultL, "join request is pending for approval of owner")
+		return nil
+	}
+	peer.InServices[service.Name] = true
+	return nil
+}
+
+// allow-peer/deny-peer/reset-peer/accept-join/reject-join serviceName pwd peerId
+func (ss *SignalServer) CheckServicePeer(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+	peer, ok := ss.db.Peers[req.ToId]
+	if !ok || peer.Id == service.Owner {
+		return errClientNotExist
+	}
+
+	service.initAcl()
+	switch req.Action {
+	case kActionAllowPeer:
+		service.Allows[peer.Id] = true
+		delete(service.Denies, peer.Id)
+	case kActionDenyPeer:
+		service.Denies[peer.Id] = true
+		delete(service.Allows, peer.Id)
+		delete(service.Requests, peer.Id)
+		if _, ok := peer.InServices[service.Name]; ok {
+			delete(peer.InServices, service.Name)
+			ss.NotifyServiceRevoked(peer.Id, service, "denied")
+		}
+	case kActionResetPeer:
+		delete(service.Allows, peer.Id)
+		delete(service.Denies, peer.Id)
+	case kActionAcceptJoin:
+		if _, ok := service.Requests[peer.Id]; !ok {
+			return errServiceNoJoinRequest
+		}
+		delete(service.Requests, peer.Id)
+		peer.InServices[service.Name] = true
+		ss.NotifyServiceEvent(peer.Id, kActionEventJoinAccepted, service.Owner, service.Name)
+	case kActionRejectJoin:
+		if _, ok := service.Requests[peer.Id]; !ok {
+			return errServiceNoJoinRequest
+		}
+		delete(service.Requests, peer.Id)
+		ss.NotifyServiceEvent(peer.Id, kActionEventJoinRejected, service.Owner, service.Name)
+	default:
+		return errFnInvalidAction(req.Action)
+	}
+	return nil
+}
+
+// set-service-approval serviceName pwd on|off
+func (ss *SignalServer) SetServiceApproval(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+	service.Approval = req.Approval
+	return nil
+}
+
+// create-invite serviceName pwd ttl [uses], return the code
+func (ss *SignalServer) CreateInvite(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+	if err := CheckInviteLimit(req.InviteTtl, req.InviteUses); err != nil {
+		return err
+	}
+
+	// client sends md5 of code as password
+	service.initAcl()
+	resp.ResultM["invite"] = NewInvite(service.Invites, req.InviteTtl, req.InviteUses, service.Salt)
+	return nil
+}
+
+func (ss *SignalServer) ShowServiceAcl(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+
+	service.initAcl()
+	PruneInvites(service.Invites)
+	info := &ServiceAclInfo{
+		Allows:   []string{},
+		Denies:   []string{},
+		Approval: service.Approval,
+		Invites:  []*ServiceInvite{},
+		Requests: []string{},
+	}
+	for id := range service.Allows {
+		info.Allows = append(info.Allows, id)
+	}
+	for id := range service.Denies {
+		info.Denies = append(info.Denies, id)
+	}
+	for _, invite := range service.Invites {
+		info.Invites = append(info.Invites, invite)
+	}
+	for id := range service.Requests {
+		info.Requests = append(info.Requests, id)
+	}
+	sort.Strings(info.Allows)
+	sort.Strings(info.Denies)
+	sort.Strings(info.Requests)
+	resp.ResultL = append(resp.ResultL, util.JsonEncode(info))
+	return nil
+}
+
+// event of service to one online peer
+func (ss *SignalServer) NotifyServiceEvent(toId, event, fromId, name string) {
+	ev := NewSignalResponse("")
+	ev.Event = event
+	ev.FromId = fromId
+	ev.ServiceName = name
+	ss.SendEvent(toId, ev)
+}
+
+/// signal client operations
+
+func (sc *SignalClient) ControlServiceAcl(action string, params []string) (*Result, error) {
+	count := 3
+	switch action {
+	case kActionShowServiceAcl:
+		count = 2
+	case kActionCreateInvite:
+		// uses is 1 if omitted
+		count = 4
+		if len(params) == 3 {
+			params = append(params, "1")
+		}
+	}
+	if len(params) != count {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ServiceName = params[0]
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{params[1]})
+	switch action {
+	case kActionSetServiceApproval:
+		if params[2] != "on" && params[2] != "off" {
+			return nil, errFnInvalidParamters(params[2:])
+		}
+		req.Approval = (params[2] == "on")
+	case kActionCreateInvite:
+		ttl, err1 := strconv.ParseInt(params[2], 10, 64)
+		uses, err2 := strconv.Atoi(params[3])
+		if err1 != nil || err2 != nil {
+			return nil, errFnInvalidParamters(params[2:])
+		}
+		req.InviteTtl = ttl
+		req.InviteUses = uses
+	case kActionShowServiceAcl:
+	default:
+		req.ToId = params[2]
+	}
+
+	resp, err := sc.SendRequest(action, req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case kActionCreateInvite:
+		code := resp.ResultM["invite"]
+		return NewResultValue(code, code), nil
+	case kActionShowServiceAcl:
+		if len(resp.ResultL) != 1 {
+			return nil, errFnInvalidParamters(resp.ResultL)
+		}
+		info := &ServiceAclInfo{}
+		if err := json.Unmarshal([]byte(resp.ResultL[0]), info); err != nil {
+			return nil, err
+		}
+		lines := []string{
+			fmt.Sprintf("allows: %s", strings.Join(info.Allows, ",")),
+			fmt.Sprintf("denies: %s", strings.Join(info.Denies, ",")),
+			fmt.Sprintf("approval: %v", info.Approval),
+			fmt.Sprintf("requests: %s", strings.Join(info.Requests, ",")),
+		}
+		for _, invite := range info.Invites {
+			lines = append(lines, fmt.Sprintf("invite: expire %s, uses %d", FormatTimeMs(invite.Expire), invite.Uses))
+		}
+		return NewResultValue(strings.Join(lines, "\n"), info), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+func createTestInvite(t *testing.T, owner *SignalConnection, ttl int64, uses int) (string, *SignalResponse) {
+	t.Helper()
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	req.InviteTtl = ttl
+	req.InviteUses = uses
+	resp := doTestRequest(t, owner, kActionCreateInvite, req)
+	return resp.ResultM["invite"], resp
+}
+
+func joinTestService(t *testing.T, conn *SignalConnection, id, pwd string) *SignalResponse {
+	t.Helper()
+	req := NewSignalRequest(id)
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{pwd})
+	return doTestRequest(t, conn, kActionJoinService, req)
+}
+
+// invite never lasting forever
+func TestInviteLimit(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, _ := newTestService(t, ss)
+
+	if _, resp := createTestInvite(t, owner, 0, 0); resp.ErrorCode != ErrorCode(errInviteUnlimited) {
+		t.Errorf("create-invite 0 0: error %q, want invite-unlimited", resp.Error)
+	}
+	if _, resp := createTestInvite(t, owner, 60, 0); len(resp.Error) > 0 {
+		t.Errorf("create-invite 60 0: %s", resp.Error)
+	}
+
+	admin := newTestPeer(t, ss, "admin", kRoleAdmin)
+	req := NewSignalRequest("admin")
+	if resp := doTestRequest(t, admin, kActionCreateRegisterInvite, req); resp.ErrorCode != ErrorCode(errInviteUnlimited) {
+		t.Errorf("create-register-invite 0 0: error %q, want invite-unlimited", resp.Error)
+	}
+	req = NewSignalRequest("admin")
+	req.InviteUses = 1
+	if resp := doTestRequest(t, admin, kActionCreateRegisterInvite, req); len(resp.Error) > 0 {
+		t.Errorf("create-register-invite 0 1: %s", resp.Error)
+	}
+}
+
+// joined or pending peer never consumes invite
+func TestInviteNotConsumedByJoined(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, member := newTestService(t, ss)
+	code, resp := createTestInvite(t, owner, 0, 1)
+	if len(resp.Error) > 0 {
+		t.Fatalf("create-invite: %s", resp.Error)
+	}
+	service := ss.db.Services["svc"]
+
+	if resp := joinTestService(t, member, "member", code); len(resp.Error) > 0 {
+		t.Fatalf("join by member: %s", resp.Error)
+	}
+	if len(service.Invites) != 1 {
+		t.Fatalf("invite consumed by joined member")
+	}
+
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	req.Approval = true
+	if resp := doTestRequest(t, owner, kActionSetServiceApproval, req); len(resp.Error) > 0 {
+		t.Fatalf("set-service-approval: %s", resp.Error)
+	}
+	other := newTestPeer(t, ss, "other", "")
+	if resp := joinTestService(t, other, "other", kTestPassword); len(resp.Error) > 0 {
+		t.Fatalf("join by other: %s", resp.Error)
+	}
+	if _, ok := service.Requests["other"]; !ok {
+		t.Fatalf("no pending request")
+	}
+	if resp := joinTestService(t, other, "other", code); len(resp.Error) > 0 {
+		t.Fatalf("join again by other: %s", resp.Error)
+	}
+	if len(service.Invites) != 1 {
+		t.Fatalf("invite consumed by pending peer")
+	}
+
+	// used once by new peer
+	third := newTestPeer(t, ss, "third", "")
+	if resp := joinTestService(t, third, "third", code); len(resp.Error) > 0 {
+		t.Fatalf("join by invite: %s", resp.Error)
+	}
+	if len(service.Invites) != 0 {
+		t.Fatalf("invite not consumed")
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kRoleAdmin = "admin"
+	kRoleUser  = "user"
+
+	// registration mode of signal server
+	kRegisterOpen   = "open"
+	kRegisterInvite = "invite" // register with invite code from admin
+	kRegisterAdmin  = "admin"  // only create-account by admin
+
+	kDefaultAdminId = "admin"
+
+	// generated password of bootstrap admin, beside kDefaultDBFile
+	kDefaultAdminPwdFile = "/tmp/signal_admin.pwd"
+	kEnvAdminPassword    = "NETPIE_ADMIN_PASSWORD"
+
+	// internal action of bootstrap, committed as others in cluster
+	kActionBootstrap = "bootstrap"
+)
+
+func IsValidRegisterMode(mode string) bool {
+	return mode == kRegisterOpen || mode == kRegisterInvite || mode == kRegisterAdmin
+}
+
+/**
+ * Peer info, returned to admin by peers
+ */
+type PeerInfo struct {
+	Id          string
+	DisplayName string
+	Role        string
+	Disabled    bool
+	Online      bool
+	LastLogin   int64
+	LastAddr    string
+}
+
+/// signal server operations
+
+// create admin at first start(no admin in database), committed to shared store
+// in cluster mode. password is taken from env, or generated and written to pwdFile
+// (owner only), never printed to logs.
+func (ss *SignalServer) Bootstrap(adminId, registerMode, pwdFile string) error {
+	if len(registerMode) > 0 && !IsValidRegisterMode(registerMode) {
+		return errFnInvalidParamters([]string{registerMode})
+	}
+
+	pwd := os.Getenv(kEnvAdminPassword)
+	fromEnv := len(pwd) > 0
+	if !fromEnv {
+		if len(pwdFile) == 0 {
+			return errFnInvalidParamters([]string{pwdFile})
+		}
+		pwd = util.RandomString(16)
+	}
+
+	created := false
+	fn := func(req *SignalRequest, resp *SignalResponse) error {
+		created = false
+		if len(registerMode) > 0 {
+			ss.db.RegisterMode = registerMode
+		}
+		for _, peer := range ss.db.Peers {
+			if peer.Role == kRoleAdmin {
+				return nil
+			}
+		}
+		if _, ok := ss.db.Peers[adminId]; ok {
+			ss.Warnf("no admin, and id %s had been registered\n", adminId)
+			return errClientExisted
+		}
+
+		pwdMd5 := util.MD5SumGenerate([]string{pwd})
+		if err := ss.AddPeer(adminId, pwdMd5, util.RandomString(4)); err != nil {
+			return err
+		}
+		ss.db.Peers[adminId].Role = kRoleAdmin
+		if !fromEnv {
+			// before committed, admin is never created with lost password
+			if err := WriteFilePrivate(pwdFile, []byte(pwd+"\n")); err != nil {
+				delete(ss.db.Peers, adminId)
+				return err
+			}
+		}
+		created = true
+		return nil
+	}
+
+	ss.mu.Lock()
+	err := ss.CommitAction(kActionBootstrap, fn, NewSignalRequest(adminId), NewSignalResponse(""))
+	ss.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ss.SyncToStorage()
+
+	if created {
+		if fromEnv {
+			ss.Printf("bootstrap admin: %s, password from $%s\n", adminId, kEnvAdminPassword)
+		} else {
+			ss.Printf("bootstrap admin: %s, password in %s (please change it)\n", adminId, pwdFile)
+		}
+	}
+	return nil
+}
+
+// validate id and password of new peer
+func (ss *SignalServer) CheckNewPeer(id, pwdMd5, salt string) error {
+	if len(id) < 5 {
+		ss.Warnf("client: %s, invalid id length\n", id)
+		return errInvalidClientId
+	}
+	if len(pwdMd5) < 32 || len(salt) < 4 {
+		ss.Warnf("client: %s, invalid password\n", id)
+		return errInvalidPassword
+	}
+	if _, ok := ss.db.Peers[id]; ok {
+		return errClientExisted
+	}
+	return nil
+}
+
+func (ss *SignalServer) AddPeer(id, pwdMd5, salt string) error {
+	if err := ss.CheckNewPeer(id, pwdMd5, salt); err != nil {
+		return err
+	}
+
+	new_pwd_md5 := util.MD5SumGenerate([]string{pwdMd5, salt})
+	ss.db.Peers[id] = NewSignalPeer(id, new_pwd_md5, salt)
+	return nil
+}
+
+func (ss *SignalServer) CheckAdmin(req *SignalRequest) (*SignalPeer, error) {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
+		return nil, err
+	}
+	if peer.Role != kRoleAdmin {
+		return nil, errRequireAdmin
+	}
+	return peer, nil
+}
+
+// list all peers with online state
+func (ss *SignalServer) ListPeers(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+
+	var ids []string
+	for id := range ss.db.Peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		info := ss.GetPeerInfo(ss.db.Peers[id])
+		resp.ResultL = append(resp.ResultL, util.JsonEncode(info))
+	}
+	return nil
+}
+
+func (ss *SignalServer) GetPeerInfo(peer *SignalPeer) *PeerInfo {
+	_, online := ss.onlines[peer.Id]
+	return &PeerInfo{
+		Id:          peer.Id,
+		DisplayName: peer.Profile.DisplayName,
+		Role:        peer.GetRole(),
+		Disabled:    peer.Disabled,
+		Online:      online,
+		LastLogin:   peer.Profile.LastLogin,
+		LastAddr:    peer.Profile.LastAddr,
+	}
+}
+
+// disable-peer/enable-peer/force-disconnect/set-role peerId
+func (ss *SignalServer) CheckAdminPeer(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+	peer, ok := ss.db.Peers[req.ToId]
+	if !ok {
+		return errClientNotExist
+	}
+	if peer.Id == req.FromId && req.Action != kActionEnablePeer {
+		return errFnInvalidParamters([]string{"self"})
+	}
+
+	switch req.Action {
+	case kActionDisablePeer:
+		peer.Disabled = true
+		ss.DisconnectPeer(peer.Id)
+	case kActionEnablePeer:
+		peer.Disabled = false
+	case kActionForceDisconnect:
+		if !ss.DisconnectPeer(peer.Id) {
+			return errClientNotLogin
+		}
+	case kActionSetRole:
+		if req.Role != kRoleAdmin && req.Role != kRoleUser {
+			return errFnInvalidParamters([]string{req.Role})
+		}
+		peer.Role = req.Role
+	default:
+		return errFnInvalidAction(req.Action)
+	}
+	return nil
+}
+
+// close websocket, and the connection is removed by readPump.
+// peer on another node is disconnected by that node.
+func (ss *SignalServer) DisconnectPeer(id string) bool {
+	if ss.DisconnectLocalPeer(id) {
+		return true
+	}
+	if node, ok := ss.RemoteNode(id); ok {
+		ss.Printf("force disconnect: %s on node %s\n", id, node)
+		ss.PublishCluster(kTopicNodePrefix+node, &ClusterMessage{ToId: id, Disconnect: true})
+		return true
+	}
+	return false
+}
+
+func (ss *SignalServer) DisconnectLocalPeer(id string) bool {
+	if conn, ok := ss.onlines[id]; ok {
+		ss.Printf("force disconnect: %v\n", conn)
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+func (ss *SignalServer) ForceRemoveService(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+	service, ok := ss.db.Services[req.ServiceName]
+	if !ok {
+		return errServiceNotExist
+	}
+
+	delete(ss.db.Services, service.Name)
+	for _, peer := range ss.db.Peers {
+		if _, ok := peer.InServices[service.Name]; ok {
+			delete(peer.InServices, service.Name)
+			ss.NotifyServiceRevoked(peer.Id, service, "removed")
+		}
+	}
+	return nil
+}
+
+func (ss *SignalServer) SetRegisterMode(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+	if !IsValidRegisterMode(req.RegisterMode) {
+		return errFnInvalidParamters([]string{req.RegisterMode})
+	}
+	ss.db.RegisterMode = req.RegisterMode
+	return nil
+}
+
+// invite for register when invite-only
+func (ss *SignalServer) CreateRegisterInvite(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+	if err := CheckInviteLimit(req.InviteTtl, req.InviteUses); err != nil {
+		return err
+	}
+
+	if ss.db.Invites == nil {
+		ss.db.Invites = make(map[string]*ServiceInvite)
+	}
+	resp.ResultM["invite"] = NewInvite(ss.db.Invites, req.InviteTtl, req.InviteUses, "")
+	return nil
+}
+
+// create-account id pwd, for admin-only registration
+func (ss *SignalServer) CreateAccount(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+	return ss.AddPeer(req.ToId, req.PwdMd5, req.Salt)
+}
+
+// check registration mode, the invite is consumed
+func (ss *SignalServer) CheckRegisterMode(req *SignalRequest) error {
+	switch ss.db.GetRegisterMode() {
+	case kRegisterInvite:
+		if len(req.InviteMd5) == 0 {
+			return errRegisterRequireInvite
+		}
+		key := util.MD5SumGenerate([]string{req.InviteMd5, ""})
+		if !ConsumeInvite(ss.db.Invites, key) {
+			return errRegisterRequireInvite
+		}
+	case kRegisterAdmin:
+		return errRegisterClosed
+	}
+	return nil
+}
+
+/// signal client operations
+
+func (sc *SignalClient) ControlAdmin(action string, params []string) (*Result, error) {
+	count := 1
+	switch action {
+	case kActionPeers:
+		count = 0
+	case kActionSetRole, kActionCreateRegisterInvite, kActionCreateAccount:
+		count = 2
+		if action == kActionCreateRegisterInvite && len(params) == 1 {
+			// uses is 1 if omitted
+			params = append(params, "1")
+		}
+	}
+	if len(params) != count {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	switch action {
+	case kActionPeers:
+	case kActionForceRemoveService:
+		req.ServiceName = params[0]
+	case kActionSetRegisterMode:
+		req.RegisterMode = params[0]
+	case kActionCreateRegisterInvite:
+		ttl, err1 := strconv.ParseInt(params[0], 10, 64)
+		uses, err2 := strconv.Atoi(params[1])
+		if err1 != nil || err2 != nil {
+			return nil, errFnInvalidParamters(params)
+		}
+		req.InviteTtl = ttl
+		req.InviteUses = uses
+	case kActionCreateAccount:
+		req.ToId = params[0]
+		req.PwdMd5 = util.MD5SumGenerate([]string{params[1]})
+		req.Salt = util.RandomString(4)
+	default:
+		req.ToId = params[0]
+		if action == kActionSetRole {
+			req.Role = params[1]
+		}
+	}
+
+	resp, err := sc.SendRequest(action, req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case kActionPeers:
+		var lines []string
+		infos := []*PeerInfo{}
+		for _, item := range resp.ResultL {
+			info := &PeerInfo{}
+			if err := json.Unmarshal([]byte(item), info); err != nil {
+				continue
+			}
+			infos = append(infos, info)
+
+			state := "offline"
+			if info.Online {
+				state = "online"
+			}
+			if info.Disabled {
+				state += ", disabled"
+			}
+			lines = append(lines, fmt.Sprintf("%s - %s, %s, last login %s", info.Id, info.Role, state, FormatTimeMs(info.LastLogin)))
+		}
+		return NewResultValue(strings.Join(lines, "\n"), infos), nil
+	case kActionCreateRegisterInvite:
+		code := resp.ResultM["invite"]
+		return NewResultValue(code, code), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// beside db, opened without following symlink
+var kDefaultAuditFile = filepath.Join(filepath.Dir(kDefaultDBFile), "signal_audit.log")
+
+const (
+	kAuditMaxSize     = 8 * 1024 * 1024 // rotate size
+	kAuditMaxBackups  = 5               // file.1 .. file.5
+	kAuditDefaultRows = 50
+	kAuditMaxRows     = 1000
+
+	// tunnels of peer closed by revoke/offline, not a request
+	kAuditTunnelClose = "tunnel-close"
+)
+
+// security-relevant actions, recorded by OnReceiveRequest
+var kAuditActions = map[string]bool{
+	kActionRegister:       true,
+	kActionLogin:          true,
+	kActionLogout:         true,
+	kActionChangePassword: true,
+	kActionDeleteAccount:  true,
+
+	kActionCreateService:         true,
+	kActionRemoveService:         true,
+	kActionEnableService:         true,
+	kActionDisableService:        true,
+	kActionJoinService:           true,
+	kActionLeaveService:          true,
+	kActionConnectService:        true, // tunnel open
+	kActionDisconnectService:     true, // tunnel close
+	kActionEventIceOpen:          true,
+	kActionEventIceClose:         true,
+	kActionEventIceOpenAck:       true,
+	kActionEventIceCloseAck:      true,
+	kActionRotateServicePassword: true,
+	kActionKickMember:            true,
+
+	kActionAllowPeer:          true,
+	kActionDenyPeer:           true,
+	kActionResetPeer:          true,
+	kActionAcceptJoin:         true,
+	kActionRejectJoin:         true,
+	kActionSetServiceApproval: true,
+	kActionCreateInvite:       true,
+
+	kActionDisablePeer:          true,
+	kActionEnablePeer:           true,
+	kActionForceDisconnect:      true,
+	kActionSetRole:              true,
+	kActionForceRemoveService:   true,
+	kActionSetRegisterMode:      true,
+	kActionCreateRegisterInvite: true,
+	kActionCreateAccount:        true,
+	kActionAudit:                true,
+}
+
+/**
+ * Audit entry, one json per line
+ */
+type AuditEntry struct {
+	Time    int64 // ms
+	Action  string
+	FromId  string `json:",omitempty"` // login of connection
+	Claimed string `json:",omitempty"` // FromId of request, if not the login
+	ToId    string `json:",omitempty"` // target peer, or forwarded peer of tunnel
+	Service string `json:",omitempty"`
+	Addr    string `json:",omitempty"` // source address of FromId
+	Result  string // ok or error code
+	Reason  string `json:",omitempty"` // why tunnel-close, e.g. kicked
+}
+
+func (e *AuditEntry) Match(filter string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	return e.FromId == filter || e.Claimed == filter || e.ToId == filter || e.Service == filter || e.Action == filter
+}
+
+/**
+ * Append-only audit log, rotated by size
+ */
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	al := &AuditLog{path: path}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	file, err := OpenFileAppendPrivate(al.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+// file => file.1 => .. => file.N(removed)
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+	al.file = nil
+	for i := kAuditMaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1))
+	}
+	if err := os.Rename(al.path, al.path+".1"); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+func (al *AuditLog) Write(entry *AuditEntry) error {
+	if al == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.file == nil {
+		if err := al.open(); err != nil {
+			return err
+		}
+	} else if al.size+int64(len(data)) > kAuditMaxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.file.Write(data)
+	al.size += int64(n)
+	return err
+}
+
+// last rows of matched entries, from oldest backup to current file
+func (al *AuditLog) Query(filter string, rows int) ([]*AuditEntry, error) {
+	if al == nil {
+		return nil, errAuditDisabled
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	var entries []*AuditEntry
+	for i := kAuditMaxBackups; i >= 0; i-- {
+		path := al.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", al.path, i)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			entry := &AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || !entry.Match(filter) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > rows {
+				entries = entries[1:]
+			}
+		}
+		file.Close()
+	}
+	return entries, nil
+}
+
+/// signal server operations
+
+func (ss *SignalServer) EnableAudit(path string) error {
+	audit, err := NewAuditLog(path)
+	if err != nil {
+		return err
+	}
+	ss.audit = audit
+	return nil
+}
+
+// tunnels of peer to service(all if empty) are closed, called with lock.
+// the entries are written out of lock, by request or connection.
+func (ss *SignalServer) OnTunnelClosed(id, service, reason string) {
+	if ss.audit == nil {
+		return
+	}
+	entry := &AuditEntry{
+		Time:    util.NowMs(),
+		Action:  kAuditTunnelClose,
+		FromId:  id,
+		Service: service,
+		Result:  "ok",
+		Reason:  reason,
+	}
+	if conn := ss.onlines[id]; conn != nil {
+		entry.Addr = conn.RemoteAddr()
+	}
+	ss.tunnelCloses = append(ss.tunnelCloses, entry)
+}
+
+// called with lock
+func (ss *SignalServer) takeTunnelCloses() []*AuditEntry {
+	entries := ss.tunnelCloses
+	ss.tunnelCloses = nil
+	return entries
+}
+
+func (ss *SignalServer) WriteAudit(entries []*AuditEntry) {
+	for _, entry := range entries {
+		if err := ss.audit.Write(entry); err != nil {
+			ss.Warnln("audit write err:", err)
+		}
+	}
+}
+
+func (ss *SignalServer) RecordAudit(action string, req *SignalRequest, resp *SignalResponse, err error) {
+	if ss.audit == nil || !kAuditActions[action] {
+		return
+	}
+	defer ss.WriteAudit(resp.audits)
+
+	entry := &AuditEntry{
+		Time:    util.NowMs(),
+		Action:  action,
+		ToId:    req.ToId,
+		Service: req.ServiceName,
+		Result:  "ok",
+	}
+	// FromId is claimed by client, the login of connection is trusted
+	if req.conn != nil {
+		entry.FromId = req.conn.id
+		entry.Addr = req.conn.RemoteAddr()
+	}
+	if req.FromId != entry.FromId {
+		entry.Claimed = req.FromId
+	}
+	if len(resp.toId) > 0 {
+		entry.ToId = resp.toId // target of forwarded
+	}
+	if err != nil {
+		entry.Result = ErrorCode(err)
+	}
+	if err := ss.audit.Write(entry); err != nil {
+		ss.Warnln("audit write err:", err)
+	}
+}
+
+// audit [rows] [filter], filter: peer id, service name or action
+func (ss *SignalServer) QueryAudit(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckAdmin(req); err != nil {
+		return err
+	}
+
+	rows := req.AuditRows
+	if rows <= 0 {
+		rows = kAuditDefaultRows
+	} else if rows > kAuditMaxRows {
+		rows = kAuditMaxRows
+	}
+	entries, err := ss.audit.Query(req.AuditFilter, rows)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		resp.ResultL = append(resp.ResultL, util.JsonEncode(entry))
+	}
+	return nil
+}
+
+/// signal client operations
+
+func (sc *SignalClient) QueryAudit(action string, params []string) (*Result, error) {
+	if len(params) > 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	if len(params) >= 1 {
+		rows, err := strconv.Atoi(params[0])
+		if err != nil {
+			return nil, errFnInvalidParamters(params)
+		}
+		req.AuditRows = rows
+	}
+	if len(params) == 2 {
+		req.AuditFilter = params[1]
+	}
+
+	resp, err := sc.SendRequest(action, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	entries := []*AuditEntry{}
+	for _, item := range resp.ResultL {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(item), entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+
+		line := fmt.Sprintf("%s %s %s", FormatTimeMs(entry.Time), entry.Action, entry.FromId)
+		if len(entry.Claimed) > 0 {
+			line += " (claimed " + entry.Claimed + ")"
+		}
+		if len(entry.ToId) > 0 {
+			line += " -> " + entry.ToId
+		}
+		if len(entry.Service) > 0 {
+			line += ", service " + entry.Service
+		}
+		if len(entry.Addr) > 0 {
+			line += ", from " + entry.Addr
+		}
+		if len(entry.Reason) > 0 {
+			line += ", " + entry.Reason
+		}
+		lines = append(lines, line+", "+entry.Result)
+	}
+	return NewResultValue(strings.Join(lines, "\n"), entries), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+func TestAuditClaimedFromId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpie-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ss := newTestSignalServer()
+	if err := ss.EnableAudit(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	newTestPeer(t, ss, "admin", kRoleAdmin)
+	mallory := newTestPeer(t, ss, "mallory", "")
+
+	// spoofed as admin, recorded as mallory
+	req := NewSignalRequest("admin")
+	req.ToId = "mallory"
+	req.Role = kRoleAdmin
+	doTestRequest(t, mallory, kActionSetRole, req)
+
+	entries, err := ss.audit.Query(kActionSetRole, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("entries: %d, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.FromId != "mallory" || entry.Claimed != "admin" || entry.Result != "client-not-login" {
+		t.Errorf("entry: from %q, claimed %q, result %q", entry.FromId, entry.Claimed, entry.Result)
+	}
+
+	// login of connection, nothing claimed
+	entries, _ = ss.audit.Query(kActionLogin, 10)
+	for _, entry := range entries {
+		if len(entry.FromId) == 0 || len(entry.Claimed) > 0 {
+			t.Errorf("login entry: from %q, claimed %q", entry.FromId, entry.Claimed)
+		}
+	}
+}
+
+func checkTestTunnelClose(t *testing.T, ss *SignalServer, id, service, reason string) {
+	t.Helper()
+	entries, err := ss.audit.Query(kAuditTunnelClose, kAuditMaxRows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.FromId == id && entry.Service == service && entry.Reason == reason {
+			return
+		}
+	}
+	t.Errorf("no tunnel-close of %s, service %q, reason %s", id, service, reason)
+}
+
+// tunnels closed by revoke, offline and deleted account are audited
+func TestAuditTunnelClose(t *testing.T) {
+	ss := newTestSignalServer()
+	if err := ss.EnableAudit(filepath.Join(t.TempDir(), "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	owner, member := newTestService(t, ss)
+	other := newTestPeer(t, ss, "other", "")
+	pwdMd5 := util.MD5SumGenerate([]string{kTestPassword})
+
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = pwdMd5
+	req.ToId = "member"
+	if resp := doTestRequest(t, owner, kActionKickMember, req); len(resp.Error) > 0 {
+		t.Fatalf("kick-member: %s", resp.Error)
+	}
+	checkTestTunnelClose(t, ss, "member", "svc", "kicked")
+
+	req = NewSignalRequest("other")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = pwdMd5
+	if resp := doTestRequest(t, other, kActionJoinService, req); len(resp.Error) > 0 {
+		t.Fatalf("join-service: %s", resp.Error)
+	}
+	req = NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = pwdMd5
+	req.NewPwdMd5 = util.MD5SumGenerate([]string{"new-password"})
+	req.ServiceSalt = util.RandomString(4)
+	req.RevokeMembers = true
+	if resp := doTestRequest(t, owner, kActionRotateServicePassword, req); len(resp.Error) > 0 {
+		t.Fatalf("rotate-service-password: %s", resp.Error)
+	}
+	checkTestTunnelClose(t, ss, "other", "svc", "password-rotated")
+
+	req = NewSignalRequest("member")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{"new-password"})
+	if resp := doTestRequest(t, member, kActionJoinService, req); len(resp.Error) > 0 {
+		t.Fatalf("join-service: %s", resp.Error)
+	}
+	req = NewSignalRequest("owner")
+	req.PwdMd5 = pwdMd5
+	if resp := doTestRequest(t, owner, kActionDeleteAccount, req); len(resp.Error) > 0 {
+		t.Fatalf("delete-account: %s", resp.Error)
+	}
+	checkTestTunnelClose(t, ss, "member", "svc", "deleted")
+
+	ss.RemoveConnection(member)
+	checkTestTunnelClose(t, ss, "member", "", "offline")
+}
+
+// a planted symlink is never followed
+func TestAuditFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "audit.log")
+	if err := os.Symlink(target, fname); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := newTestSignalServer()
+	if err := ss.EnableAudit(fname); err == nil {
+		t.Fatal("audit through symlink")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "keep" {
+		t.Fatalf("symlink followed: %q", data)
+	}
+}
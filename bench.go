@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kBenchConnect         = "connect" // websocket connected
+	kBenchPassword        = "bench-password"
+	kBenchCandidate       = "candidate:1 1 udp 2130706431 127.0.0.1 9 typ host"
+	kBenchConnectTimeout  = 10 * time.Second
+	kBenchShutdownTimeout = 2 * time.Second
+)
+
+// flows of bench, in order of running
+var kBenchFlows = []string{
+	kActionRegister,
+	kActionLogin,
+	kActionServices,
+	kActionConnectService,
+	kActionEventIceCandidate,
+}
+
+/**
+ * Load test of signal server by simulated SignalClients
+ *	a. N clients connect by websocket, one owner per 10 clients
+ *	b. register/login, owners create-service and members join-service
+ *	c. members run rounds of services/connect-service/ice-candidate
+ *	d. against target address, or in-process loopback server if empty
+ */
+type BenchOptions struct {
+	Addr     string // empty for loopback
+	Clients  int
+	Rounds   int
+	Interval time.Duration // between rounds of one client
+	Flows    []string      // of kBenchFlows
+	Prefix   string        // of client ids, random if empty
+}
+
+func (o *BenchOptions) HasFlow(flow string) bool {
+	for _, item := range o.Flows {
+		if item == flow {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseBenchFlows(flows string) ([]string, error) {
+	var items []string
+	for _, item := range strings.Split(flows, ",") {
+		item = strings.TrimSpace(item)
+		valid := false
+		for _, flow := range kBenchFlows {
+			valid = valid || (item == flow)
+		}
+		if !valid {
+			return nil, errFnInvalidParamters([]string{item})
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+/**
+ * Latencies and errors of one action
+ */
+type BenchAction struct {
+	Name      string
+	Count     int
+	Errors    int
+	latencies []time.Duration
+}
+
+func (ba *BenchAction) Percentile(p int) time.Duration {
+	if len(ba.latencies) == 0 {
+		return 0
+	}
+	return ba.latencies[(len(ba.latencies)-1)*p/100]
+}
+
+type BenchResult struct {
+	Addr     string
+	Clients  int
+	Requests int
+	Errors   int
+	Elapsed  time.Duration
+	Actions  []*BenchAction
+	Reasons  map[string]int // error => count
+}
+
+func (r *BenchResult) String() string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("addr: %s, clients: %d, requests: %d, errors: %d, elapsed: %v, throughput: %.0f req/s",
+		r.Addr, r.Clients, r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond), float64(r.Requests)/r.Elapsed.Seconds()))
+	lines = append(lines, fmt.Sprintf("%-16s %8s %8s %10s %10s %10s %10s",
+		"action", "count", "errors", "p50", "p90", "p99", "max"))
+	for _, ba := range r.Actions {
+		lines = append(lines, fmt.Sprintf("%-16s %8d %8d %10v %10v %10v %10v",
+			ba.Name, ba.Count, ba.Errors, ba.Percentile(50), ba.Percentile(90), ba.Percentile(99), ba.Percentile(100)))
+	}
+	if len(r.Reasons) > 0 {
+		lines = append(lines, "errors:")
+		var reasons []string
+		for reason := range r.Reasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			lines = append(lines, fmt.Sprintf("  %6d %s", r.Reasons[reason], reason))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type benchStats struct {
+	mu      sync.Mutex
+	actions map[string]*BenchAction
+	reasons map[string]int
+}
+
+func (bs *benchStats) Record(action string, elapsed time.Duration, err error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	ba, ok := bs.actions[action]
+	if !ok {
+		ba = &BenchAction{Name: action}
+		bs.actions[action] = ba
+	}
+	ba.Count += 1
+	ba.latencies = append(ba.latencies, elapsed)
+	if err != nil {
+		ba.Errors += 1
+		bs.reasons[action+": "+err.Error()] += 1
+	}
+}
+
+type benchClient struct {
+	id      string
+	service string // owned or joined
+	owner   bool
+	sc      *SignalClient
+}
+
+func (bc *benchClient) Call(stats *benchStats, action string, params ...string) error {
+	fn, ok := bc.sc.actions[action]
+	if !ok {
+		return errFnInvalidAction(action)
+	}
+	start := time.Now()
+	_, err := fn(action, params)
+	stats.Record(action, time.Since(start), err)
+	return err
+}
+
+// ice-candidate to owner of joined service
+func (bc *benchClient) SendCandidate(stats *benchStats) error {
+	start := time.Now()
+	_, err := bc.sc.SendIceCandidate(kBenchCandidate, bc.service, "")
+	stats.Record(kActionEventIceCandidate, time.Since(start), err)
+	return err
+}
+
+func (bc *benchClient) WaitConnected(stats *benchStats) error {
+	start := time.Now()
+	var err error
+	for bc.sc.Network() != kNetworkConnected {
+		if time.Since(start) > kBenchConnectTimeout {
+			err = errNetworkNotConnected
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats.Record(kBenchConnect, time.Since(start), err)
+	return err
+}
+
+// in-process signal server on random port of 127.0.0.1
+func StartLoopbackSignal() (*SignalServer, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	ss := NewSignalServer()
+	ss.SetStore(NewMemoryStore())
+	go ss.Serve(ln)
+	return ss, ln.Addr().String(), nil
+}
+
+func RunBench(opts *BenchOptions) (*BenchResult, error) {
+	if opts.Clients <= 0 || len(opts.Flows) == 0 {
+		return nil, errFnInvalidParamters([]string{fmt.Sprint(opts.Clients), strings.Join(opts.Flows, ",")})
+	}
+
+	// quiet logging of each request
+	writer := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(writer)
+
+	addr := opts.Addr
+	if len(addr) == 0 {
+		ss, loopback, err := StartLoopbackSignal()
+		if err != nil {
+			return nil, err
+		}
+		defer ss.Shutdown(kBenchShutdownTimeout)
+		addr = loopback
+	}
+	prefix := opts.Prefix
+	if len(prefix) == 0 {
+		prefix = "bench-" + strings.ToLower(util.RandomString(6))
+	}
+
+	stats := &benchStats{
+		actions: make(map[string]*BenchAction),
+		reasons: make(map[string]int),
+	}
+	clients := make([]*benchClient, opts.Clients)
+	for i := range clients {
+		owner := i - i%10
+		clients[i] = &benchClient{
+			id:      fmt.Sprintf("%s-%06d", prefix, i),
+			service: fmt.Sprintf("%s-svc-%06d", prefix, owner),
+			owner:   i == owner,
+			sc:      NewSignalClient(),
+		}
+	}
+
+	parallel := func(fn func(bc *benchClient)) {
+		var wg sync.WaitGroup
+		for _, bc := range clients {
+			wg.Add(1)
+			go func(bc *benchClient) {
+				defer wg.Done()
+				fn(bc)
+			}(bc)
+		}
+		wg.Wait()
+	}
+
+	withService := opts.HasFlow(kActionConnectService) || opts.HasFlow(kActionEventIceCandidate)
+	start := time.Now()
+
+	// account and service, owners are ready before members join
+	parallel(func(bc *benchClient) {
+		bc.sc.sigaddr = addr
+		bc.sc.Start()
+		if bc.WaitConnected(stats) != nil {
+			return
+		}
+		if opts.HasFlow(kActionRegister) {
+			bc.Call(stats, kActionRegister, bc.id, kBenchPassword)
+		}
+		if !opts.HasFlow(kActionLogin) || bc.Call(stats, kActionLogin, bc.id, kBenchPassword) != nil {
+			return
+		}
+		if withService && bc.owner {
+			bc.Call(stats, kActionCreateService, bc.service, kBenchPassword, "bench")
+		}
+	})
+	if withService {
+		parallel(func(bc *benchClient) {
+			if !bc.owner && bc.sc.IsOnline() {
+				bc.Call(stats, kActionJoinService, bc.service, kBenchPassword)
+			}
+		})
+	}
+
+	// rounds of members
+	parallel(func(bc *benchClient) {
+		if !bc.sc.IsOnline() || (withService && bc.owner) {
+			return
+		}
+		for i := 0; i < opts.Rounds; i++ {
+			if i > 0 {
+				time.Sleep(opts.Interval)
+			}
+			if opts.HasFlow(kActionServices) {
+				bc.Call(stats, kActionServices)
+			}
+			if opts.HasFlow(kActionConnectService) {
+				bc.Call(stats, kActionConnectService, bc.service, kBenchPassword)
+			}
+			if opts.HasFlow(kActionEventIceCandidate) {
+				bc.SendCandidate(stats)
+			}
+		}
+	})
+	elapsed := time.Since(start)
+
+	// also clients still retrying
+	for _, bc := range clients {
+		bc.sc.Close()
+	}
+
+	result := &BenchResult{
+		Addr:    addr,
+		Clients: opts.Clients,
+		Elapsed: elapsed,
+		Reasons: stats.reasons,
+	}
+	for _, ba := range stats.actions {
+		sort.Slice(ba.latencies, func(i, j int) bool { return ba.latencies[i] < ba.latencies[j] })
+		result.Actions = append(result.Actions, ba)
+		result.Errors += ba.Errors
+		if ba.Name != kBenchConnect {
+			result.Requests += ba.Count
+		}
+	}
+	sort.Slice(result.Actions, func(i, j int) bool { return result.Actions[i].Name < result.Actions[j].Name })
+	return result, nil
+}
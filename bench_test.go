@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// all flows against loopback server by websocket, no error
+func TestBenchLoopback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("websocket clients of loopback server")
+	}
+	opts := &BenchOptions{
+		Clients:  20,
+		Rounds:   3,
+		Interval: 10 * time.Millisecond,
+		Flows:    kBenchFlows,
+	}
+	result, err := RunBench(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Errors != 0 || result.Requests == 0 {
+		t.Fatalf("bench result:\n%s", result)
+	}
+}
+
+// clients failing to connect are stopped in retrying
+func TestBenchClientStop(t *testing.T) {
+	sc := NewSignalClient()
+	sc.sigaddr = "127.0.0.1:1" // refused
+	sc.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		sc.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sc.Network() != kNetworkDisconnected {
+		if time.Now().After(deadline) {
+			t.Fatal("client still retrying")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
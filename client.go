@@ -23,10 +23,24 @@ func (c *Client) Init(sigaddr string) {
 }
 
 func (c *Client) PreRunSignal(params []string) error {
+	if len(params) > 1 {
+		switch params[0] {
+		case "connect-service":
+			// prepare to accept tunnels of this service,
+			// before open-ack which may arrive with response.
+			c.ep.CheckEnableLocalService("enable", params[1])
+		}
+	}
 	return nil
 }
 
 func (c *Client) PostRunSignal(params []string, err error) {
+	if err != nil && len(params) > 1 {
+		switch params[0] {
+		case "connect-service":
+			c.ep.CheckEnableLocalService("disable", params[1])
+		}
+	}
 }
 
 func (c *Client) StartShell() {
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kTopicDb         = "db"
+	kTopicPresence   = "presence"
+	kTopicNodePrefix = "node."
+
+	kNodeExpire        = 15 * 1000 // ms, no presence from node
+	kClusterRetries    = 32        // of conflicted commit
+	kClusterMaxBackoff = 32        // ms, random wait before rerun
+)
+
+/**
+ * Cluster of signal servers(nodes)
+ *	a. store: SignalStore of peers/services, file by default,
+ *	   and SignalSharedStore(compare-and-swap by version) for cluster
+ *	b. bus: SignalBus(pub/sub) between nodes, loopback in-process for tests,
+ *	   and redis for nodes of processes(see redis.go)
+ *	c. db: mutating request is committed to shared store as next version,
+ *	   reloaded and rerun on conflict, then version is published and
+ *	   other nodes reload from store.
+ *	d. presence: online ids of each node, published on change and by tick
+ *	e. forward: events to peer on another node by "node.<id>" topic,
+ *	   and disconnect of peer, e.g. login again on another node
+ *	conferences are node-local, members should login on the same node.
+ */
+type SignalStore interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// store shared by nodes, version is increased by each save
+type SignalSharedStore interface {
+	SignalStore
+	Version() (uint64, error)
+	// save if stored version is still version, else errStoreConflict
+	CompareAndSave(version uint64, data []byte) error
+}
+
+type SignalBus interface {
+	Publish(topic string, data []byte) error
+	Subscribe(topic string, fn func(data []byte)) error
+	Close() error
+}
+
+// actions which never change db
+var kReadOnlyActions = map[string]bool{
+	kActionServices:          true,
+	kActionMyServices:        true,
+	kActionShowService:       true,
+	kActionConnectService:    true,
+	kActionDisconnectService: true,
+	kActionInfo:              true,
+	kActionPeers:             true,
+	kActionForceDisconnect:   true,
+	kActionAudit:             true,
+	kActionShowServiceAcl:    true,
+	kActionEventIceOpen:      true,
+	kActionEventIceClose:     true,
+	kActionEventIceOpenAck:   true,
+	kActionEventIceCloseAck:  true,
+	kActionEventIceAuth:      true,
+	kActionEventIceCandidate: true,
+	kActionEventOffer:        true,
+	kActionEventAnswer:       true,
+	kActionCreateConference:  true,
+	kActionJoinConference:    true,
+	kActionInviteConference:  true,
+	kActionLeaveConference:   true,
+	kActionConferences:       true,
+}
+
+/**
+ * File store, the default of single node
+ */
+type FileStore struct {
+	path    string
+	maxSize int
+}
+
+func NewFileStore(path string, maxSize int) *FileStore {
+	return &FileStore{path: path, maxSize: maxSize}
+}
+
+func (fs *FileStore) Load() ([]byte, error) {
+	return ReadFile(fs.path, fs.maxSize)
+}
+
+func (fs *FileStore) Save(data []byte) error {
+	return WriteFileAtomic(fs.path, data)
+}
+
+/**
+ * Memory store, shared by nodes in one process
+ */
+type MemoryStore struct {
+	mu      sync.Mutex
+	data    []byte
+	version uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (ms *MemoryStore) Load() ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.data == nil {
+		return nil, errors.New("empty store")
+	}
+	return append([]byte(nil), ms.data...), nil
+}
+
+func (ms *MemoryStore) Save(data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = append([]byte(nil), data...)
+	ms.version += 1
+	return nil
+}
+
+func (ms *MemoryStore) Version() (uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.version, nil
+}
+
+func (ms *MemoryStore) CompareAndSave(version uint64, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.version != version {
+		return errStoreConflict
+	}
+	ms.data = append([]byte(nil), data...)
+	ms.version += 1
+	return nil
+}
+
+/**
+ * Loopback bus, delivered in order by one goroutine per subscription,
+ * never dropped: queue of slow subscriber grows.
+ */
+type LoopbackHub struct {
+	mu   sync.Mutex
+	subs map[string][]*loopbackSub // topic => ..
+}
+
+type loopbackSub struct {
+	bus     *LoopbackBus
+	mu      sync.Mutex
+	queue   [][]byte
+	closed  bool
+	ch_wake chan struct{}
+}
+
+func (sub *loopbackSub) push(data []byte) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, data)
+	sub.mu.Unlock()
+	sub.wake()
+}
+
+func (sub *loopbackSub) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	sub.wake()
+}
+
+func (sub *loopbackSub) wake() {
+	select {
+	case sub.ch_wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver queued data until closed
+func (sub *loopbackSub) loop(fn func(data []byte)) {
+	for {
+		sub.mu.Lock()
+		queue, closed := sub.queue, sub.closed
+		sub.queue = nil
+		sub.mu.Unlock()
+		if closed {
+			return
+		}
+		for _, data := range queue {
+			fn(data)
+		}
+		if len(queue) == 0 {
+			<-sub.ch_wake
+		}
+	}
+}
+
+type LoopbackBus struct {
+	hub    *LoopbackHub
+	closed bool
+}
+
+func NewLoopbackHub() *LoopbackHub {
+	return &LoopbackHub{subs: make(map[string][]*loopbackSub)}
+}
+
+func (h *LoopbackHub) NewBus() *LoopbackBus {
+	return &LoopbackBus{hub: h}
+}
+
+func (b *LoopbackBus) Publish(topic string, data []byte) error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.closed {
+		return errClusterClosed
+	}
+	for _, sub := range b.hub.subs[topic] {
+		sub.push(data)
+	}
+	return nil
+}
+
+func (b *LoopbackBus) Subscribe(topic string, fn func(data []byte)) error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.closed {
+		return errClusterClosed
+	}
+	sub := &loopbackSub{bus: b, ch_wake: make(chan struct{}, 1)}
+	b.hub.subs[topic] = append(b.hub.subs[topic], sub)
+	go sub.loop(fn)
+	return nil
+}
+
+func (b *LoopbackBus) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for topic, subs := range b.hub.subs {
+		var left []*loopbackSub
+		for _, sub := range subs {
+			if sub.bus == b {
+				sub.close()
+			} else {
+				left = append(left, sub)
+			}
+		}
+		b.hub.subs[topic] = left
+	}
+	return nil
+}
+
+/**
+ * Message between nodes
+ */
+type ClusterMessage struct {
+	Topic string
+	Node  string // from
+
+	Version uint64 // db committed to shared store
+
+	Ids []string // presence, online ids
+
+	ToId       string // forward
+	Resp       *SignalResponse
+	Disconnect bool // close connection of ToId
+}
+
+type SignalCluster struct {
+	node    string
+	bus     SignalBus
+	store   SignalSharedStore
+	nodes   map[string]int64    // node => last seen(ms)
+	remotes map[string][]string // node => online ids
+
+	stale bool // local db has uncommitted changes
+
+	// events of mutating request, sent after committed
+	deferring bool
+	events    []*clusterEvent
+}
+
+type clusterEvent struct {
+	toId string
+	ev   *SignalResponse
+}
+
+/// signal server operations
+
+func (ss *SignalServer) SetStore(store SignalStore) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.store = store
+	ss.SyncFromStorage()
+}
+
+// join cluster as node, messages are handled in Run loop.
+// the store must be shared by nodes, see SetStore.
+func (ss *SignalServer) EnableCluster(node string, bus SignalBus) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	store, ok := ss.store.(SignalSharedStore)
+	if !ok {
+		return errStoreNotShared
+	}
+	cluster := &SignalCluster{
+		node:    node,
+		bus:     bus,
+		store:   store,
+		nodes:   make(map[string]int64),
+		remotes: make(map[string][]string),
+	}
+	if err := ss.ReloadFromStore(store, true); err != nil {
+		return err
+	}
+	for _, topic := range []string{kTopicDb, kTopicPresence, kTopicNodePrefix + node} {
+		topic := topic
+		err := bus.Subscribe(topic, func(data []byte) {
+			msg := &ClusterMessage{}
+			if err := util.GobDecode(data, msg); err != nil {
+				ss.Warnln("cluster decode err:", err)
+				return
+			}
+			if msg.Node == node {
+				return
+			}
+			msg.Topic = topic
+			ss.ch_cluster <- msg
+		})
+		if err != nil {
+			return err
+		}
+	}
+	ss.cluster = cluster
+	return nil
+}
+
+func (ss *SignalServer) PublishCluster(topic string, msg *ClusterMessage) {
+	msg.Node = ss.cluster.node
+	if buf, err := util.GobEncode(msg); err != nil {
+		ss.Warnln("cluster encode err:", err)
+	} else if err := ss.cluster.bus.Publish(topic, buf.Bytes()); err != nil {
+		ss.Warnln("cluster publish err:", err)
+	}
+}
+
+// reload db from shared store if its version is changed or forced
+func (ss *SignalServer) ReloadFromStore(store SignalSharedStore, force bool) error {
+	version, err := store.Version()
+	if err != nil {
+		return err
+	}
+	if version == ss.db.Version && !force {
+		return nil
+	}
+	db := &SignalDatabase{}
+	if version > 0 {
+		data, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if err := util.GobDecode(data, db); err != nil {
+			return err
+		}
+	}
+	if db.Peers == nil {
+		db.Peers = make(map[string]*SignalPeer)
+	}
+	if db.Services == nil {
+		db.Services = make(map[string]*SignalService)
+	}
+	db.Version = version
+	ss.db = db
+	return nil
+}
+
+// run mutating action by compare-and-swap of shared store:
+// reload if stale, run, and commit as next version. if other node
+// committed before, reload and rerun. events are sent after committed.
+func (ss *SignalServer) CommitAction(action string, fn fnSignalServerAction, req *SignalRequest, resp *SignalResponse) error {
+	cluster := ss.cluster
+	if cluster == nil || kReadOnlyActions[action] {
+		return fn(req, resp)
+	}
+	stale := cluster.stale
+	cluster.stale = false
+
+	defer func() {
+		cluster.deferring = false
+		cluster.events = nil
+	}()
+	for i := 0; ; i++ {
+		if err := ss.ReloadFromStore(cluster.store, stale); err != nil {
+			cluster.stale = stale
+			ss.Warnln("cluster reload err:", err)
+			return err
+		}
+		cluster.deferring = true
+		cluster.events = nil
+		ss.tunnelCloses = nil
+		*resp = *NewSignalResponse(req.Sequence)
+		if err := fn(req, resp); err != nil {
+			// drop partial changes by next reload, and their events
+			cluster.stale = true
+			return err
+		}
+
+		version := ss.db.Version
+		ss.db.Version = version + 1
+		buf, err := util.GobEncode(ss.db)
+		if err == nil {
+			err = cluster.store.CompareAndSave(version, buf.Bytes())
+		}
+		if err == nil {
+			ss.FlushEvents()
+			ss.PublishCluster(kTopicDb, &ClusterMessage{Version: ss.db.Version})
+			return nil
+		}
+		stale = true
+		if err != errStoreConflict || i >= kClusterRetries {
+			cluster.stale = true
+			ss.Warnln("cluster commit err:", action, err)
+			return err
+		}
+		ss.Println("cluster commit conflict, rerun:", action)
+
+		// random backoff, nodes are not in lockstep
+		backoff := 1 << uint(i)
+		if backoff > kClusterMaxBackoff {
+			backoff = kClusterMaxBackoff
+		}
+		time.Sleep(time.Duration(rand.Intn(backoff)+1) * time.Millisecond)
+	}
+}
+
+// send deferred events of committed request
+func (ss *SignalServer) FlushEvents() {
+	cluster := ss.cluster
+	events := cluster.events
+	cluster.deferring = false
+	cluster.events = nil
+	for _, item := range events {
+		ss.SendEvent(item.toId, item.ev)
+	}
+}
+
+func (ss *SignalServer) PublishPresence() {
+	if ss.cluster == nil {
+		return
+	}
+	var ids []string
+	for id := range ss.onlines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ss.PublishCluster(kTopicPresence, &ClusterMessage{Ids: ids})
+}
+
+func (ss *SignalServer) OnClusterMessage(msg *ClusterMessage) {
+	cluster := ss.cluster
+	if cluster == nil {
+		return
+	}
+	cluster.nodes[msg.Node] = util.NowMs()
+
+	switch {
+	case msg.Topic == kTopicDb:
+		// committed by other node, the store is the source of truth
+		if msg.Version > ss.db.Version || cluster.stale {
+			if err := ss.ReloadFromStore(cluster.store, cluster.stale); err != nil {
+				ss.Warnln("cluster reload err:", err)
+			} else {
+				cluster.stale = false
+			}
+		}
+	case msg.Topic == kTopicPresence:
+		cluster.remotes[msg.Node] = msg.Ids
+	case strings.HasPrefix(msg.Topic, kTopicNodePrefix):
+		if msg.Disconnect {
+			ss.DisconnectLocalPeer(msg.ToId)
+		} else if conn, ok := ss.onlines[msg.ToId]; ok && msg.Resp != nil {
+			conn.Send(msg.Resp)
+		}
+	}
+}
+
+// remove nodes without presence, and reload db if its message is lost
+func (ss *SignalServer) CheckClusterNodes() {
+	if ss.cluster == nil {
+		return
+	}
+	if err := ss.ReloadFromStore(ss.cluster.store, ss.cluster.stale); err != nil {
+		ss.Warnln("cluster reload err:", err)
+	} else {
+		ss.cluster.stale = false
+	}
+	now := util.NowMs()
+	for node, last := range ss.cluster.nodes {
+		if now-last > kNodeExpire {
+			ss.Println("cluster node expired:", node)
+			delete(ss.cluster.nodes, node)
+			delete(ss.cluster.remotes, node)
+		}
+	}
+}
+
+// node holding connection of peer id
+func (ss *SignalServer) RemoteNode(id string) (string, bool) {
+	if ss.cluster == nil {
+		return "", false
+	}
+	for node, ids := range ss.cluster.remotes {
+		for _, item := range ids {
+			if item == id {
+				return node, true
+			}
+		}
+	}
+	return "", false
+}
+
+// online in local or remote node
+func (ss *SignalServer) IsOnline(id string) bool {
+	if _, ok := ss.onlines[id]; ok {
+		return true
+	}
+	_, ok := ss.RemoteNode(id)
+	return ok
+}
+
+// event to peer in local or remote node, deferred if committing
+func (ss *SignalServer) SendEvent(toId string, ev *SignalResponse) bool {
+	if ss.cluster != nil && ss.cluster.deferring {
+		ss.cluster.events = append(ss.cluster.events, &clusterEvent{toId: toId, ev: ev})
+		return true
+	}
+	if conn, ok := ss.onlines[toId]; ok {
+		return conn.Send(ev)
+	}
+	if node, ok := ss.RemoteNode(toId); ok {
+		ss.PublishCluster(kTopicNodePrefix+node, &ClusterMessage{ToId: toId, Resp: ev})
+		return true
+	}
+	return false
+}
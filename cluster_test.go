@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// nodes of one cluster, by shared memory store and loopback bus
+func newTestCluster(t *testing.T, count int) []*SignalServer {
+	t.Helper()
+	store := NewMemoryStore()
+	hub := NewLoopbackHub()
+	return newTestClusterOf(t, count, func(i int) (SignalSharedStore, SignalBus) {
+		return store, hub.NewBus()
+	})
+}
+
+func newTestClusterOf(t *testing.T, count int, backend func(i int) (SignalSharedStore, SignalBus)) []*SignalServer {
+	t.Helper()
+	var nodes []*SignalServer
+	for i := 0; i < count; i++ {
+		store, bus := backend(i)
+		ss := newTestSignalServer()
+		ss.SetStore(store)
+		if err := ss.EnableCluster(fmt.Sprintf("node%d", i), bus); err != nil {
+			t.Fatal(err)
+		}
+		go ss.Run()
+		t.Cleanup(func() { ss.Shutdown(time.Second) })
+		nodes = append(nodes, ss)
+	}
+	return nodes
+}
+
+func TestClusterConcurrentRegister(t *testing.T) {
+	testClusterRegister(t, newTestCluster(t, 2))
+}
+
+// concurrent registrations of each node, none is lost
+func testClusterRegister(t *testing.T, nodes []*SignalServer) {
+	t.Helper()
+	const count = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(nodes)*count)
+	for n, ss := range nodes {
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(ss *SignalServer, id string) {
+				defer wg.Done()
+				conn := newTestConn(ss)
+				req := NewSignalRequest(id)
+				req.Action = kActionRegister
+				req.Sequence = util.RandomString(8)
+				req.PwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+				req.Salt = util.RandomString(4)
+				req.conn = conn
+				ss.OnReceiveRequest(req)
+				resp := <-conn.ch_send
+				if len(resp.Error) > 0 {
+					errs <- fmt.Errorf("register %s: %s", id, resp.Error)
+				}
+			}(ss, fmt.Sprintf("peer-%d-%d", n, i))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// no registration is lost by any node
+	for n, ss := range nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ss.mu.RLock()
+			peers := len(ss.db.Peers)
+			ss.mu.RUnlock()
+			if peers == len(nodes)*count {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node%d: %d peers, want %d", n, peers, len(nodes)*count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestMemoryStoreCompareAndSave(t *testing.T) {
+	ms := NewMemoryStore()
+	if err := ms.CompareAndSave(0, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.CompareAndSave(0, []byte("b")); err != errStoreConflict {
+		t.Fatalf("stale save: %v, want conflict", err)
+	}
+	if data, _ := ms.Load(); string(data) != "a" {
+		t.Fatalf("data: %q, want a", data)
+	}
+	if version, _ := ms.Version(); version != 1 {
+		t.Fatalf("version: %d, want 1", version)
+	}
+}
+
+func TestLoopbackBusNoDrop(t *testing.T) {
+	hub := NewLoopbackHub()
+	pub, sub := hub.NewBus(), hub.NewBus()
+	defer pub.Close()
+	defer sub.Close()
+
+	const count = 10000
+	ch_recv := make(chan int, count)
+	ch_block := make(chan struct{})
+	sub.Subscribe(kTopicDb, func(data []byte) {
+		<-ch_block // slow subscriber
+		ch_recv <- int(data[0]) | int(data[1])<<8
+	})
+	for i := 0; i < count; i++ {
+		if err := pub.Publish(kTopicDb, []byte{byte(i), byte(i >> 8)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(ch_block)
+	for i := 0; i < count; i++ {
+		select {
+		case n := <-ch_recv:
+			if n != i {
+				t.Fatalf("message %d: got %d", i, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d lost", i)
+		}
+	}
+}
+
+// wait until conn is closed by server
+func waitTestClosed(t *testing.T, conn *SignalConnection) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-conn.ch_send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("connection not closed")
+		}
+	}
+}
+
+// wait until ss sees id online on other node
+func waitTestRemote(t *testing.T, ss *SignalServer, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var ok bool
+		ss.Query(func() { _, ok = ss.RemoteNode(id) })
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not online on other node", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterDuplicateLogin(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	first := newTestPeer(t, nodes[0], "alice", "")
+	waitTestRemote(t, nodes[1], "alice")
+
+	// login on node1 kicks the one of node0
+	conn := newTestConn(nodes[1])
+	req := NewSignalRequest("alice")
+	req.PwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	if resp := doTestRequest(t, conn, kActionLogin, req); len(resp.Error) > 0 {
+		t.Fatalf("login on node1: %s", resp.Error)
+	}
+	waitTestClosed(t, first)
+}
+
+func TestClusterForceDisconnect(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	admin := newTestPeer(t, nodes[1], "admin", kRoleAdmin)
+	alice := newTestPeer(t, nodes[0], "alice", "")
+	waitTestRemote(t, nodes[1], "alice")
+
+	req := NewSignalRequest("admin")
+	req.ToId = "alice"
+	if resp := doTestRequest(t, admin, kActionForceDisconnect, req); len(resp.Error) > 0 {
+		t.Fatalf("force-disconnect: %s", resp.Error)
+	}
+	waitTestClosed(t, alice)
+}
+
+func TestClusterFailedCommitNoEvents(t *testing.T) {
+	nodes := newTestCluster(t, 1)
+	ss := nodes[0]
+	bob := newTestPeer(t, ss, "bobby", "")
+
+	ss.Query(func() {
+		fn := func(req *SignalRequest, resp *SignalResponse) error {
+			ev := NewSignalResponse("")
+			ev.Event = kActionEventServiceRevoked
+			ss.SendEvent("bobby", ev)
+			return errServiceNotExist
+		}
+		req := NewSignalRequest("bobby")
+		if err := ss.CommitAction(kActionRemoveService, fn, req, NewSignalResponse("")); err != errServiceNotExist {
+			t.Errorf("commit: %v, want service-not-exist", err)
+		}
+	})
+	select {
+	case ev := <-bob.ch_send:
+		t.Errorf("event of failed commit: %s", ev.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// bootstrapped admin is committed to shared store, and created once by nodes
+func TestClusterBootstrap(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	dir := t.TempDir()
+	for i, ss := range nodes {
+		fname := filepath.Join(dir, fmt.Sprintf("admin%d.pwd", i))
+		if err := ss.Bootstrap(kDefaultAdminId, "", fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "admin1.pwd")); !os.IsNotExist(err) {
+		t.Fatalf("admin created twice: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "admin0.pwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := nodes[1]
+	ss.Query(func() {
+		if err := ss.ReloadFromStore(ss.cluster.store, false); err != nil {
+			t.Error(err)
+			return
+		}
+		checkTestAdminPassword(t, ss, kDefaultAdminId, strings.TrimSpace(string(data)))
+	})
+}
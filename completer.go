@@ -2,12 +2,18 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/c-bata/go-prompt"
 )
 
 /**
  * shell completer
+ *	a. command: prefix-match all commands
+ *	b. arguments: by argument name in usage, e.g. serviceName/peerId,
+ *	   candidates are from cache refreshed after login.
  */
 func NewShellCompleter() *ShellCompleter {
 	cc := &ShellCompleter{}
@@ -16,6 +22,11 @@ func NewShellCompleter() *ShellCompleter {
 
 type ShellCompleter struct {
 	suggest []prompt.Suggest
+
+	mu       sync.Mutex
+	services []*SignalServiceInfo
+	peers    []string
+	tunnels  []string // serviceName of local active tunnels
 }
 
 func (cc *ShellCompleter) Init(isServer bool) {
@@ -29,59 +40,261 @@ func (cc *ShellCompleter) Init(isServer bool) {
 func (cc *ShellCompleter) InitClient() {
 	cc.suggest = []prompt.Suggest{
 		{Text: "help", Description: "usage: help"},
+		{Text: "set", Description: "usage: set output text|json"},
+		{Text: "keyring", Description: "usage: keyring list|set|remove|lock kind name (kind: user|service)"},
 
 		{Text: "status", Description: "usage: status (show status to sigserver)"},
-		{Text: "connect", Description: "usage: connect sigaddr (to sigserver)"},
+		{Text: "connect", Description: "usage: connect sigaddr (to sigserver, comma-separated for failover)"},
 		{Text: "disconnect", Description: "usage: disconnect (to sigserver)"},
 
-		{Text: "register", Description: "usage: register id pwd"},
+		{Text: "register", Description: "usage: register id pwd (append invite code if invite-only)"},
 		{Text: "login", Description: "usage: login id pwd"},
 		{Text: "logout", Description: "usage: logout"},
+		{Text: "info", Description: "usage: info (show my account)"},
+		{Text: "set-profile", Description: "usage: set-profile key value (key: name|contact)"},
+		{Text: "change-password", Description: "usage: change-password pwd newPwd"},
+		{Text: "delete-account", Description: "usage: delete-account pwd (remove owned services too)"},
+
+		{Text: "peers", Description: "usage: peers (list all peers, only admin)"},
+		{Text: "disable-peer", Description: "usage: disable-peer peerId (ban and disconnect, only admin)"},
+		{Text: "enable-peer", Description: "usage: enable-peer peerId (only admin)"},
+		{Text: "force-disconnect", Description: "usage: force-disconnect peerId (only admin)"},
+		{Text: "set-role", Description: "usage: set-role peerId role (role: admin|user, only admin)"},
+		{Text: "force-remove-service", Description: "usage: force-remove-service serviceName (only admin)"},
+		{Text: "set-register-mode", Description: "usage: set-register-mode mode (mode: open|invite|admin, only admin)"},
+		{Text: "create-register-invite", Description: "usage: create-register-invite ttl [uses] (seconds and uses, 0: unlimited but not both, uses default 1, only admin)"},
+		{Text: "create-account", Description: "usage: create-account id pwd (only admin)"},
+		{Text: "audit", Description: "usage: audit [rows] [filter] (filter: peerId|serviceName|action, only admin)"},
 
 		{Text: "services", Description: "usage: services (list all services)"},
 		{Text: "myservices", Description: "usage: myservices (list joined services)"},
 		{Text: "show-service", Description: "usage: show-service serviceName (show service info)"},
 
-		{Text: "join-service", Description: "usage: join-service serviceName pwd"},
+		{Text: "tunnels", Description: "usage: tunnels (list local active tunnels)"},
+		{Text: "tunnel-stats", Description: "usage: tunnel-stats serviceName peerId (show tunnel stats)"},
+		{Text: "close-tunnel", Description: "usage: close-tunnel serviceName peerId"},
+
+		{Text: "create-conference", Description: "usage: create-conference (create and join one conference)"},
+		{Text: "join-conference", Description: "usage: join-conference conferenceId (only owner or invited)"},
+		{Text: "invite-conference", Description: "usage: invite-conference conferenceId peerId (only owner)"},
+		{Text: "leave-conference", Description: "usage: leave-conference conferenceId"},
+		{Text: "conferences", Description: "usage: conferences (list my conferences)"},
+		{Text: "conference-send", Description: "usage: conference-send conferenceId message (broadcast to members)"},
+
+		{Text: "join-service", Description: "usage: join-service serviceName pwd (pwd or invite code)"},
 		{Text: "leave-service", Description: "usage: leave-service serviceName pwd"},
 		{Text: "connect-service", Description: "usage: connect-service serviceName pwd"},
 		{Text: "disconnect-service", Description: "usage: disconnect-service serviceName pwd"},
+		{Text: "bind-service", Description: "usage: bind-service serviceName proto addr (local listen address, e.g. tcp 127.0.0.1:2222)"},
 	}
 }
 
 func (cc *ShellCompleter) InitServer() {
 	cc.suggest = []prompt.Suggest{
 		{Text: "help", Description: "usage: help"},
+		{Text: "set", Description: "usage: set output text|json"},
+		{Text: "keyring", Description: "usage: keyring list|set|remove|lock kind name (kind: user|service)"},
 
 		{Text: "status", Description: "usage: status (show status to sigserver)"},
-		{Text: "connect", Description: "usage: connect sigaddr (to sigserver)"},
+		{Text: "connect", Description: "usage: connect sigaddr (to sigserver, comma-separated for failover)"},
 		{Text: "disconnect", Description: "usage: disconnect (to sigserver)"},
 
-		{Text: "register", Description: "usage: register id pwd"},
+		{Text: "register", Description: "usage: register id pwd (append invite code if invite-only)"},
 		{Text: "login", Description: "usage: login id pwd"},
 		{Text: "logout", Description: "usage: logout"},
+		{Text: "info", Description: "usage: info (show my account)"},
+		{Text: "set-profile", Description: "usage: set-profile key value (key: name|contact)"},
+		{Text: "change-password", Description: "usage: change-password pwd newPwd"},
+		{Text: "delete-account", Description: "usage: delete-account pwd (remove owned services too)"},
+
+		{Text: "peers", Description: "usage: peers (list all peers, only admin)"},
+		{Text: "disable-peer", Description: "usage: disable-peer peerId (ban and disconnect, only admin)"},
+		{Text: "enable-peer", Description: "usage: enable-peer peerId (only admin)"},
+		{Text: "force-disconnect", Description: "usage: force-disconnect peerId (only admin)"},
+		{Text: "set-role", Description: "usage: set-role peerId role (role: admin|user, only admin)"},
+		{Text: "force-remove-service", Description: "usage: force-remove-service serviceName (only admin)"},
+		{Text: "set-register-mode", Description: "usage: set-register-mode mode (mode: open|invite|admin, only admin)"},
+		{Text: "create-register-invite", Description: "usage: create-register-invite ttl [uses] (seconds and uses, 0: unlimited but not both, uses default 1, only admin)"},
+		{Text: "create-account", Description: "usage: create-account id pwd (only admin)"},
+		{Text: "audit", Description: "usage: audit [rows] [filter] (filter: peerId|serviceName|action, only admin)"},
 
 		{Text: "services", Description: "usage: services (list all services)"},
 		{Text: "myservices", Description: "usage: myservices (list my services)"},
 		{Text: "show-service", Description: "usage: show-service serviceName (show service info)"},
 
-		{Text: "create-service", Description: "usage: create-service serviceName pwd description}"},
+		{Text: "tunnels", Description: "usage: tunnels (list local active tunnels)"},
+		{Text: "tunnel-stats", Description: "usage: tunnel-stats serviceName peerId (show tunnel stats)"},
+		{Text: "close-tunnel", Description: "usage: close-tunnel serviceName peerId"},
+
+		{Text: "create-conference", Description: "usage: create-conference (create and join one conference)"},
+		{Text: "join-conference", Description: "usage: join-conference conferenceId (only owner or invited)"},
+		{Text: "invite-conference", Description: "usage: invite-conference conferenceId peerId (only owner)"},
+		{Text: "leave-conference", Description: "usage: leave-conference conferenceId"},
+		{Text: "conferences", Description: "usage: conferences (list my conferences)"},
+		{Text: "conference-send", Description: "usage: conference-send conferenceId message (broadcast to members)"},
+
+		{Text: "create-service", Description: "usage: create-service serviceName pwd description"},
 		{Text: "remove-service", Description: "usage: remove-service serviceName pwd (only owner)"},
 		{Text: "enable-service", Description: "usage: enable-service serviceName pwd (only owner)"},
 		{Text: "disable-service", Description: "usage: disable-service serviceName pwd (only owner)"},
+		{Text: "rotate-service-password", Description: "usage: rotate-service-password serviceName pwd newPwd revoke (revoke: yes|no, only owner)"},
+		{Text: "kick-member", Description: "usage: kick-member serviceName pwd peerId (only owner)"},
+		{Text: "allow-peer", Description: "usage: allow-peer serviceName pwd peerId (only allowed peers join if any)"},
+		{Text: "deny-peer", Description: "usage: deny-peer serviceName pwd peerId (deny and revoke)"},
+		{Text: "reset-peer", Description: "usage: reset-peer serviceName pwd peerId (remove from allow/deny list)"},
+		{Text: "accept-join", Description: "usage: accept-join serviceName pwd peerId (accept join-request)"},
+		{Text: "reject-join", Description: "usage: reject-join serviceName pwd peerId (reject join-request)"},
+		{Text: "set-service-approval", Description: "usage: set-service-approval serviceName pwd mode (mode: on|off)"},
+		{Text: "create-invite", Description: "usage: create-invite serviceName pwd ttl [uses] (seconds and uses, 0: unlimited but not both, uses default 1)"},
+		{Text: "service-acl", Description: "usage: service-acl serviceName pwd (show acl, invites and join-requests)"},
+		{Text: "bind-service", Description: "usage: bind-service serviceName proto addr (local address, e.g. tcp 127.0.0.1:22)"},
 	}
 }
 
 func (cc *ShellCompleter) Complete(d prompt.Document) []prompt.Suggest {
 	word := d.GetWordBeforeCursor()
+	args := strings.Fields(d.TextBeforeCursor())
+	if len(args) == 0 || (len(args) == 1 && len(word) > 0) {
+		if len(word) > 0 {
+			return prompt.FilterHasPrefix(cc.suggest, word, true)
+		} else {
+			return []prompt.Suggest{}
+		}
+	}
+
+	// position of current argument(from 0)
+	pos := len(args) - 1
 	if len(word) > 0 {
-		return prompt.FilterHasPrefix(cc.suggest, word, true)
-	} else {
+		pos -= 1
+	}
+	return cc.CompleteArgument(args[0], pos, word)
+}
+
+func (cc *ShellCompleter) CompleteArgument(cmd string, pos int, word string) []prompt.Suggest {
+	names := cc.GetArgumentNames(cmd)
+	if pos >= len(names) {
 		return []prompt.Suggest{}
 	}
+
+	name := names[pos]
+	var candidates []prompt.Suggest
+	switch name {
+	case "serviceName":
+		candidates = cc.getServiceCandidates(cmd)
+	case "peerId":
+		candidates = cc.getPeerCandidates()
+	}
+
+	if len(candidates) > 0 {
+		return prompt.FilterHasPrefix(candidates, word, true)
+	} else if len(word) == 0 {
+		// only hint when nothing to complete
+		return []prompt.Suggest{{Text: "<" + name + ">", Description: fmt.Sprintf("argument %d of %s", pos+1, cmd)}}
+	}
+	return []prompt.Suggest{}
+}
+
+// argument names parsed from usage, e.g. "usage: join-service serviceName pwd"
+func (cc *ShellCompleter) GetArgumentNames(cmd string) []string {
+	for _, item := range cc.suggest {
+		if item.Text != cmd {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(item.Description, "usage:"))
+		var names []string
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "(") {
+				break
+			}
+			names = append(names, field)
+		}
+		return names
+	}
+	return nil
+}
+
+func (cc *ShellCompleter) getServiceCandidates(cmd string) []prompt.Suggest {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var candidates []prompt.Suggest
+	switch cmd {
+	case kActionDisconnectService, kActionTunnelStats, kActionCloseTunnel:
+		for _, name := range cc.tunnels {
+			candidates = append(candidates, prompt.Suggest{Text: name, Description: "active tunnel"})
+		}
+		if len(candidates) > 0 {
+			return candidates
+		}
+	}
+
+	for _, info := range cc.services {
+		var matched bool
+		switch cmd {
+		case kActionJoinService:
+			matched = (info.State != kServiceStateOwned && info.State != kServiceStateJoined)
+		case kActionLeaveService, kActionConnectService, kActionDisconnectService:
+			matched = (info.State == kServiceStateJoined)
+		case kActionRemoveService, kActionEnableService, kActionDisableService,
+			kActionRotateServicePassword, kActionKickMember,
+			kActionAllowPeer, kActionDenyPeer, kActionResetPeer, kActionAcceptJoin, kActionRejectJoin,
+			kActionSetServiceApproval, kActionCreateInvite, kActionShowServiceAcl:
+			matched = (info.State == kServiceStateOwned)
+		default:
+			matched = true
+		}
+		if matched {
+			desc := fmt.Sprintf("%s owned", info.Owner)
+			if info.State != kServiceStateNone {
+				desc = "my " + info.State
+			}
+			candidates = append(candidates, prompt.Suggest{Text: info.Name, Description: desc})
+		}
+	}
+	return candidates
+}
+
+func (cc *ShellCompleter) getPeerCandidates() []prompt.Suggest {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var candidates []prompt.Suggest
+	for _, id := range cc.peers {
+		candidates = append(candidates, prompt.Suggest{Text: id, Description: "peer"})
+	}
+	return candidates
+}
+
+func (cc *ShellCompleter) UpdateServices(infos []*SignalServiceInfo) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.services = infos
+	sort.Slice(cc.services, func(i, j int) bool {
+		return cc.services[i].Name < cc.services[j].Name
+	})
+}
+
+func (cc *ShellCompleter) UpdateTunnels(names []string, peers []string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	sort.Strings(names)
+	sort.Strings(peers)
+	cc.tunnels = names
+	cc.peers = peers
+}
+
+func (cc *ShellCompleter) ResetCache() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.services = nil
+	cc.peers = nil
+	cc.tunnels = nil
 }
 
-func (cc ShellCompleter) IsExist(cmd string) bool {
+func (cc *ShellCompleter) IsExist(cmd string) bool {
 	for _, item := range cc.suggest {
 		if item.Text == cmd {
 			return true
@@ -90,7 +303,7 @@ func (cc ShellCompleter) IsExist(cmd string) bool {
 	return false
 }
 
-func (cc ShellCompleter) PrintHelp() {
+func (cc *ShellCompleter) PrintHelp() {
 	fmt.Println("All avaiable commands: ")
 	for _, item := range cc.suggest {
 		fmt.Printf("  %s - %s\n", item.Text, item.Description)
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func completeTestTexts(cc *ShellCompleter, cmd string, pos int, word string) []string {
+	var texts []string
+	for _, item := range cc.CompleteArgument(cmd, pos, word) {
+		texts = append(texts, item.Text)
+	}
+	return texts
+}
+
+func TestCompleteArgumentNames(t *testing.T) {
+	cc := NewShellCompleter()
+	cc.Init(true)
+	if names := cc.GetArgumentNames(kActionKickMember); !reflect.DeepEqual(names, []string{"serviceName", "pwd", "peerId"}) {
+		t.Errorf("names of kick-member: %v", names)
+	}
+	if names := cc.GetArgumentNames("no-such-command"); names != nil {
+		t.Errorf("names of unknown: %v", names)
+	}
+}
+
+// services by state of command, tunnels first if any, hints when nothing cached
+func TestCompleteArgumentCandidates(t *testing.T) {
+	client := NewShellCompleter()
+	client.Init(false)
+	cc := NewShellCompleter()
+	cc.Init(true)
+
+	if texts := completeTestTexts(client, kActionJoinService, 0, ""); !reflect.DeepEqual(texts, []string{"<serviceName>"}) {
+		t.Errorf("hint without cache: %v", texts)
+	}
+
+	infos := []*SignalServiceInfo{
+		{Name: "web-other", Owner: "alice", State: kServiceStateNone},
+		{Name: "ssh-joined", Owner: "bobby", State: kServiceStateJoined},
+		{Name: "ssh-mine", Owner: "me", State: kServiceStateOwned},
+	}
+	client.UpdateServices(infos)
+	cc.UpdateServices(infos)
+	cases := []struct {
+		cc     *ShellCompleter
+		cmd    string
+		word   string
+		expect []string
+	}{
+		{client, kActionJoinService, "", []string{"web-other"}},
+		{client, kActionConnectService, "", []string{"ssh-joined"}},
+		{cc, kActionRemoveService, "", []string{"ssh-mine"}},
+		{cc, kActionShowService, "ssh", []string{"ssh-joined", "ssh-mine"}},
+		{cc, kActionShowService, "SSH-M", []string{"ssh-mine"}},
+		{cc, kActionShowService, "none", nil},
+	}
+	for _, item := range cases {
+		if texts := completeTestTexts(item.cc, item.cmd, 0, item.word); !reflect.DeepEqual(texts, item.expect) {
+			t.Errorf("%s %q: %v, want %v", item.cmd, item.word, texts, item.expect)
+		}
+	}
+
+	// password is never completed, peers by position
+	if texts := completeTestTexts(cc, kActionKickMember, 1, ""); !reflect.DeepEqual(texts, []string{"<pwd>"}) {
+		t.Errorf("kick-member pwd: %v", texts)
+	}
+	cc.UpdateTunnels([]string{"ssh-joined"}, []string{"carol", "alice"})
+	if texts := completeTestTexts(cc, kActionKickMember, 2, ""); !reflect.DeepEqual(texts, []string{"alice", "carol"}) {
+		t.Errorf("kick-member peerId: %v", texts)
+	}
+	if texts := completeTestTexts(cc, kActionCloseTunnel, 0, ""); !reflect.DeepEqual(texts, []string{"ssh-joined"}) {
+		t.Errorf("close-tunnel: %v", texts)
+	}
+	if texts := completeTestTexts(cc, kActionKickMember, 3, ""); len(texts) != 0 {
+		t.Errorf("beyond arguments: %v", texts)
+	}
+
+	cc.ResetCache()
+	if texts := completeTestTexts(cc, kActionConnectService, 0, "ssh"); len(texts) != 0 {
+		t.Errorf("after reset: %v", texts)
+	}
+}
@@ -1,3 +1,566 @@
 package main
 
-type Conference struct{}
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kConferenceMaxMessage = 1200 // one ice packet
+)
+
+/**
+ * Conference(room) of peers, kept by signal server in memory.
+ *	a. create/join/leave by signal, join/leave events are fanned out to members,
+ *	   only the owner and peers invited by owner can join
+ *	b. newcomer builds mesh ice connections to existing members,
+ *	   by ice-auth/ice-candidate with ConferenceId and ToId
+ *	c. conference-send broadcasts one message to all connected members
+ */
+func NewConference(id uint32, owner string) *Conference {
+	return &Conference{
+		Id:      id,
+		Owner:   owner,
+		Members: make(map[string]bool),
+		Invited: make(map[string]bool),
+		Ctime:   util.NowMs(),
+	}
+}
+
+type Conference struct {
+	Id      uint32
+	Owner   string
+	Members map[string]bool
+	Invited map[string]bool
+	Ctime   int64
+}
+
+func (c *Conference) GetMembers() []string {
+	var members []string
+	for id := range c.Members {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+	return members
+}
+
+/**
+ * Conference info, returned by conferences
+ */
+type ConferenceInfo struct {
+	Id      uint32
+	Owner   string
+	Members []string
+}
+
+func ParseConferenceId(param string) (uint32, error) {
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || id == 0 {
+		return 0, errFnInvalidParamters([]string{param})
+	}
+	return uint32(id), nil
+}
+
+/// signal server operations
+
+func (ss *SignalServer) CheckConference(req *SignalRequest) (*Conference, error) {
+	if _, err := ss.CheckOnline(req.FromId); err != nil {
+		return nil, err
+	}
+	if conf, ok := ss.conferences[req.ConferenceId]; !ok {
+		return nil, errConferenceNotExist
+	} else {
+		return conf, nil
+	}
+}
+
+func (ss *SignalServer) CreateConference(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckOnline(req.FromId); err != nil {
+		return err
+	}
+
+	var id uint32
+	for id == 0 || ss.conferences[id] != nil {
+		id = rand.Uint32()
+	}
+	conf := NewConference(id, req.FromId)
+	conf.Members[req.FromId] = true
+	ss.conferences[id] = conf
+	resp.ResultM["conference"] = fmt.Sprint(id)
+	return nil
+}
+
+// return existing members, and notify them
+func (ss *SignalServer) JoinConference(req *SignalRequest, resp *SignalResponse) error {
+	conf, err := ss.CheckConference(req)
+	if err != nil {
+		return err
+	}
+	if conf.Members[req.FromId] {
+		return errConferenceJoined
+	}
+	if req.FromId != conf.Owner && !conf.Invited[req.FromId] {
+		return errConferenceNotInvited
+	}
+
+	resp.ResultL = conf.GetMembers()
+	resp.ResultM["conference"] = fmt.Sprint(conf.Id)
+	conf.Members[req.FromId] = true
+	ss.NotifyConference(conf, kActionEventConferenceJoin, req.FromId)
+	return nil
+}
+
+// owner invites one registered peer(ToId)
+func (ss *SignalServer) InviteConference(req *SignalRequest, resp *SignalResponse) error {
+	conf, err := ss.CheckConference(req)
+	if err != nil {
+		return err
+	}
+	if req.FromId != conf.Owner {
+		return errConferenceRequireOwner
+	}
+	if _, ok := ss.db.Peers[req.ToId]; !ok {
+		return errClientNotExist
+	}
+	conf.Invited[req.ToId] = true
+	resp.ResultM["conference"] = fmt.Sprint(conf.Id)
+	return nil
+}
+
+func (ss *SignalServer) LeaveConference(req *SignalRequest, resp *SignalResponse) error {
+	conf, err := ss.CheckConference(req)
+	if err != nil {
+		return err
+	}
+	if !conf.Members[req.FromId] {
+		return errConferenceNotJoined
+	}
+	ss.RemoveConferenceMember(conf, req.FromId)
+	return nil
+}
+
+// return my conferences
+func (ss *SignalServer) Conferences(req *SignalRequest, resp *SignalResponse) error {
+	if _, err := ss.CheckOnline(req.FromId); err != nil {
+		return err
+	}
+	for _, conf := range ss.conferences {
+		if conf.Members[req.FromId] {
+			info := &ConferenceInfo{Id: conf.Id, Owner: conf.Owner, Members: conf.GetMembers()}
+			resp.ResultL = append(resp.ResultL, util.JsonEncode(info))
+		}
+	}
+	return nil
+}
+
+// the last one leaves and conference is removed
+func (ss *SignalServer) RemoveConferenceMember(conf *Conference, id string) {
+	delete(conf.Members, id)
+	if len(conf.Members) == 0 {
+		delete(ss.conferences, conf.Id)
+	} else {
+		ss.NotifyConference(conf, kActionEventConferenceLeave, id)
+	}
+}
+
+// leave all conferences when offline
+func (ss *SignalServer) LeaveConferences(id string) {
+	for _, conf := range ss.conferences {
+		if conf.Members[id] {
+			ss.RemoveConferenceMember(conf, id)
+		}
+	}
+}
+
+// fan out event to other online members
+func (ss *SignalServer) NotifyConference(conf *Conference, event, fromId string) {
+	for member := range conf.Members {
+		if member == fromId {
+			continue
+		}
+		if conn, ok := ss.onlines[member]; ok {
+			ev := NewSignalResponse("")
+			ev.Event = event
+			ev.FromId = fromId
+			ev.ConferenceId = conf.Id
+			ev.ResultM["conference"] = fmt.Sprint(conf.Id)
+			conn.Send(ev)
+		}
+	}
+}
+
+// ice-auth/ice-candidate between two members
+func (ss *SignalServer) ForwardConferenceData(req *SignalRequest, resp *SignalResponse) error {
+	conf, err := ss.CheckConference(req)
+	if err != nil {
+		return err
+	}
+	if !conf.Members[req.FromId] || !conf.Members[req.ToId] {
+		return errConferenceNotJoined
+	}
+	if conn, err := ss.CheckOnlineConn(req.ToId); err != nil {
+		return err
+	} else {
+		resp.Event = req.Action
+		resp.FromId = req.FromId
+		resp.ConferenceId = conf.Id
+		resp.ResultM["conference"] = fmt.Sprint(conf.Id)
+		resp.conn = conn
+	}
+	return nil
+}
+
+/// endpoint operations
+
+// one member of local conference, connected by full ice
+type ConferencePeer struct {
+	id          uint32
+	peerId      string
+	controlling bool
+	agent       *IceAgent
+	remoteUfrag string
+	remotePwd   string
+	started     bool
+	connected   bool
+	ch_close    chan bool
+}
+
+type LocalConference struct {
+	id      uint32
+	peers   map[string]*ConferencePeer // key: peerId
+	members map[string]bool            // by join result and join/leave events
+}
+
+func NewLocalConference(id uint32, members []string) *LocalConference {
+	conf := &LocalConference{
+		id:      id,
+		peers:   make(map[string]*ConferencePeer),
+		members: make(map[string]bool),
+	}
+	for _, member := range members {
+		conf.members[member] = true
+	}
+	return conf
+}
+
+func (e *Endpoint) CreateConference(action string, params []string) (*Result, error) {
+	resp, err := e.signal.ControlConference(action, params)
+	if err != nil {
+		return nil, err
+	}
+	id, err := ParseConferenceId(resp.ResultM["conference"])
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.conferences[id] = NewLocalConference(id, nil)
+	e.mu.Unlock()
+	return NewResultValue(fmt.Sprint(id), id), nil
+}
+
+// join and connect to existing members
+func (e *Endpoint) JoinConference(action string, params []string) (*Result, error) {
+	resp, err := e.signal.ControlConference(action, params)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := ParseConferenceId(params[0])
+
+	e.mu.Lock()
+	e.conferences[id] = NewLocalConference(id, resp.ResultL)
+	e.mu.Unlock()
+	for _, member := range resp.ResultL {
+		e.GetConferencePeer(id, member, true)
+	}
+	return NewResultValue(strings.Join(resp.ResultL, "\n"), resp.ResultL), nil
+}
+
+func (e *Endpoint) InviteConference(action string, params []string) (*Result, error) {
+	if _, err := e.signal.ControlConference(action, params); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (e *Endpoint) LeaveConference(action string, params []string) (*Result, error) {
+	if _, err := e.signal.ControlConference(action, params); err != nil {
+		return nil, err
+	}
+	id, _ := ParseConferenceId(params[0])
+	e.CloseLocalConference(id)
+	return nil, nil
+}
+
+func (e *Endpoint) Conferences(action string, params []string) (*Result, error) {
+	resp, err := e.signal.ControlConference(action, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	infos := []*ConferenceInfo{}
+	for _, item := range resp.ResultL {
+		info := &ConferenceInfo{}
+		if err := json.Unmarshal([]byte(item), info); err != nil {
+			continue
+		}
+		infos = append(infos, info)
+		lines = append(lines, fmt.Sprintf("%d - %s owned, members: %s", info.Id, info.Owner, strings.Join(info.Members, ",")))
+	}
+	return NewResultValue(strings.Join(lines, "\n"), infos), nil
+}
+
+// conference-send conferenceId message, broadcast to connected members
+func (e *Endpoint) ConferenceSend(action string, params []string) (*Result, error) {
+	if len(params) != 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+	id, err := ParseConferenceId(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(params[1]) == 0 || len(params[1]) > kConferenceMaxMessage {
+		return nil, errConferenceMessageSize
+	}
+
+	e.mu.Lock()
+	conf, ok := e.conferences[id]
+	var peers []*ConferencePeer
+	if ok {
+		for _, peer := range conf.peers {
+			if peer.connected {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	e.mu.Unlock()
+	if !ok {
+		return nil, errConferenceNotJoined
+	}
+
+	for _, peer := range peers {
+		data := []byte(params[1])
+		select {
+		case peer.agent.ch_send <- data:
+		case <-peer.ch_close:
+		}
+	}
+	return NewResultValue(fmt.Sprintf("sent to %d members", len(peers)), len(peers)), nil
+}
+
+// events of conference: join/leave, ice-auth/ice-candidate
+func (e *Endpoint) OnConferenceEvent(resp *SignalResponse) {
+	switch resp.Event {
+	case kActionEventConferenceJoin:
+		// newcomer will connect to me
+		e.SetConferenceMember(resp.ConferenceId, resp.FromId, true)
+	case kActionEventConferenceLeave:
+		e.SetConferenceMember(resp.ConferenceId, resp.FromId, false)
+		e.CloseConferencePeer(resp.ConferenceId, resp.FromId)
+	case kActionEventIceAuth:
+		// created only for current member, as controlled
+		peer := e.FindConferencePeer(resp.ConferenceId, resp.FromId)
+		if peer == nil && e.IsConferenceMember(resp.ConferenceId, resp.FromId) {
+			peer = e.GetConferencePeer(resp.ConferenceId, resp.FromId, false)
+		}
+		if peer != nil {
+			e.mu.Lock()
+			peer.remoteUfrag = resp.ResultM["ice-ufrag"]
+			peer.remotePwd = resp.ResultM["ice-pwd"]
+			e.mu.Unlock()
+			e.StartConferencePeer(peer)
+		}
+	case kActionEventIceCandidate:
+		// never create peer, candidates follow ice-auth
+		if peer := e.FindConferencePeer(resp.ConferenceId, resp.FromId); peer != nil {
+			peer.agent.AddRemoteCandidate(resp.ResultM["ice-candidate"])
+		}
+	}
+}
+
+func (e *Endpoint) SetConferenceMember(id uint32, peerId string, joined bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if conf, ok := e.conferences[id]; ok {
+		if joined {
+			conf.members[peerId] = true
+		} else {
+			delete(conf.members, peerId)
+		}
+	}
+}
+
+func (e *Endpoint) IsConferenceMember(id uint32, peerId string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	conf, ok := e.conferences[id]
+	return ok && conf.members[peerId]
+}
+
+// lookup only, nil if not created
+func (e *Endpoint) FindConferencePeer(id uint32, peerId string) *ConferencePeer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if conf, ok := e.conferences[id]; ok {
+		return conf.peers[peerId]
+	}
+	return nil
+}
+
+// get or create peer of conference, the newcomer is controlling.
+// ice agent is inited(gathering) out of lock.
+func (e *Endpoint) GetConferencePeer(id uint32, peerId string, controlling bool) *ConferencePeer {
+	e.mu.Lock()
+	conf, ok := e.conferences[id]
+	if !ok {
+		e.mu.Unlock()
+		log.Println("conference not joined:", id)
+		return nil
+	}
+	if peer, ok := conf.peers[peerId]; ok {
+		e.mu.Unlock()
+		return peer
+	}
+	iceNet := e.iceNet
+	e.mu.Unlock()
+
+	peer := &ConferencePeer{
+		id:          id,
+		peerId:      peerId,
+		controlling: controlling,
+		agent:       NewIceAgent(controlling),
+		ch_close:    make(chan bool),
+	}
+	peer.agent.lite = false
+	peer.agent.SetNet(iceNet)
+	peer.agent.ListenEvent("ice-auth", func(ev evEvent) error {
+		ufrag, _ := ev.Get("ufrag").(string)
+		pwd, _ := ev.Get("pwd").(string)
+		e.signal.SendConferenceIceAuth(id, peerId, ufrag, pwd)
+		return nil
+	})
+	peer.agent.ListenEvent("ice-candidate", func(ev evEvent) error {
+		if candidate, _ := ev.Get("candidate").(string); len(candidate) > 0 {
+			e.signal.SendConferenceIceCandidate(id, peerId, candidate)
+		}
+		return nil
+	})
+	if err := peer.agent.Init([]string{}); err != nil {
+		log.Println("conference ice init error:", id, peerId, err)
+		return nil
+	}
+
+	// created by others meanwhile, or conference closed
+	e.mu.Lock()
+	conf, ok = e.conferences[id]
+	if !ok {
+		e.mu.Unlock()
+		peer.agent.Uninit()
+		return nil
+	}
+	if other, ok := conf.peers[peerId]; ok {
+		e.mu.Unlock()
+		peer.agent.Uninit()
+		return other
+	}
+	conf.peers[peerId] = peer
+	e.mu.Unlock()
+	return peer
+}
+
+// start ice once remote auth is known, dial/accept is blocking
+func (e *Endpoint) StartConferencePeer(peer *ConferencePeer) {
+	e.mu.Lock()
+	if peer.started || len(peer.remoteUfrag) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	peer.started = true
+	ufrag, pwd := peer.remoteUfrag, peer.remotePwd
+	e.mu.Unlock()
+
+	go func() {
+		if err := peer.agent.Start(ufrag, pwd); err != nil {
+			log.Println("conference ice start error:", peer.id, peer.peerId, err)
+			e.CloseConferencePeer(peer.id, peer.peerId)
+			return
+		}
+		e.mu.Lock()
+		peer.connected = true
+		e.mu.Unlock()
+
+		for {
+			select {
+			case data := <-peer.agent.ch_recv:
+				e.OnConferenceMessage(peer.id, peer.peerId, data)
+			case <-peer.ch_close:
+				return
+			}
+		}
+	}()
+}
+
+func (e *Endpoint) OnConferenceMessage(id uint32, fromId string, data []byte) {
+	if e.output == kOutputJson {
+		resp := NewSignalResponse("")
+		resp.Event = kActionEventConferenceMessage
+		resp.FromId = fromId
+		resp.ConferenceId = id
+		resp.ResultM["conference"] = fmt.Sprint(id)
+		resp.ResultM["message"] = string(data)
+		PrintEvent(e.output, resp)
+	} else {
+		fmt.Printf("== conference %d, %s: %s\n", id, fromId, string(data))
+	}
+}
+
+func (e *Endpoint) CloseConferencePeer(id uint32, peerId string) {
+	e.mu.Lock()
+	var peer *ConferencePeer
+	if conf, ok := e.conferences[id]; ok {
+		peer = conf.peers[peerId]
+		delete(conf.peers, peerId)
+	}
+	e.mu.Unlock()
+
+	if peer != nil {
+		close(peer.ch_close)
+		peer.agent.Uninit()
+	}
+}
+
+func (e *Endpoint) CloseLocalConference(id uint32) {
+	e.mu.Lock()
+	conf, ok := e.conferences[id]
+	delete(e.conferences, id)
+	e.mu.Unlock()
+
+	if ok {
+		for _, peer := range conf.peers {
+			close(peer.ch_close)
+			peer.agent.Uninit()
+		}
+	}
+}
+
+// offline, all local conferences are invalid
+func (e *Endpoint) CloseLocalConferences() {
+	e.mu.Lock()
+	var ids []uint32
+	for id := range e.conferences {
+		ids = append(ids, id)
+	}
+	e.mu.Unlock()
+
+	for _, id := range ids {
+		e.CloseLocalConference(id)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJoinConferenceInvited(t *testing.T) {
+	ss := newTestSignalServer()
+	owner := newTestPeer(t, ss, "owner", "")
+	alice := newTestPeer(t, ss, "alice", "")
+	mallory := newTestPeer(t, ss, "mallory", "")
+
+	resp := doTestRequest(t, owner, kActionCreateConference, NewSignalRequest("owner"))
+	id, err := ParseConferenceId(resp.ResultM["conference"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := func(conn *SignalConnection, action, fromId, toId string) string {
+		req := NewSignalRequest(fromId)
+		req.ConferenceId = id
+		req.ToId = toId
+		return doTestRequest(t, conn, action, req).ErrorCode
+	}
+
+	if code := conference(alice, kActionJoinConference, "alice", ""); code != ErrorCode(errConferenceNotInvited) {
+		t.Errorf("join without invite: %q, want not-invited", code)
+	}
+	if code := conference(mallory, kActionInviteConference, "mallory", "mallory"); code != ErrorCode(errConferenceRequireOwner) {
+		t.Errorf("invite by non-owner: %q, want require-owner", code)
+	}
+	if code := conference(owner, kActionInviteConference, "owner", "nobody"); code != ErrorCode(errClientNotExist) {
+		t.Errorf("invite unknown peer: %q, want client-not-exist", code)
+	}
+	if code := conference(owner, kActionInviteConference, "owner", "alice"); len(code) > 0 {
+		t.Fatalf("invite alice: %q", code)
+	}
+	if code := conference(alice, kActionJoinConference, "alice", ""); len(code) > 0 {
+		t.Errorf("join with invite: %q", code)
+	}
+	if code := conference(mallory, kActionJoinConference, "mallory", ""); code != ErrorCode(errConferenceNotInvited) {
+		t.Errorf("join by others: %q, want not-invited", code)
+	}
+
+	// owner rejoins without invite
+	if code := conference(owner, kActionLeaveConference, "owner", ""); len(code) > 0 {
+		t.Fatalf("leave by owner: %q", code)
+	}
+	if code := conference(owner, kActionJoinConference, "owner", ""); len(code) > 0 {
+		t.Errorf("rejoin by owner: %q", code)
+	}
+}
+
+// peers are never created by ice-candidate, or by ice-auth of non-member
+func TestConferenceEventCreatePeer(t *testing.T) {
+	e := NewEndpoint(nil, false)
+	const id = 1001
+	e.conferences[id] = NewLocalConference(id, []string{"alice"})
+
+	event := func(name, fromId string) {
+		resp := NewSignalResponse("")
+		resp.Event = name
+		resp.FromId = fromId
+		resp.ConferenceId = id
+		resp.ResultM["ice-ufrag"] = "ufrag"
+		resp.ResultM["ice-pwd"] = "pwd"
+		resp.ResultM["ice-candidate"] = kBenchCandidate
+		e.OnConferenceEvent(resp)
+	}
+
+	event(kActionEventIceCandidate, "alice")
+	event(kActionEventIceAuth, "mallory")
+	event(kActionEventIceCandidate, "mallory")
+	if n := len(e.conferences[id].peers); n != 0 {
+		t.Fatalf("peers created: %d", n)
+	}
+
+	event(kActionEventConferenceJoin, "bobby")
+	if !e.IsConferenceMember(id, "bobby") {
+		t.Error("joined peer is not member")
+	}
+	event(kActionEventConferenceLeave, "alice")
+	if e.IsConferenceMember(id, "alice") {
+		t.Error("left peer is still member")
+	}
+	event(kActionEventIceAuth, "alice")
+	if n := len(e.conferences[id].peers); n != 0 {
+		t.Fatalf("peer created for left member: %d", n)
+	}
+}
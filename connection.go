@@ -3,11 +3,24 @@ package main
 import (
 	"bytes"
 	"log"
+	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	util "github.com/PeterXu/goutil"
+	gn "github.com/panjf2000/gnet"
+)
+
+const (
+	kConnectionTimeout = 30 * 1000 // ms
+
+	// consent freshness(RFC 7675)
+	kConsentInterval = 5 * 1000  // ms, randomized by +/-20%
+	kConsentTimeout  = 30 * 1000 // ms, path is dead without response
+	kConsentPending  = 16        // max pending transactions
+	kConsentWindow   = 32        // binding requests of loss statistics
 )
 
 type Connection struct {
@@ -16,11 +29,20 @@ type Connection struct {
 	addr     net.Addr
 	stunName string
 	ready    bool
+	dead     bool // consent expired
 	pc       *PeerConnection
+	conn     gn.Conn   // udp conn of gateway, or tcp conn of ice-tcp
+	tcp      bool      // rfc4571 framing by codec of tcp service
+	stun     *StunInfo // negotiated ice credentials
 
-	stunRequesting         int
-	hadStunChecking        bool
-	hadStunBindingResponse bool
+	mu          sync.Mutex
+	checking    bool
+	consentTime int64            // last binding response
+	pending     map[string]int64 // transId => send time
+	rtt         int              // ms, smoothed
+	sent        int              // binding requests
+	lost        int              // binding requests without response
+	ch_stop     chan bool
 
 	*TimeInfo
 }
@@ -30,37 +52,82 @@ func NewConnection(addr net.Addr, stunName string) *Connection {
 		TAG:      "[CONN]",
 		addr:     addr,
 		stunName: stunName,
+		pending:  make(map[string]int64),
+		ch_stop:  make(chan bool),
 		TimeInfo: NewTimeInfo(),
 	}
 }
 
-func (c Connection) getStunName() string {
+func (c *Connection) getStunName() string {
 	return c.stunName
 }
 
-func (c Connection) getRemoteAddr() net.Addr {
+func (c *Connection) getRemoteAddr() net.Addr {
 	return c.addr
 }
 
-func (c Connection) isReady() bool {
-	return c.ready
+func (c *Connection) isReady() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready && !c.dead
+}
+
+// smoothed rtt in ms, -1 if unknown
+func (c *Connection) getRtt() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent == 0 || c.sent == c.lost {
+		return -1
+	}
+	return c.rtt
+}
+
+// loss rate(0-100) of recent binding requests, in-flight one excluded
+func (c *Connection) getLoss() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, lost := c.sent, c.lost
+	if lost > 0 && len(c.pending) > 0 {
+		sent, lost = sent-1, lost-1
+	}
+	if sent <= 0 {
+		return 0
+	}
+	return lost * 100 / sent
 }
 
 func (c *Connection) sendData(data []byte) bool {
-	return false
+	if c.conn == nil {
+		return false
+	}
+	var err error
+	if c.tcp {
+		err = c.conn.AsyncWrite(data)
+	} else {
+		err = c.conn.SendTo(data)
+	}
+	if err != nil {
+		log.Println(c.TAG, "send data error:", err)
+		return false
+	}
+	return true
 }
 
 func (c *Connection) onReceivedData(data []byte) {
 	c.updateTime()
 
-	if util.IsStunPacket(data) {
+	switch DemuxPacket(data) {
+	case kPacketStun:
+		if !util.IsStunPacket(data) {
+			log.Println(c.TAG, "invalid stun packet")
+			return
+		}
 		var msg util.IceMessage
 		if err := msg.Read(data); err != nil {
 			log.Println(c.TAG, "invalid stun message", err)
 			return
 		}
 
-		log.Println(c.TAG, "handle stun message")
 		switch msg.Dtype {
 		case util.STUN_BINDING_REQUEST:
 			attr := msg.GetAttribute(util.STUN_ATTR_USERNAME)
@@ -71,29 +138,44 @@ func (c *Connection) onReceivedData(data []byte) {
 
 			stunName := string(attr.(*util.StunByteStringAttribute).Data)
 			items := strings.Split(stunName, ":")
-			if len(items) != 2 {
+			if len(items) != 2 || stunName != c.stunName {
 				log.Println(c.TAG, "invalid stun name:", stunName)
 				return
 			}
-			c.onRecvStunBindingRequest(msg.TransId)
-		case util.STUN_BINDING_RESPONSE:
-			if c.hadStunBindingResponse {
-				log.Println(c.TAG, "had stun binding response")
+			var localPwd string
+			if c.stun != nil {
+				localPwd = c.stun.localPwd
+			}
+			if err := VerifyStunMessage(data, localPwd); err != nil {
+				log.Println(c.TAG, "stun verify error:", err)
+				c.sendData(GenStunErrorResponse(data, 401, "Unauthorized"))
 				return
 			}
-			log.Println(c.TAG, "recv stun binding response")
-			c.hadStunBindingResponse = true
+			// ice-lite: valid binding request makes the path ready
+			c.mu.Lock()
 			c.ready = true
+			c.mu.Unlock()
+			c.onRecvStunBindingRequest(msg.TransId)
+		case util.STUN_BINDING_RESPONSE:
+			c.onRecvStunBindingResponse(msg.TransId)
 		case util.STUN_BINDING_ERROR_RESPONSE:
 			log.Println(c.TAG, "error stun message")
 		default:
 			log.Println(c.TAG, "invalid stun type =", msg.Dtype)
 		}
-	} else {
+	case kPacketDtls:
+		c.mu.Lock()
 		c.ready = true
+		c.mu.Unlock()
 		if c.pc != nil {
 			c.pc.onRecvDtlsData(data)
 		}
+	case kPacketRtp:
+		if c.pc != nil && c.isReady() {
+			c.pc.OnRtpRtcpData(data, c.stunName)
+		}
+	default:
+		log.Println(c.TAG, "drop unknown packet, first byte=", data[0])
 	}
 }
 
@@ -104,7 +186,10 @@ func (c *Connection) onRecvStunBindingRequest(transId string) {
 	}
 
 	//log.Println(c.TAG, "send stun binding response")
-	sendPwd := ""
+	var sendPwd string
+	if c.stun != nil {
+		sendPwd = c.stun.localPwd
+	}
 
 	var buf bytes.Buffer
 	if err := util.GenStunMessageResponse(&buf, sendPwd, transId, c.addr); err != nil {
@@ -117,56 +202,125 @@ func (c *Connection) onRecvStunBindingRequest(transId string) {
 	c.checkStunBindingRequest()
 }
 
+// response of our consent request, refresh consent and measure rtt
+func (c *Connection) onRecvStunBindingResponse(transId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sendTime, ok := c.pending[transId]
+	if !ok {
+		log.Println(c.TAG, "unknown stun binding response")
+		return
+	}
+	delete(c.pending, transId)
+
+	now := util.NowMs()
+	rtt := int(now - sendTime)
+	if c.sent-c.lost <= 1 {
+		c.rtt = rtt
+	} else {
+		c.rtt = (c.rtt*7 + rtt) / 8
+	}
+	if c.lost > 0 {
+		c.lost -= 1
+	}
+	c.consentTime = now
+}
+
+// send authenticated binding request with negotiated credentials
 func (c *Connection) sendStunBindingRequest() bool {
-	if c.hadStunBindingResponse {
+	if c.stun == nil {
 		return false
 	}
 
-	//log.Println(c.TAG, "send stun binding request")
-	var sendUfrag string
-	var recvUfrag, recvPwd string
-
 	var buf bytes.Buffer
-	if err := util.GenStunMessageRequest(&buf, sendUfrag, recvUfrag, recvPwd); err == nil {
-		log.Println(c.TAG, "send stun binding request, len=", buf.Len())
-		c.sendData(buf.Bytes())
-	} else {
+	if err := util.GenStunMessageRequest(&buf, c.stun.localUfrag, c.stun.remoteUfrag, c.stun.remotePwd); err != nil {
 		log.Println(c.TAG, "fail to get stun request bufffer", err)
+		return false
 	}
-	return true
-}
 
-func (c *Connection) checkStunBindingRequest() {
-	if !c.sendStunBindingRequest() {
-		return
+	var msg util.IceMessage
+	if err := msg.Read(buf.Bytes()); err != nil {
+		log.Println(c.TAG, "fail to read stun request", err)
+		return false
+	}
+
+	c.mu.Lock()
+	if len(c.pending) >= kConsentPending {
+		// drop the oldest one
+		var oldKey string
+		var oldTime int64
+		for k, v := range c.pending {
+			if len(oldKey) == 0 || v < oldTime {
+				oldKey, oldTime = k, v
+			}
+		}
+		delete(c.pending, oldKey)
 	}
+	c.pending[msg.TransId] = util.NowMs()
+	if c.sent >= kConsentWindow {
+		// decay to keep recent statistics
+		c.sent, c.lost = c.sent/2, c.lost/2
+	}
+	c.sent += 1
+	c.lost += 1 // until response
+	c.mu.Unlock()
 
-	if c.hadStunChecking {
+	return c.sendData(buf.Bytes())
+}
+
+// start consent freshness once the path is ready
+func (c *Connection) checkStunBindingRequest() {
+	c.mu.Lock()
+	if c.checking || c.dead {
+		c.mu.Unlock()
 		return
 	}
+	c.checking = true
+	c.consentTime = util.NowMs()
+	c.mu.Unlock()
 
-	c.hadStunChecking = true
 	go func() {
-		c.stunRequesting = 500
 		for {
+			delay := kConsentInterval * (80 + rand.Intn(41)) / 100
 			select {
-			case <-time.After(time.Millisecond * time.Duration(c.stunRequesting)):
-				if !c.sendStunBindingRequest() {
-					log.Println(c.TAG, "quit stun request interval")
-					c.hadStunChecking = false
-					return
-				}
-
-				if delta := c.TimeInfo.sinceLastUpdate(); delta >= (15 * 1000) {
-					log.Println(c.TAG, "no response from client and quit")
-					return
-				} else if delta > (5 * 1000) {
-					log.Println(c.TAG, "adjust stun request interval")
-					c.stunRequesting = delta / 2
-				} else if delta < 500 {
-					c.stunRequesting = 500
-				}
+			case <-c.ch_stop:
+				return
+			case <-time.After(time.Millisecond * time.Duration(delay)):
+			}
+
+			if c.expireConsent(util.NowMs()) {
+				return
 			}
+			c.sendStunBindingRequest()
 		}
 	}()
 }
+
+// path is dead without binding response in kConsentTimeout
+func (c *Connection) expireConsent(now int64) bool {
+	c.mu.Lock()
+	expired := now > c.consentTime+kConsentTimeout
+	if expired {
+		c.dead = true
+		c.checking = false
+	}
+	c.mu.Unlock()
+
+	if expired {
+		log.Println(c.TAG, "consent expired, addr=", c.addr)
+		if c.pc != nil {
+			c.pc.onConnectionDead(c)
+		}
+	}
+	return expired
+}
+
+func (c *Connection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dead {
+		c.dead = true
+		close(c.ch_stop)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// ready connection from 10.0.0.1:port, without socket
+func newTestConnection(port int) *Connection {
+	conn := NewConnection(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}, "local:remote")
+	conn.ready = true
+	return conn
+}
+
+func newTestPeerConnection(conns ...*Connection) *PeerConnection {
+	pc := &PeerConnection{
+		TAG:         "[PC]",
+		stunName:    "local:remote",
+		connections: make(map[string]*Connection),
+	}
+	for _, conn := range conns {
+		pc.addConnection(conn)
+	}
+	return pc
+}
+
+func TestConsentRtt(t *testing.T) {
+	conn := newTestConnection(1000)
+	if rtt := conn.getRtt(); rtt != -1 {
+		t.Errorf("rtt without response: %d", rtt)
+	}
+
+	now := util.NowMs()
+	conn.pending["t1"] = now - 40
+	conn.pending["t2"] = now
+	conn.sent, conn.lost = 2, 2
+	conn.onRecvStunBindingResponse("unknown")
+	if conn.lost != 2 || len(conn.pending) != 2 {
+		t.Fatalf("unknown response accepted: lost=%d", conn.lost)
+	}
+
+	conn.onRecvStunBindingResponse("t1")
+	if rtt := conn.getRtt(); rtt < 40 || rtt > 1000 {
+		t.Errorf("rtt: %d", rtt)
+	}
+	if conn.consentTime < now {
+		t.Errorf("consent not refreshed")
+	}
+	// t2 is in flight, not lost yet
+	if loss := conn.getLoss(); loss != 0 {
+		t.Errorf("loss with in-flight request: %d", loss)
+	}
+}
+
+// dead path without response, active one fails over
+func TestConsentExpired(t *testing.T) {
+	a, b := newTestConnection(1000), newTestConnection(2000)
+	pc := newTestPeerConnection(a, b)
+	pc.activeConn = a
+
+	now := util.NowMs()
+	a.consentTime = now
+	if a.expireConsent(now + kConsentTimeout) {
+		t.Fatal("expired within timeout")
+	}
+	if !a.expireConsent(now + kConsentTimeout + 1) {
+		t.Fatal("not expired after timeout")
+	}
+	if a.isReady() {
+		t.Error("dead conn is ready")
+	}
+	if pc.activeConn != nil {
+		t.Error("dead conn is still active")
+	}
+	if active := pc.getActiveConn(); active != b {
+		t.Errorf("fail over to %v, want %v", active, b)
+	}
+
+	// no consent check restarted on dead path
+	a.checkStunBindingRequest()
+	if a.checking {
+		t.Error("consent check of dead conn")
+	}
+}
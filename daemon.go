@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kCtlSockName = "netpie.sock"
+)
+
+// per-user socket, in $XDG_RUNTIME_DIR or ~/.netpie, both are 0700,
+// so no other user connects before it is chmod-ed.
+func DefaultCtlSock() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); len(dir) > 0 {
+		return filepath.Join(dir, kCtlSockName)
+	}
+	if dir, err := GetProfileDir(); err == nil {
+		return filepath.Join(dir, kCtlSockName)
+	}
+	return kCtlSockName
+}
+
+/**
+ * Control request/response, exchanged by daemon and `ctl` with json.
+ */
+type CtlRequest struct {
+	Action string
+	Params []string
+}
+
+type CtlResponse struct {
+	Result    string
+	Value     interface{} `json:",omitempty"`
+	Error     string
+	ErrorCode string
+}
+
+/**
+ * Daemon, run endpoint headless and serve control api on unix socket.
+ *	POST /run: CtlRequest -> CtlResponse
+ *	GET /actions: all available commands
+ */
+func NewDaemon(sigaddr, sockaddr string, isServer bool) *Daemon {
+	d := &Daemon{
+		sockaddr: sockaddr,
+	}
+	if isServer {
+		d.ep = NewServer(sigaddr).ep
+	} else {
+		d.ep = NewClient(sigaddr).ep
+	}
+	d.TAG = "daemon"
+	return d
+}
+
+type Daemon struct {
+	util.Logging
+
+	ep       *Endpoint
+	mu       sync.Mutex // serialize commands, as the shell does
+	sockaddr string
+	listener net.Listener
+}
+
+func (d *Daemon) Start() error {
+	// remove stale socket left by last run, never other files
+	if info, err := os.Lstat(d.sockaddr); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errFnNotSocket(d.sockaddr)
+		}
+		if err := os.Remove(d.sockaddr); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", d.sockaddr)
+	if err != nil {
+		return err
+	}
+	d.listener = listener
+	defer d.Stop()
+
+	// commands are run as owner of daemon
+	if err := os.Chmod(d.sockaddr, 0600); err != nil {
+		return err
+	}
+
+	d.ep.signal.Start()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", d.handleRun)
+	mux.HandleFunc("/actions", d.handleActions)
+
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		d.Println("exit by signal")
+		d.listener.Close()
+	}()
+
+	d.Println("control listening on", d.sockaddr)
+	if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (d *Daemon) Stop() {
+	if d.listener != nil {
+		d.listener.Close()
+		d.listener = nil
+	}
+	os.Remove(d.sockaddr)
+}
+
+func (d *Daemon) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CtlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := d.Run(req.Action, req.Params)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (d *Daemon) handleActions(w http.ResponseWriter, r *http.Request) {
+	var actions []string
+	for _, item := range d.ep.cc.suggest {
+		actions = append(actions, item.Text+" - "+item.Description)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
+
+func (d *Daemon) Run(action string, params []string) *CtlResponse {
+	resp := &CtlResponse{}
+	if !d.ep.cc.IsExist(action) || action == "help" || action == "set" {
+		err := errFnInvalidAction(action)
+		resp.Error = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+		return resp
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Println("run action:", action)
+	ret, err := d.ep.RunCommand(append([]string{action}, params...))
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+	}
+	if ret != nil {
+		resp.Result = ret.data
+		resp.Value = ret.value
+	}
+	return resp
+}
+
+/**
+ * Control client, used by `ctl` command.
+ */
+func NewCtlClient(sockaddr string) *CtlClient {
+	return &CtlClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", sockaddr)
+				},
+			},
+		},
+	}
+}
+
+type CtlClient struct {
+	http *http.Client
+}
+
+func (c *CtlClient) Actions() ([]string, error) {
+	resp, err := c.http.Get("http://netpie/actions")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var actions []string
+	if err := json.NewDecoder(resp.Body).Decode(&actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func (c *CtlClient) Run(action string, params []string) (*Result, error) {
+	data, err := json.Marshal(&CtlRequest{Action: action, Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Post("http://netpie/run", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ctlResp CtlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ctlResp); err != nil {
+		return nil, err
+	}
+
+	var ret *Result
+	if len(ctlResp.Result) > 0 || ctlResp.Value != nil {
+		ret = NewResultValue(ctlResp.Result, ctlResp.Value)
+	}
+	if len(ctlResp.Error) > 0 {
+		return ret, ErrorFromCode(ctlResp.ErrorCode, ctlResp.Error)
+	}
+	return ret, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDaemonSockNotRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpie-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// regular file and directory at sock path are kept
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "dir")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, sub} {
+		d := &Daemon{sockaddr: path}
+		if err := d.Start(); ErrorCode(err) != "not-socket" {
+			t.Errorf("start at %s: %v, want not-socket", path, err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+}
+
+// default socket is in a directory of owner only
+func TestDefaultCtlSock(t *testing.T) {
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	if sock := DefaultCtlSock(); sock != filepath.Join(runtime, kCtlSockName) {
+		t.Errorf("sock: %s, want in %s", sock, runtime)
+	}
+
+	home := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("HOME", home)
+	sock := DefaultCtlSock()
+	if sock != filepath.Join(home, kProfileDirectory, kCtlSockName) {
+		t.Fatalf("sock: %s, want in %s", sock, home)
+	}
+	info, err := os.Stat(filepath.Dir(sock))
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("sock dir: %v, %v", info, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kSendQueueSize = 256 // per connection
+
+	// policy of slow consumer whose send queue is full
+	kSlowPolicyClose = "close" // close the connection, client will reconnect
+	kSlowPolicyDrop  = "drop"  // drop the response/event
+)
+
+/**
+ * Dispatcher of signal server
+ *	a. requests are handled in readPump goroutine of each connection,
+ *	   in order for one connection and concurrently between connections.
+ *	b. server state is guarded by ss.mu, read lock for actions below.
+ *	c. responses/events are queued to buffered ch_send, never blocked,
+ *	   the slow consumer is closed or dropped by policy.
+ */
+
+// actions never changing server state(db, onlines, conferences, guards)
+var kSharedLockActions = map[string]bool{
+	kActionServices:          true,
+	kActionMyServices:        true,
+	kActionShowService:       true,
+	kActionInfo:              true,
+	kActionPeers:             true,
+	kActionAudit:             true,
+	kActionConferences:       true,
+	kActionConnectService:    true,
+	kActionDisconnectService: true,
+	kActionEventIceOpen:      true,
+	kActionEventIceClose:     true,
+	kActionEventIceOpenAck:   true,
+	kActionEventIceCloseAck:  true,
+	kActionEventIceAuth:      true,
+	kActionEventIceCandidate: true,
+	kActionEventOffer:        true,
+	kActionEventAnswer:       true,
+}
+
+func IsValidSlowPolicy(policy string) bool {
+	return policy == kSlowPolicyClose || policy == kSlowPolicyDrop
+}
+
+func (ss *SignalServer) SetSlowPolicy(policy string) error {
+	if !IsValidSlowPolicy(policy) {
+		return errFnInvalidParamters([]string{policy})
+	}
+	ss.slowPolicy = policy
+	return nil
+}
+
+func (ss *SignalServer) AddConnection(conn *SignalConnection) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.Printf("add one connection: %v\n", conn)
+	ss.connections[conn] = true
+}
+
+func (ss *SignalServer) RemoveConnection(conn *SignalConnection) {
+	ss.mu.Lock()
+	ss.Printf("close one connection:%v\n", conn)
+	if _, ok := ss.connections[conn]; ok {
+		delete(ss.connections, conn)
+	} else if ss.onlines[conn.id] == conn {
+		// all tunnels of peer are closed when offline
+		ss.OnTunnelClosed(conn.id, "", "offline")
+		delete(ss.onlines, conn.id)
+		ss.LeaveConferences(conn.id)
+		ss.PublishPresence()
+	}
+	conn.closeSend()
+	audits := ss.takeTunnelCloses()
+	ss.mu.Unlock()
+
+	ss.WriteAudit(audits)
+}
+
+// run fn with lock, false if timeout and then fn is never run,
+// so fn can write variables of caller without race.
+func (ss *SignalServer) Query(fn func()) bool {
+	var state int32 // 0: waiting, 1: running, 2: timeout
+	done := make(chan bool)
+	go func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			fn()
+			close(done)
+		}
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(kQueryTimeout):
+		if atomic.CompareAndSwapInt32(&state, 0, 2) {
+			return false
+		}
+		// fn is running
+		<-done
+		return true
+	}
+}
+
+/// signal connection operations
+
+// non-blocking, false if closed or dropped
+func (c *SignalConnection) Send(resp *SignalResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.ch_send <- resp:
+		return true
+	default:
+	}
+
+	c.ss.metrics.OnSlowConsumer()
+	if c.ss.slowPolicy == kSlowPolicyClose {
+		// writePump will close websocket and then readPump exits
+		c.ss.Warnf("conn, slow consumer closed: %v\n", c)
+		c.closed = true
+		close(c.ch_send)
+	}
+	return false
+}
+
+func (c *SignalConnection) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.ch_send)
+	}
+}
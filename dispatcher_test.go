@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// fill send queue of conn, the next Send is by slow policy
+func fillTestQueue(t *testing.T, conn *SignalConnection) {
+	t.Helper()
+	for i := 0; i < kSendQueueSize; i++ {
+		if !conn.Send(NewSignalResponse("")) {
+			t.Fatalf("send %d: queue full", i)
+		}
+	}
+}
+
+func TestSlowPolicyClose(t *testing.T) {
+	ss := newTestSignalServer()
+	ss.SetSlowPolicy(kSlowPolicyClose)
+	conn := newTestConn(ss)
+
+	fillTestQueue(t, conn)
+	if conn.Send(NewSignalResponse("")) {
+		t.Fatal("send to full queue")
+	}
+	count := 0
+	for range conn.ch_send {
+		count += 1
+	}
+	if count != kSendQueueSize {
+		t.Fatalf("queued %d, want %d", count, kSendQueueSize)
+	}
+	if conn.Send(NewSignalResponse("")) {
+		t.Fatal("send to closed conn")
+	}
+}
+
+func TestSlowPolicyDrop(t *testing.T) {
+	ss := newTestSignalServer()
+	ss.SetSlowPolicy(kSlowPolicyDrop)
+	conn := newTestConn(ss)
+
+	fillTestQueue(t, conn)
+	if conn.Send(NewSignalResponse("")) {
+		t.Fatal("send to full queue")
+	}
+
+	// conn is kept, and writable after read
+	<-conn.ch_send
+	if !conn.Send(NewSignalResponse("")) {
+		t.Fatal("send after read")
+	}
+	if len(conn.ch_send) != kSendQueueSize {
+		t.Fatalf("queued %d, want %d", len(conn.ch_send), kSendQueueSize)
+	}
+}
+
+func TestSharedLockActions(t *testing.T) {
+	ss := newTestSignalServer()
+	conn := newTestPeer(t, ss, "alice", "")
+
+	run := func(action string, req *SignalRequest) chan bool {
+		done := make(chan bool)
+		go func() {
+			req.Action = action
+			req.Sequence = util.RandomString(8)
+			req.conn = conn
+			ss.OnReceiveRequest(req)
+			close(done)
+		}()
+		return done
+	}
+
+	// shared action runs with read lock held by others
+	ss.mu.RLock()
+	select {
+	case <-run(kActionServices, NewSignalRequest("alice")):
+	case <-time.After(time.Second):
+		ss.mu.RUnlock()
+		t.Fatal("shared action blocked by read lock")
+	}
+
+	// exclusive action waits for read lock
+	req := NewSignalRequest("alice")
+	req.ProfileKey = kProfileName
+	req.ProfileValue = "Alice"
+	done := run(kActionSetProfile, req)
+	select {
+	case <-done:
+		ss.mu.RUnlock()
+		t.Fatal("exclusive action ran with read lock held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ss.mu.RUnlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("exclusive action blocked after read unlock")
+	}
+}
+
+/**
+ * Dispatcher without websocket, one owner per 10 peers,
+ * members run services and ice-candidate(forwarded to owner).
+ * thousands of concurrent peers over websockets are measured by
+ * `netpie bench -clients 2000` (see bench.go and TestBenchLoopback).
+ */
+func BenchmarkDispatch(b *testing.B) {
+	writer := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(writer)
+
+	const peers = 1000
+	ss := newTestSignalServer()
+	pwdMd5 := util.MD5SumGenerate([]string{kTestPassword})
+	conns := make([]*SignalConnection, peers)
+	var forwarded int64
+	for i := 0; i < peers; i++ {
+		id, owner := fmt.Sprintf("peer%06d", i), fmt.Sprintf("peer%06d", i-i%10)
+		conns[i] = newTestPeer(b, ss, id, "")
+		req := NewSignalRequest(id)
+		req.ServiceName = "svc-" + owner
+		req.ServicePwdMd5 = pwdMd5
+		if id == owner {
+			req.ServiceSalt = util.RandomString(4)
+			doTestRequest(b, conns[i], kActionCreateService, req)
+		} else {
+			doTestRequest(b, conns[i], kActionJoinService, req)
+		}
+		go func(conn *SignalConnection) {
+			for resp := range conn.ch_send {
+				if resp.Event == kActionEventIceCandidate {
+					atomic.AddInt64(&forwarded, 1)
+				}
+			}
+		}(conns[i])
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&next, 1)
+			i := int(n % peers)
+			if i%10 == 0 {
+				i += 1
+			}
+			id, owner := fmt.Sprintf("peer%06d", i), fmt.Sprintf("peer%06d", i-i%10)
+			req := NewSignalRequest(id)
+			req.Action = kActionServices
+			if n%2 == 0 {
+				req.Action = kActionEventIceCandidate
+				req.ServiceName = "svc-" + owner
+				req.IceCandidate = "candidate:1 1 udp 2130706431 127.0.0.1 9 typ host"
+			}
+			req.Sequence = util.RandomString(8)
+			req.conn = conns[i]
+			ss.OnReceiveRequest(req)
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&forwarded))/float64(b.N), "forwarded/op")
+}
+
+// audit/metrics of one request never hold the server lock
+func TestAuditOutOfLock(t *testing.T) {
+	ss := newTestSignalServer()
+	if err := ss.EnableAudit(filepath.Join(t.TempDir(), "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	admin := newTestPeer(t, ss, "admin", kRoleAdmin)
+
+	// audit file is blocked, e.g. slow disk
+	ss.audit.mu.Lock()
+	done := make(chan bool)
+	go func() {
+		req := NewSignalRequest("admin")
+		req.ServiceName = "svc"
+		req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+		req.ServiceSalt = util.RandomString(4)
+		doTestRequest(t, admin, kActionCreateService, req)
+		close(done)
+	}()
+
+	// the lock is free while create-service is writing audit
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan bool)
+	go func() {
+		ss.mu.Lock()
+		ss.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("server lock held by audit")
+	}
+	ss.audit.mu.Unlock()
+	<-done
+}
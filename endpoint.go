@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strings"
+	"sync"
 
 	util "github.com/PeterXu/goutil"
 	"github.com/c-bata/go-prompt"
@@ -25,26 +27,66 @@ type LocalServiceDB struct {
 	items map[string]*LocalService // key: myid@peerid
 }
 
+// local address of service, which provider connects to
+type LocalServiceBind struct {
+	proto string
+	addr  string
+}
+
 func NewEndpoint(hook EndpointHook, isServer bool) *Endpoint {
 	return &Endpoint{
 		hook:     hook,
 		isServer: isServer,
 		services: make(map[string]*LocalServiceDB),
+		binds:    make(map[string]*LocalServiceBind),
+		actions:  make(map[string]fnSignalClientAction),
+
+		conferences: make(map[uint32]*LocalConference),
+		ch_event:    make(chan *SignalResponse, 64),
+		output:      kOutputText,
+		history:     NewShellHistory(kDefaultProfile),
+		keyring:     NewKeyring(kDefaultProfile),
 	}
 }
 
 type Endpoint struct {
 	hook     EndpointHook
 	isServer bool
+	mu       sync.Mutex                 // protect services and conferences
 	services map[string]*LocalServiceDB // key: serviceName
+	binds    map[string]*LocalServiceBind
+	actions  map[string]fnSignalClientAction
+	ch_event chan *SignalResponse
 	signal   *SignalClient
+	gateway  *Gateway
 	cc       *ShellCompleter
+	output   string // text or json
+	history  *ShellHistory
+	keyring  *Keyring
+	iceNet   *IceNet // virtual network of ice agents, nil for real
+
+	conferences map[uint32]*LocalConference
 }
 
 func (e *Endpoint) Init(sigaddr string) {
 	e.signal = NewSignalClient()
 	e.signal.sigaddr = sigaddr
 
+	e.cc = NewShellCompleter()
+	e.cc.Init(e.isServer)
+
+	// local actions
+	e.actions[kActionTunnels] = e.Tunnels
+	e.actions[kActionTunnelStats] = e.TunnelStats
+	e.actions[kActionCloseTunnel] = e.CloseTunnel
+	e.actions[kActionBindService] = e.BindService
+	e.actions[kActionCreateConference] = e.CreateConference
+	e.actions[kActionJoinConference] = e.JoinConference
+	e.actions[kActionInviteConference] = e.InviteConference
+	e.actions[kActionLeaveConference] = e.LeaveConference
+	e.actions[kActionConferences] = e.Conferences
+	e.actions[kActionConferenceSend] = e.ConferenceSend
+
 	// listen remote-peer's events
 	events := []string{
 		kActionEventIceOpen,
@@ -53,16 +95,41 @@ func (e *Endpoint) Init(sigaddr string) {
 		kActionEventIceCloseAck,
 		kActionEventIceAuth,
 		kActionEventIceCandidate,
+		kActionEventOffer,
+		kActionEventAnswer,
+		kActionEventConferenceJoin,
+		kActionEventConferenceLeave,
+		kActionEventServiceRevoked,
+		kActionEventJoinRequest,
+		kActionEventJoinAccepted,
+		kActionEventJoinRejected,
+		kActionEventServerShutdown,
 	}
 	e.signal.ListenEvents(events, func(ev evEvent) error {
 		if resp := ev.Get("data").(*SignalResponse); resp != nil {
-			e.OnRemoteEvent(resp)
+			e.ch_event <- resp
 		}
 		return nil
 	})
+	go e.eventLoop()
+}
+
+// handle events in order, and out of signal's read loop
+// which must be free to receive responses of SendRequest.
+func (e *Endpoint) eventLoop() {
+	for resp := range e.ch_event {
+		e.OnRemoteEvent(resp)
+	}
 }
 
 func (e *Endpoint) OnRemoteEvent(resp *SignalResponse) error {
+	PrintEvent(e.output, resp)
+
+	if resp.ConferenceId != 0 {
+		e.OnConferenceEvent(resp)
+		return nil
+	}
+
 	switch resp.Event {
 	case kActionEventIceOpen:
 		e.CheckOpenLocalService("ev_open", resp.ServiceName, resp.FromId)
@@ -70,7 +137,10 @@ func (e *Endpoint) OnRemoteEvent(resp *SignalResponse) error {
 		req := NewSignalRequest(e.signal.id)
 		req.ToId = resp.FromId
 		req.ServiceName = resp.ServiceName
-		e.signal.SendRequest(kActionEventIceOpenAck, req)
+		if _, err := e.signal.SendRequest(kActionEventIceOpenAck, req); err == nil {
+			// ack is queued to requester before our ice messages
+			e.StartLocalIce(resp.ServiceName, resp.FromId, false)
+		}
 	case kActionEventIceClose:
 		e.CheckOpenLocalService("ev_close", resp.ServiceName, resp.FromId)
 
@@ -80,6 +150,7 @@ func (e *Endpoint) OnRemoteEvent(resp *SignalResponse) error {
 		e.signal.SendRequest(kActionEventIceCloseAck, req)
 	case kActionEventIceOpenAck:
 		e.CheckOpenLocalService("ev_openack", resp.ServiceName, resp.FromId)
+		e.StartLocalIce(resp.ServiceName, resp.FromId, true)
 	case kActionEventIceCloseAck:
 		e.CheckOpenLocalService("ev_closeack", resp.ServiceName, resp.FromId)
 	case kActionEventIceAuth:
@@ -90,15 +161,114 @@ func (e *Endpoint) OnRemoteEvent(resp *SignalResponse) error {
 		if srv := e.GetLocalService(resp.ServiceName, resp.FromId); srv != nil {
 			srv.OnIceCandidate(resp.ResultM["ice-candidate"])
 		}
+	case kActionEventOffer:
+		answer, err := e.CheckGatewayOffer(resp.ServiceName, resp.FromId, resp.ResultM["sdp"])
+		if err != nil {
+			log.Println("gateway offer error:", resp.ServiceName, resp.FromId, err)
+			return err
+		}
+
+		e.signal.SendSdp(kActionEventAnswer, answer, resp.ServiceName, resp.FromId)
+	case kActionEventAnswer:
+		// only for output, endpoints have no webrtc stack
+	case kActionEventServiceRevoked:
+		// kicked or password rotated by owner
+		e.CheckOpenLocalService("ev_close", resp.ServiceName, resp.FromId)
+		e.PrintNotice(resp)
+	case kActionEventJoinRequest, kActionEventJoinAccepted, kActionEventJoinRejected:
+		e.PrintNotice(resp)
+	case kActionEventServerShutdown:
+		if e.output == kOutputText {
+			fmt.Printf("== %s: reconnect in %sms and login again automatically\n", resp.Event, resp.ResultM["reconnect-ms"])
+		}
 	}
 	return nil
 }
 
+// events which need attention of user in text mode
+func (e *Endpoint) PrintNotice(resp *SignalResponse) {
+	if e.output == kOutputText {
+		fmt.Printf("== %s: service %s, peer %s\n", resp.Event, resp.ServiceName, resp.FromId)
+	}
+}
+
+// bind-service serviceName proto addr,
+// provider dials the address and requester listens on it.
+func (e *Endpoint) BindService(action string, params []string) (*Result, error) {
+	if len(params) != 3 {
+		return nil, errFnInvalidParamters(params)
+	}
+	if params[1] != "tcp" && params[1] != "udp" {
+		return nil, errFnInvalidParamters(params[1:2])
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.binds[params[0]] = &LocalServiceBind{proto: params[1], addr: params[2]}
+	return nil, nil
+}
+
+// create LocalService for browser's offer and return answer of gateway
+func (e *Endpoint) CheckGatewayOffer(name, fromId, offer string) (string, error) {
+	if e.gateway == nil {
+		return "", errGatewayDisabled
+	}
+
+	e.mu.Lock()
+	db, ok := e.services[name]
+	if !ok {
+		e.mu.Unlock()
+		return "", errServiceNotExist
+	}
+	bind, ok := e.binds[name]
+	if !ok {
+		e.mu.Unlock()
+		return "", errServiceNotBound
+	}
+
+	srvId := e.GetLocalServiceKey(fromId)
+	if item, ok := db.items[srvId]; ok {
+		item.Uninit()
+	}
+	item := NewLocalService(name, fromId, false)
+	item.SetAddr(bind.proto, bind.addr)
+	item.SetOnClose(func() {
+		go e.RemoveLocalService(name, fromId, item)
+	})
+	db.items[srvId] = item
+	e.refreshCompleterTunnels()
+	e.mu.Unlock()
+
+	answer, err := e.gateway.HandleOffer(fromId, offer, item)
+	if err != nil {
+		e.RemoveLocalService(name, fromId, item)
+	}
+	return answer, err
+}
+
+// remove item if it is still the one in services
+func (e *Endpoint) RemoveLocalService(name, fromId string, item *LocalService) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if db, ok := e.services[name]; ok {
+		srvId := e.GetLocalServiceKey(fromId)
+		if db.items[srvId] == item {
+			item.Uninit()
+			delete(db.items, srvId)
+			e.refreshCompleterTunnels()
+		}
+	}
+}
+
 func (e *Endpoint) GetLocalServiceKey(fromId string) string {
 	return e.signal.id + "@" + fromId
 }
 
 func (e *Endpoint) GetLocalService(name, fromId string) *LocalService {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	if db, ok := e.services[name]; ok {
 		srvId := e.GetLocalServiceKey(fromId)
 		if item, ok := db.items[srvId]; ok {
@@ -109,6 +279,9 @@ func (e *Endpoint) GetLocalService(name, fromId string) *LocalService {
 }
 
 func (e *Endpoint) CheckEnableLocalService(action, name string) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	switch action {
 	case "enable":
 		if _, ok := e.services[name]; !ok {
@@ -120,12 +293,16 @@ func (e *Endpoint) CheckEnableLocalService(action, name string) (err error) {
 				item.Uninit()
 			}
 			delete(e.services, name)
+			e.refreshCompleterTunnels()
 		}
 	}
 	return
 }
 
 func (e *Endpoint) CheckOpenLocalService(action, name, fromId string) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	switch action {
 	case "ev_open", "ev_openack":
 		if db, ok := e.services[name]; ok {
@@ -134,39 +311,67 @@ func (e *Endpoint) CheckOpenLocalService(action, name, fromId string) (err error
 				// service provider should start client-mode
 				// service requester should start server-mode
 				isServiceProvider := (action == "ev_open")
-				item = NewLocalService(name, !isServiceProvider)
-				//TODO
+				item = NewLocalService(name, fromId, !isServiceProvider)
+				if bind, ok := e.binds[name]; ok {
+					item.SetAddr(bind.proto, bind.addr)
+				}
+				item.SetOnClose(func() {
+					go e.RemoveLocalService(name, fromId, item)
+				})
 				db.items[srvId] = item
+				e.refreshCompleterTunnels()
 			}
 		}
 	case "ev_close", "ev_closeack":
 		if db, ok := e.services[name]; ok {
 			srvId := e.GetLocalServiceKey(fromId)
-			if item, ok := db.items[srvId]; !ok {
+			if item, ok := db.items[srvId]; ok {
 				item.Uninit()
 				delete(db.items, srvId)
+				e.refreshCompleterTunnels()
 			}
 		}
 	}
 	return
 }
 
+// start ice of tunnel after open/openack, requester(controlling) listens
+// after connected, and provider dials local service for each stream.
+func (e *Endpoint) StartLocalIce(name, fromId string, controlling bool) {
+	item := e.GetLocalService(name, fromId)
+	if item == nil {
+		return
+	}
+	if _, addr := item.GetAddr(); len(addr) == 0 {
+		log.Println("tunnel not bound:", name, fromId)
+		e.RemoveLocalService(name, fromId, item)
+		return
+	}
+	if err := item.InitIce(controlling, e.signal, e.iceNet); err != nil {
+		log.Println("tunnel ice init error:", name, fromId, err)
+		e.RemoveLocalService(name, fromId, item)
+	}
+}
+
+// set before tunnels, e.g. pion vnet for tests
+func (e *Endpoint) SetIceNet(net *IceNet) {
+	e.iceNet = net
+}
+
 func (e *Endpoint) StartShell(title string) {
 	fmt.Println("Please use `exit` or `Ctrl-D` to exit this program.")
 	defer fmt.Println("Bye!")
 	defer util.HandleTTYOnExit()
 
-	cc := NewShellCompleter()
-	cc.Init(e.isServer)
 	p := prompt.New(
 		e.Executor,
-		cc.Complete,
+		e.cc.Complete,
+		prompt.OptionHistory(e.history.Load()),
 		prompt.OptionTitle(fmt.Sprintf("%s: interactive cmdline", title)),
 		prompt.OptionPrefix(">>> "),
 		prompt.OptionInputTextColor(prompt.Blue),
 		prompt.OptionCompletionWordSeparator(completer.FilePathCompletionSeparator),
 	)
-	e.cc = cc
 	p.Run()
 }
 
@@ -196,13 +401,233 @@ func (e *Endpoint) Executor(line string) {
 		fmt.Printf("warn: %s not exist\n", parts[0])
 		return
 	} else {
+		e.history.Append(e.StripPasswords(parts))
+
 		switch parts[0] {
 		case "help":
 			e.cc.PrintHelp()
 			return
+		case "set":
+			err = e.SetOption(parts[1:])
+			PrintResult(e.output, parts[0], nil, err)
+			return
+		case "keyring":
+			ret, err := e.RunKeyring(parts[1:])
+			PrintResult(e.output, parts[0], ret, err)
+			return
 		}
 	}
 
+	// prompt or recall omitted password
+	if parts, err = e.FillPasswords(parts); err != nil {
+		PrintResult(e.output, parts[0], nil, err)
+		return
+	}
+
+	ret, err := e.RunCommand(parts)
+	PrintResult(e.output, parts[0], ret, err)
+	if err == nil {
+		e.RefreshCompleter(parts[0], ret)
+	}
+	//fmt.Println(":", line, len(parts), parts, err)
+}
+
+// refresh completer's cache after commands which change services
+func (e *Endpoint) RefreshCompleter(action string, ret *Result) {
+	switch action {
+	case kActionLogout, kActionDeleteAccount:
+		e.cc.ResetCache()
+		return
+	case kActionServices:
+	case kActionLogin, kActionJoinService, kActionLeaveService,
+		kActionCreateService, kActionRemoveService, kActionEnableService, kActionDisableService:
+		ret, _ = e.signal.ControlService(kActionServices, []string{}, 0)
+	default:
+		return
+	}
+
+	if ret != nil {
+		if infos, ok := ret.value.([]*SignalServiceInfo); ok {
+			e.cc.UpdateServices(infos)
+		}
+	}
+}
+
+// should be called with e.mu locked
+func (e *Endpoint) refreshCompleterTunnels() {
+	var names, peers []string
+	for name, db := range e.services {
+		if len(db.items) > 0 {
+			names = append(names, name)
+		}
+		for key := range db.items {
+			if idx := strings.Index(key, "@"); idx >= 0 {
+				peers = append(peers, key[idx+1:])
+			}
+		}
+	}
+	e.cc.UpdateTunnels(names, peers)
+}
+
+// set profile for history and keyring, the name is part of file path
+func (e *Endpoint) SetProfile(profile string) error {
+	if !IsValidProfile(profile) {
+		return errFnInvalidParamters([]string{profile})
+	}
+	e.history = NewShellHistory(profile)
+	e.keyring = NewKeyring(profile)
+	return nil
+}
+
+// return command line without password arguments, for history.
+// arguments are stripped by position of usage names ending with "pwd",
+// and unnamed ones(e.g. invite code), empty if command is unknown.
+func (e *Endpoint) StripPasswords(parts []string) string {
+	if !e.cc.IsExist(parts[0]) {
+		return ""
+	}
+
+	names := e.cc.GetArgumentNames(parts[0])
+	stripped := []string{parts[0]}
+	for idx, arg := range parts[1:] {
+		if idx >= len(names) || strings.HasSuffix(strings.ToLower(names[idx]), "pwd") {
+			continue
+		}
+		stripped = append(stripped, arg)
+	}
+	return JoinCommandLine(stripped)
+}
+
+// insert password when omitted, recall from keyring or read from terminal
+func (e *Endpoint) FillPasswords(parts []string) ([]string, error) {
+	names := e.cc.GetArgumentNames(parts[0])
+	pos := -1
+	for idx, name := range names {
+		if name == "pwd" {
+			pos = idx
+			break
+		}
+	}
+	if pos <= 0 || len(parts)-1 != len(names)-1 {
+		return parts, nil
+	}
+
+	// the argument before pwd is user id or service name
+	kind := kKeyringService
+	if parts[0] == kActionLogin || parts[0] == kActionRegister {
+		kind = kKeyringUser
+	}
+	name := parts[pos]
+
+	var pwd string
+	if parts[0] != kActionRegister && e.keyring.IsExist() {
+		if err := e.UnlockKeyring(); err != nil {
+			return parts, err
+		}
+		pwd, _ = e.keyring.Get(kind, name)
+	}
+	if len(pwd) == 0 {
+		var err error
+		if pwd, err = e.ReadNewPassword(fmt.Sprintf("password of %s: ", name), parts[0] == kActionRegister); err != nil {
+			return parts, err
+		}
+	}
+
+	filled := append([]string{}, parts[:pos+1]...)
+	filled = append(filled, pwd)
+	return append(filled, parts[pos+1:]...), nil
+}
+
+// read password from terminal, confirm again if required
+func (e *Endpoint) ReadNewPassword(prompt string, confirm bool) (string, error) {
+	pwd, err := ReadPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		if again, err := ReadPassword("confirm " + prompt); err != nil {
+			return "", err
+		} else if again != pwd {
+			return "", errPasswordMismatch
+		}
+	}
+	return pwd, nil
+}
+
+func (e *Endpoint) UnlockKeyring() error {
+	if e.keyring.IsUnlocked() {
+		return nil
+	}
+	passphrase, err := e.ReadNewPassword("keyring passphrase: ", !e.keyring.IsExist())
+	if err != nil {
+		return err
+	}
+	return e.keyring.Unlock(passphrase)
+}
+
+// keyring list|set|remove|lock kind name
+func (e *Endpoint) RunKeyring(params []string) (*Result, error) {
+	if len(params) == 0 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	action := params[0]
+	switch action {
+	case "lock":
+		e.keyring.Lock()
+		return nil, nil
+	case "list":
+		if err := e.UnlockKeyring(); err != nil {
+			return nil, err
+		}
+		names, err := e.keyring.List()
+		if err != nil {
+			return nil, err
+		}
+		return NewResultValue(strings.Join(names, "\n"), names), nil
+	case "set", "remove":
+		if len(params) != 3 || (params[1] != kKeyringUser && params[1] != kKeyringService) {
+			return nil, errFnInvalidParamters(params)
+		}
+		if err := e.UnlockKeyring(); err != nil {
+			return nil, err
+		}
+		if action == "remove" {
+			return nil, e.keyring.Remove(params[1], params[2])
+		}
+		pwd, err := e.ReadNewPassword(fmt.Sprintf("password of %s: ", params[2]), true)
+		if err != nil {
+			return nil, err
+		}
+		return nil, e.keyring.Set(params[1], params[2], pwd)
+	default:
+		return nil, errFnInvalidParamters(params)
+	}
+}
+
+// set shell options, e.g. `set output json`
+func (e *Endpoint) SetOption(params []string) error {
+	if len(params) != 2 {
+		return errFnInvalidParamters(params)
+	}
+	switch params[0] {
+	case "output":
+		return e.SetOutput(params[1])
+	default:
+		return errFnInvalidParamters(params)
+	}
+}
+
+func (e *Endpoint) SetOutput(mode string) error {
+	if !IsValidOutput(mode) {
+		return errFnInvalidParamters([]string{mode})
+	}
+	e.output = mode
+	return nil
+}
+
+// run one command with hooks, shared by shell and daemon.
+func (e *Endpoint) RunCommand(parts []string) (ret *Result, err error) {
 	// do PreRun if exist
 	if e.hook != nil {
 		if err = e.hook.PreRunSignal(parts); err != nil {
@@ -211,25 +636,22 @@ func (e *Endpoint) Executor(line string) {
 	}
 
 	// do Run
-	var ret *Result
-	if ret, err = e.GoRun(parts[0], parts[1:]); err != nil {
-		fmt.Printf("== %s failed: %v\n", parts[0], err)
-	} else {
-		fmt.Printf("== %s success\n", parts[0])
-	}
-	if ret != nil {
-		fmt.Println("== result: \n", ret.data)
+	ret, err = e.GoRun(parts[0], parts[1:])
+	if err == nil && (parts[0] == kActionLogout || parts[0] == kActionDeleteAccount || parts[0] == kActionDisconnect) {
+		e.CloseLocalConferences()
 	}
-	//fmt.Println(":", line, len(parts), parts, err)
 
 	// do PostRun if exist
 	if e.hook != nil {
 		e.hook.PostRunSignal(parts, err)
 	}
+	return
 }
 
 func (e *Endpoint) GoRun(action string, params []string) (*Result, error) {
-	if fn, ok := e.signal.actions[action]; ok {
+	if fn, ok := e.actions[action]; ok {
+		return fn(action, params)
+	} else if fn, ok := e.signal.actions[action]; ok {
 		return fn(action, params)
 	} else {
 		return nil, errFnInvalidAction(action)
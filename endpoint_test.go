@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStripPasswords(t *testing.T) {
+	ep := NewServer("127.0.0.1:0").ep
+	cases := []struct {
+		line   string
+		expect string
+	}{
+		{"login alice secret", "login alice"},
+		{"login alice", "login alice"},
+		{"register bob secret invite-code", "register bob"},
+		{"change-password old-secret new-secret", "change-password"},
+		{"rotate-service-password svc old-secret new-secret yes", "rotate-service-password svc yes"},
+		{"create-service svc secret echo", "create-service svc echo"},
+		{"kick-member svc secret mallory", "kick-member svc mallory"},
+		{"join-service svc secret", ""}, // client only
+		{"logout", "logout"},
+		{"no-such-command alice secret", ""},
+	}
+	for _, item := range cases {
+		parts, err := ParseCommandLine(item.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := ep.StripPasswords(parts); line != item.expect {
+			t.Errorf("%q: stripped %q, want %q", item.line, line, item.expect)
+		}
+	}
+}
+
+func TestIsValidProfile(t *testing.T) {
+	for _, profile := range []string{"default", "work-1", "a.b_c"} {
+		if !IsValidProfile(profile) {
+			t.Errorf("%q should be valid", profile)
+		}
+	}
+	for _, profile := range []string{"", ".", "..", "../x", "a/b", "/etc/passwd", ".hidden", "a\\b"} {
+		if IsValidProfile(profile) {
+			t.Errorf("%q should be invalid", profile)
+		}
+	}
+}
@@ -2,41 +2,143 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
 var (
-	errNetworkHadConnected = errors.New("network had connected")
-	errNetworkNotConnected = errors.New("network not connected")
-	errRequestTimeout      = errors.New("request timeout")
-	errWrongPassword       = errors.New("wrong password")
-	errInvalidParameters   = errors.New("invalid paramters")
-	errInvalidPassword     = errors.New("invalid password")
-	errInvalidClientId     = errors.New("invalid client id")
-	errClientNotLogin      = errors.New("client not login")
-	errClientNotExist      = errors.New("client not exist")
-	errClientExisted       = errors.New("client had existed")
-
-	errFnInvalidParamters = func(args []string) error { return errors.New("invalid paramters:" + strings.Join(args, " ")) }
-	errFnInvalidAction    = func(action string) error { return errors.New("invalid action:" + action) }
-
-	errServiceNotExist       = errors.New("service not exist")
-	errServiceExisted        = errors.New("service had existed")
-	errServiceInvalidName    = errors.New("service invalid name")
-	errServiceNotJoined      = errors.New("service not joined")
-	errServiceShouldNotOwner = errors.New("service should not owner")
-	errServiceRequireOwner   = errors.New("service require owner")
-
-	errFnServiceInvalid = func(msg string) error { return errors.New("service invalid: " + msg) }
+	errNetworkHadConnected = newCodeError("network-had-connected", "network had connected")
+	errNetworkNotConnected = newCodeError("network-not-connected", "network not connected")
+	errRequestTimeout      = newCodeError("request-timeout", "request timeout")
+	errRequestClosed       = newCodeError("request-closed", "closed by other")
+	errWrongPassword       = newCodeError("wrong-password", "wrong password")
+	errInvalidParameters   = newCodeError("invalid-parameters", "invalid paramters")
+	errInvalidPassword     = newCodeError("invalid-password", "invalid password")
+	errInvalidClientId     = newCodeError("invalid-client-id", "invalid client id")
+	errClientNotLogin      = newCodeError("client-not-login", "client not login")
+	errClientNotExist      = newCodeError("client-not-exist", "client not exist")
+	errClientExisted       = newCodeError("client-existed", "client had existed")
+	errClientDisabled      = newCodeError("client-disabled", "client disabled")
+	errRequireAdmin        = newCodeError("require-admin", "require admin")
+	errTooManyAttempts     = newCodeError("too-many-attempts", "too many failed attempts, please retry later")
+	errRateLimited         = newCodeError("rate-limited", "too many requests")
+	errAuditDisabled       = newCodeError("audit-disabled", "audit log disabled")
+	errClusterClosed       = newCodeError("cluster-closed", "cluster bus closed")
+	errStoreConflict       = newCodeError("store-conflict", "store changed by other node")
+	errStoreNotShared      = newCodeError("store-not-shared", "store is not shared by cluster")
+	errRedisProtocol       = newCodeError("redis-protocol", "invalid reply of redis")
+
+	errRegisterRequireInvite = newCodeError("register-require-invite", "register require valid invite")
+	errRegisterClosed        = newCodeError("register-closed", "register closed, please contact admin")
+
+	errFnInvalidParamters = func(args []string) error {
+		return newCodeError("invalid-parameters", "invalid paramters:"+strings.Join(args, " "))
+	}
+	errFnInvalidAction  = func(action string) error { return newCodeError("invalid-action", "invalid action:"+action) }
+	errFnClientLogined  = func(id string) error { return newCodeError("client-logined", fmt.Sprintf("user %s is logined", id)) }
+	errFnClientNotLogin = func(id string) error { return newCodeError("client-not-login", fmt.Sprintf("user %s not login", id)) }
+
+	errServiceNotExist       = newCodeError("service-not-exist", "service not exist")
+	errServiceExisted        = newCodeError("service-existed", "service had existed")
+	errServiceInvalidName    = newCodeError("service-invalid-name", "service invalid name")
+	errServiceNotJoined      = newCodeError("service-not-joined", "service not joined")
+	errServiceShouldNotOwner = newCodeError("service-should-not-owner", "service should not owner")
+	errServiceRequireOwner   = newCodeError("service-require-owner", "service require owner")
+	errServiceNotMember      = newCodeError("service-not-member", "peer is not member of service")
+	errServiceDenied         = newCodeError("service-denied", "service denied")
+	errServiceNotAllowed     = newCodeError("service-not-allowed", "service not allowed")
+	errServiceNoJoinRequest  = newCodeError("service-no-join-request", "service has no join request")
+	errInviteUnlimited       = newCodeError("invite-unlimited", "invite should expire or be limited by uses")
+
+	errFnServiceInvalid = func(msg string) error { return newCodeError("service-invalid", "service invalid: "+msg) }
+
+	errTunnelNotExist  = newCodeError("tunnel-not-exist", "tunnel not exist")
+	errTunnelClosed    = newCodeError("tunnel-closed", "tunnel closed")
+	errTunnelBusy      = newCodeError("tunnel-busy", "tunnel send buffer is full")
+	errServiceNotBound = newCodeError("service-not-bound", "service not bound")
+	errGatewayDisabled = newCodeError("gateway-disabled", "gateway disabled")
+
+	errConferenceNotExist     = newCodeError("conference-not-exist", "conference not exist")
+	errConferenceJoined       = newCodeError("conference-joined", "conference had joined")
+	errConferenceNotJoined    = newCodeError("conference-not-joined", "conference not joined")
+	errConferenceMessageSize  = newCodeError("conference-message-size", "conference message is empty or too long")
+	errConferenceNotInvited   = newCodeError("conference-not-invited", "conference not invited")
+	errConferenceRequireOwner = newCodeError("conference-require-owner", "conference require owner")
+
+	errStunInvalid      = newCodeError("stun-invalid", "stun message invalid")
+	errStunUnauthorized = newCodeError("stun-unauthorized", "stun message integrity check failed")
+
+	errSdpInvalid = func(msg string) error { return newCodeError("sdp-invalid", "sdp invalid: "+msg) }
+
+	errFnNotSocket = func(path string) error { return newCodeError("not-socket", "not a socket: "+path) }
+
+	errNoProfileDir     = newCodeError("no-profile-dir", "no profile directory")
+	errPasswordMismatch = newCodeError("password-mismatch", "password mismatch")
+	errKeyringLocked    = newCodeError("keyring-locked", "keyring locked")
+	errKeyringNotFound  = newCodeError("keyring-not-found", "keyring entry not found")
+	errKeyringPassword  = newCodeError("keyring-wrong-password", "keyring wrong password")
 )
 
+const kErrorCodeUnknown = "unknown"
+
+/**
+ * Error with stable code, the code is passed to peers and json output.
+ */
+func newCodeError(code, msg string) *CodeError {
+	return &CodeError{code: code, msg: msg}
+}
+
+type CodeError struct {
+	code string
+	msg  string
+}
+
+func (e *CodeError) Error() string {
+	return e.msg
+}
+
+func (e *CodeError) Code() string {
+	return e.code
+}
+
+// return the stable code of err, or unknown
+func ErrorCode(err error) string {
+	var ce *CodeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return kErrorCodeUnknown
+}
+
+// restore error from code/message pair(e.g. SignalResponse)
+func ErrorFromCode(code, msg string) error {
+	if len(code) == 0 || code == kErrorCodeUnknown {
+		return errors.New(msg)
+	}
+	return newCodeError(code, msg)
+}
+
 /**
  * Run result
+ *	data: text output
+ *	value: structured output(json), use data if nil
  */
 func NewResult(data string) *Result {
 	return &Result{data: data}
 }
 
+func NewResultValue(data string, value interface{}) *Result {
+	return &Result{data: data, value: value}
+}
+
 type Result struct {
-	data string
+	data  string
+	value interface{}
+}
+
+func (r *Result) Value() interface{} {
+	if r.value != nil {
+		return r.value
+	}
+	return r.data
 }
@@ -3,17 +3,28 @@ package main
 import (
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	util "github.com/PeterXu/goutil"
+	gn "github.com/panjf2000/gnet"
 )
 
 var defaultGateway = NewGateway()
 
+/**
+ * WebRTC gateway(ice-lite), bridge browser's data-channel to LocalService.
+ *	a. offer/answer by signal server, HandleOffer
+ *	b. stun/dtls on udp port, OnUdpPacket -> Connection -> PeerConnection
+ *	   or on tcp port(ice-tcp, rfc4571), OnTcpPacket -> Connection
+ *	c. sctp data <-> LocalService
+ */
 func NewGateway() *Gateway {
 	gw := &Gateway{
 		conferences: make(map[uint32]*Conference),
 		stuns:       make(map[string]*StunInfo),
+		pcs:         make(map[string]*PeerConnection),
 		connections: make(map[string]*Connection),
 	}
 	listenEvent("udp", gw, "")
@@ -23,14 +34,44 @@ func NewGateway() *Gateway {
 }
 
 type Gateway struct {
+	mu          sync.Mutex
 	conferences map[uint32]*Conference
-	stuns       map[string]*StunInfo
-	pcs         map[string]*PeerConnection
-	connections map[string]*Connection
+	stuns       map[string]*StunInfo       // key: local ufrag
+	pcs         map[string]*PeerConnection // key: stunName
+	connections map[string]*Connection     // key: remote addr
+
+	ip          string
+	port        int
+	tcpPort     int // passive ice-tcp, 0: disabled
+	tlsCrt      string
+	tlsKey      string
+	fingerprint string
+}
+
+func (g *Gateway) Init(ip string, port, tcpPort int) error {
+	crt, key, fingerprint, err := GenerateCertificate()
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ip = ip
+	g.port = port
+	g.tcpPort = tcpPort
+	g.tlsCrt = crt
+	g.tlsKey = key
+	g.fingerprint = fingerprint
+	return nil
+}
+
+func (g *Gateway) IsEnabled() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.port > 0
 }
 
 func (g *Gateway) Handle(e evEvent) error {
-	log.Println(e)
 	switch e.Name() {
 	case "udp":
 		g.OnUdpPacket(e)
@@ -41,42 +82,231 @@ func (g *Gateway) Handle(e evEvent) error {
 	return nil
 }
 
+// ice-tcp(passive), one tcp conn is one path of remote
 func (g *Gateway) OnTcpPacket(e evEvent) {
+	conn, _ := e.Get("conn").(gn.Conn)
+	if conn == nil {
+		return
+	}
+	if closed, _ := e.Get("closed").(bool); closed {
+		g.removeConnection(conn, true)
+		return
+	}
+
+	data, _ := e.Get("data").([]byte)
+	if len(data) == 0 {
+		return
+	}
+	g.onPacket(conn, data, true)
 }
 
 func (g *Gateway) OnUdpPacket(e evEvent) {
-	/*
-		conn := e.Get("conn")
-		data := e.Get("data")
-		if sink := g.findConnection(conn.RemoteAddr()); sink != nil {
+	conn, _ := e.Get("conn").(gn.Conn)
+	data, _ := e.Get("data").([]byte)
+	if conn == nil || len(data) == 0 {
+		return
+	}
+
+	g.onPacket(conn, data, false)
+}
+
+// demux by RFC 7983, only stun binding request could create Connection
+func (g *Gateway) onPacket(conn gn.Conn, data []byte, tcp bool) {
+	ptype := DemuxPacket(data)
+	if ptype == kPacketUnknown {
+		log.Println("[GW] drop unknown packet from:", conn.RemoteAddr(), data[0])
+		return
+	}
+
+	if sink := g.findConnection(conn.RemoteAddr(), tcp); sink != nil {
+		sink.onReceivedData(data)
+	} else if ptype == kPacketStun && util.IsStunPacket(data) {
+		if sink = g.newConnection(conn, data, tcp); sink != nil {
 			sink.onReceivedData(data)
-		} else {
-			handleStunPacket(data, conn.RemoteAddr())
 		}
-	*/
+	} else {
+		log.Println("[GW] drop packet from unknown addr:", conn.RemoteAddr())
+	}
+}
+
+// create Connection by stun username of binding request
+func (g *Gateway) newConnection(conn gn.Conn, data []byte, tcp bool) *Connection {
+	var msg util.IceMessage
+	if err := msg.Read(data); err != nil || msg.Dtype != util.STUN_BINDING_REQUEST {
+		return nil
+	}
+	attr := msg.GetAttribute(util.STUN_ATTR_USERNAME)
+	if attr == nil {
+		return nil
+	}
+
+	stunName := string(attr.(*util.StunByteStringAttribute).Data)
+	items := strings.Split(stunName, ":")
+	if len(items) != 2 {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	info, ok := g.stuns[items[0]]
+	if !ok || info.getStunName() != stunName {
+		log.Println("[GW] unknown stun name:", stunName)
+		return nil
+	}
+	pc, ok := g.pcs[stunName]
+	if !ok {
+		return nil
+	}
+	if err := VerifyStunMessage(data, info.localPwd); err != nil {
+		log.Println("[GW] stun verify error:", stunName, conn.RemoteAddr(), err)
+		replyStunUnauthorized(conn, data, tcp)
+		return nil
+	}
+
+	sink := NewConnection(conn.RemoteAddr(), stunName)
+	sink.conn = conn
+	sink.tcp = tcp
+	sink.stun = info
+	pc.addConnection(sink)
+	g.connections[connectionKey(conn.RemoteAddr(), tcp)] = sink
+	return sink
+}
+
+// 401 to binding request without valid integrity
+func replyStunUnauthorized(conn gn.Conn, request []byte, tcp bool) {
+	resp := GenStunErrorResponse(request, 401, "Unauthorized")
+	if tcp {
+		conn.AsyncWrite(resp)
+	} else {
+		conn.SendTo(resp)
+	}
 }
 
-func (g *Gateway) findConnection(addr net.Addr) *Connection {
-	var key string = util.AddrToString(addr)
+// udp and tcp paths from the same addr are different
+func connectionKey(addr net.Addr, tcp bool) string {
+	if tcp {
+		return "tcp:" + util.AddrToString(addr)
+	}
+	return util.AddrToString(addr)
+}
+
+func (g *Gateway) findConnection(addr net.Addr, tcp bool) *Connection {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var key string = connectionKey(addr, tcp)
 	if u, ok := g.connections[key]; ok {
 		return u
 	}
 	return nil
 }
 
+func (g *Gateway) removeConnection(conn gn.Conn, tcp bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := connectionKey(conn.RemoteAddr(), tcp)
+	if sink, ok := g.connections[key]; ok {
+		sink.close()
+		if sink.pc != nil {
+			sink.pc.removeConnection(sink)
+		}
+		delete(g.connections, key)
+	}
+}
+
+// negotiate one data-channel session for service, return answer sdp
+func (g *Gateway) HandleOffer(uid, offer string, service *LocalService) (string, error) {
+	if !g.IsEnabled() {
+		return "", errGatewayDisabled
+	}
+
+	remote := ParseSdp(offer)
+	if err := remote.Check(); err != nil {
+		return "", err
+	}
+	if err := remote.CheckSetup(true); err != nil {
+		return "", err
+	}
+	if setup := NegotiateDtlsSetup(remote.Setup); setup != kDtlsSetupPassive {
+		// gateway is always dtls server
+		return "", errSdpInvalid("unsupported dtls setup: " + remote.Setup)
+	}
+
+	info := NewStunInfo(uid, offer)
+	info.service = service.name
+	info.localUfrag = util.RandomString(8)
+	info.localPwd = util.RandomString(24)
+	info.remoteUfrag = remote.IceUfrag
+	info.remotePwd = remote.IcePwd
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stunName := info.getStunName()
+	pc := NewPeerConnection(stunName, g.tlsCrt, g.tlsKey, offer)
+	if pc == nil {
+		return "", errSdpInvalid("fail to create peer connection")
+	}
+	pc.setService(service)
+	g.stuns[info.localUfrag] = info
+	g.pcs[stunName] = pc
+
+	local := &SdpInfo{
+		IceUfrag:    info.localUfrag,
+		IcePwd:      info.localPwd,
+		Fingerprint: g.fingerprint,
+		Setup:       kDtlsSetupPassive,
+		SctpPort:    remote.SctpPort,
+		Candidates:  []string{BuildHostCandidate(1, "udp", g.ip, g.port)},
+	}
+	if g.tcpPort > 0 {
+		local.Candidates = append(local.Candidates, BuildTcpCandidate(2, g.ip, g.tcpPort))
+	}
+	return BuildAnswerSdp(remote, local), nil
+}
+
+// remove sessions which are closed or never connected
+func (g *Gateway) checkTimeout() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, conn := range g.connections {
+		if conn.isTimeout(kConnectionTimeout) {
+			conn.close()
+			if conn.pc != nil {
+				conn.pc.removeConnection(conn)
+			}
+			delete(g.connections, key)
+		}
+	}
+	for ufrag, info := range g.stuns {
+		stunName := info.getStunName()
+		pc := g.pcs[stunName]
+		if pc == nil || pc.isClosed() || (!pc.hasConnection() && util.NowMs() > info.ctime+kConnectionTimeout) {
+			if pc != nil {
+				pc.Close()
+			}
+			delete(g.pcs, stunName)
+			delete(g.stuns, ufrag)
+		}
+	}
+}
+
 func (g *Gateway) getPeerConnection(stunName string) *PeerConnection {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	if pc, ok := g.pcs[stunName]; ok {
 		return pc
 	}
-
-	var tlsCrtPem string
-	var tslKeyPem string
-	var offer string
-	return NewPeerConnection(stunName, tlsCrtPem, tslKeyPem, offer)
+	return nil
 }
 
 func (g *Gateway) _loop() {
 	for {
 		time.Sleep(time.Duration(10) * time.Second)
+		g.checkTimeout()
 	}
 }
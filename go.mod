@@ -10,6 +10,9 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/panjf2000/gnet v1.6.4
 	github.com/pion/ice/v2 v2.1.14
+	github.com/pion/logging v0.2.2
+	github.com/pion/transport v0.12.3
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20211116231205-47ca1ff31462
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	kDefaultProfile   = "default"
+	kMaxHistoryLines  = 1000
+	kProfileDirectory = ".netpie"
+)
+
+// profile name: letters, digits, '-', '_' and '.', not starting with '.'
+func IsValidProfile(profile string) bool {
+	if len(profile) == 0 || len(profile) > 64 || profile[0] == '.' {
+		return false
+	}
+	for _, ch := range profile {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// return ~/.netpie, created if not exist
+func GetProfileDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, kProfileDirectory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+/**
+ * Shell history, persisted per profile in ~/.netpie/<profile>.history.
+ *	secrets(password arguments) should be stripped before Append.
+ */
+func NewShellHistory(profile string) *ShellHistory {
+	h := &ShellHistory{}
+	if dir, err := GetProfileDir(); err == nil {
+		h.fname = filepath.Join(dir, profile+".history")
+	}
+	return h
+}
+
+type ShellHistory struct {
+	fname string
+	lines []string
+}
+
+func (h *ShellHistory) Load() []string {
+	if len(h.fname) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(h.fname)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > kMaxHistoryLines {
+		// truncate file to recent lines
+		h.lines = h.lines[len(h.lines)-kMaxHistoryLines:]
+		WriteFile(h.fname, []byte(strings.Join(h.lines, "\n")+"\n"))
+	}
+	return h.lines
+}
+
+func (h *ShellHistory) Append(line string) {
+	if len(h.fname) == 0 || len(line) == 0 {
+		return
+	}
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+
+	file, err := os.OpenFile(h.fname, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.WriteString(line + "\n")
+}
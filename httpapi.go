@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	kQueryTimeout = 3 * time.Second
+)
+
+/**
+ * Http api of signal server, separated from /ws
+ *	a. /healthz, /metrics: no auth, for probes and prometheus
+ *	b. /api/peers, /api/services, /api/connections, /api/counters: "Authorization: Bearer token"
+ */
+type ServiceStat struct {
+	Name        string
+	Owner       string
+	OwnerOnline bool
+	Enabled     bool
+	Active      bool
+	Members     int
+}
+
+type ConnectionStat struct {
+	Id     string
+	Addr   string
+	Online bool
+}
+
+type CounterStat struct {
+	Count  int64
+	Errors int64
+	AvgMs  float64
+}
+
+func (ss *SignalServer) StartApi(addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", ss.serveHealthz)
+	mux.HandleFunc("/metrics", ss.serveMetrics)
+	mux.HandleFunc("/api/peers", ss.withToken(token, ss.servePeers))
+	mux.HandleFunc("/api/services", ss.withToken(token, ss.serveServices))
+	mux.HandleFunc("/api/connections", ss.withToken(token, ss.serveConnections))
+	mux.HandleFunc("/api/counters", ss.withToken(token, ss.serveCounters))
+
+	go func() {
+		ss.Println("api listen:", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			ss.Println("api ListenAndServe err", err)
+		}
+	}()
+}
+
+func (ss *SignalServer) withToken(token string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ss *SignalServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	// server lock should be available
+	if !ss.Query(func() {}) {
+		http.Error(w, "server blocked", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (ss *SignalServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	gauges := make(map[string]int)
+	ok := ss.Query(func() {
+		gauges["connections"] = len(ss.connections) + len(ss.onlines)
+		gauges["onlines"] = len(ss.onlines)
+		gauges["peers"] = len(ss.db.Peers)
+		gauges["services"] = len(ss.db.Services)
+		gauges["conferences"] = len(ss.conferences)
+	})
+	if !ok {
+		http.Error(w, "server blocked", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ss.metrics.WritePrometheus(w, gauges)
+}
+
+func (ss *SignalServer) servePeers(w http.ResponseWriter, r *http.Request) {
+	infos := []*PeerInfo{}
+	ok := ss.Query(func() {
+		for _, peer := range ss.db.Peers {
+			infos = append(infos, ss.GetPeerInfo(peer))
+		}
+	})
+	if !ok {
+		http.Error(w, "server blocked", http.StatusServiceUnavailable)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	writeJson(w, infos)
+}
+
+func (ss *SignalServer) serveServices(w http.ResponseWriter, r *http.Request) {
+	stats := []*ServiceStat{}
+	ok := ss.Query(func() {
+		for _, service := range ss.db.Services {
+			online := ss.IsOnline(service.Owner)
+			stat := &ServiceStat{
+				Name:        service.Name,
+				Owner:       service.Owner,
+				OwnerOnline: online,
+				Enabled:     service.Enabled,
+				Active:      service.Enabled && online,
+			}
+			for _, peer := range ss.db.Peers {
+				if peer.InServices[service.Name] {
+					stat.Members += 1
+				}
+			}
+			stats = append(stats, stat)
+		}
+	})
+	if !ok {
+		http.Error(w, "server blocked", http.StatusServiceUnavailable)
+		return
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	writeJson(w, stats)
+}
+
+func (ss *SignalServer) serveConnections(w http.ResponseWriter, r *http.Request) {
+	stats := []*ConnectionStat{}
+	ok := ss.Query(func() {
+		for conn := range ss.connections {
+			stats = append(stats, &ConnectionStat{Id: conn.id, Addr: conn.RemoteAddr()})
+		}
+		for id, conn := range ss.onlines {
+			stats = append(stats, &ConnectionStat{Id: id, Addr: conn.RemoteAddr(), Online: true})
+		}
+	})
+	if !ok {
+		http.Error(w, "server blocked", http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, stats)
+}
+
+func (ss *SignalServer) serveCounters(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]*CounterStat)
+	for action, am := range ss.metrics.Counters() {
+		stats[action] = &CounterStat{Count: am.Count, Errors: am.Errors, AvgMs: am.AvgMs()}
+	}
+	writeJson(w, stats)
+}
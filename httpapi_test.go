@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+func getTestServiceStat(t *testing.T, ss *SignalServer, name string) *ServiceStat {
+	t.Helper()
+	w := httptest.NewRecorder()
+	ss.serveServices(w, httptest.NewRequest("GET", "/api/services", nil))
+	var stats []*ServiceStat
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, stat := range stats {
+		if stat.Name == name {
+			return stat
+		}
+	}
+	t.Fatalf("service %s not found", name)
+	return nil
+}
+
+func TestServiceStatActive(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, _ := newTestService(t, ss)
+
+	if stat := getTestServiceStat(t, ss, "svc"); stat.Active {
+		t.Errorf("disabled service is active")
+	}
+
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	if resp := doTestRequest(t, owner, kActionEnableService, req); len(resp.Error) > 0 {
+		t.Fatalf("enable-service: %s", resp.Error)
+	}
+	if stat := getTestServiceStat(t, ss, "svc"); !stat.Active || !stat.OwnerOnline {
+		t.Errorf("enabled service of online owner: active %v, online %v", stat.Active, stat.OwnerOnline)
+	}
+
+	if resp := doTestRequest(t, owner, kActionLogout, NewSignalRequest("owner")); len(resp.Error) > 0 {
+		t.Fatalf("logout: %s", resp.Error)
+	}
+	if stat := getTestServiceStat(t, ss, "svc"); stat.Active {
+		t.Errorf("service of offline owner is active")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ss := newTestSignalServer()
+
+	ss.mu.Lock()
+	ran := false
+	ok := ss.Query(func() { ran = true })
+	ss.mu.Unlock()
+	if ok {
+		t.Fatal("query with lock held")
+	}
+
+	// fn is never run after timeout
+	time.Sleep(100 * time.Millisecond)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ran {
+		t.Fatal("fn run after timeout")
+	}
+}
@@ -2,44 +2,77 @@ package main
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 
 	util "github.com/PeterXu/goutil"
 	ice "github.com/pion/ice/v2"
+	"github.com/pion/transport/vnet"
 )
 
 var (
 	defaultStunUrls = []string{"stun.voipbuster.com", "stun.wirlab.net"}
 )
 
+// max size of one ice packet, larger data is split
+const kIceMaxPayload = 1200
+
+// virtual network of agent, e.g. pion vnet behind nat for tests
+type IceNet struct {
+	Net        *vnet.Net
+	NAT1To1IPs []string // advertised as host candidates
+	StunUrls   []string // server reflexive candidates by stun of vnet
+}
+
 type IceAgent struct {
 	util.Logging
 	*EvObject
 
 	agent         *ice.Agent
 	isControlling bool
+	lite          bool // full ice is required if both sides are agents
+	net           *IceNet
 	ch_send       chan []byte
 	ch_recv       chan []byte
 	ch_err        chan error
+	ch_done       chan struct{}
+	doneOnce      sync.Once
+
+	mu   sync.Mutex
+	conn *ice.Conn // after started
+
+	bytesIn  uint64
+	bytesOut uint64
 }
 
 func NewIceAgent(controlling bool) *IceAgent {
 	agent := &IceAgent{
 		EvObject:      NewEvObject(),
 		isControlling: controlling,
+		lite:          true,
 		ch_send:       make(chan []byte),
 		ch_recv:       make(chan []byte),
 		ch_err:        make(chan error),
+		ch_done:       make(chan struct{}),
 	}
 	agent.TAG = "ice"
 	return agent
 }
 
+// set before Init
+func (a *IceAgent) SetNet(net *IceNet) {
+	a.net = net
+}
+
 func (a *IceAgent) Init(urls []string) error {
 	a.Println("init urls:", urls)
 
-	if len(urls) == 0 {
+	if len(urls) == 0 && a.net == nil {
 		urls = append(urls, defaultStunUrls...)
 	}
+	if a.net != nil {
+		urls = append(urls, a.net.StunUrls...)
+	}
 
 	var iceUrls []*ice.URL
 	for _, item := range urls {
@@ -56,9 +89,23 @@ func (a *IceAgent) Init(urls []string) error {
 			ice.NetworkTypeUDP4,
 			ice.NetworkTypeTCP4,
 		},
-		Lite:               true,
+		Lite:               a.lite,
 		InsecureSkipVerify: true,
 	}
+	if a.net != nil {
+		// vnet is udp only, server reflexive if behind nat with stun
+		config.Net = a.net.Net
+		config.NetworkTypes = []ice.NetworkType{ice.NetworkTypeUDP4}
+		config.CandidateTypes = []ice.CandidateType{ice.CandidateTypeHost}
+		if len(a.net.StunUrls) > 0 {
+			config.CandidateTypes = append(config.CandidateTypes, ice.CandidateTypeServerReflexive)
+		}
+		config.MulticastDNSMode = ice.MulticastDNSModeDisabled
+		if len(a.net.NAT1To1IPs) > 0 {
+			config.NAT1To1IPs = a.net.NAT1To1IPs
+			config.NAT1To1IPCandidateType = ice.CandidateTypeHost
+		}
+	}
 
 	if agent, err := ice.NewAgent(config); err != nil {
 		a.Warnln("create agent error:", err)
@@ -110,6 +157,9 @@ func (a *IceAgent) Init(urls []string) error {
 }
 
 func (a *IceAgent) Uninit() {
+	a.doneOnce.Do(func() {
+		close(a.ch_done)
+	})
 	if a.agent != nil {
 		a.Stop()
 		a.agent.Close()
@@ -129,6 +179,9 @@ func (a *IceAgent) Start(remoteUfrag, remotePwd string) error {
 		a.Warnln("agent start error:", err)
 		return (err)
 	}
+	a.mu.Lock()
+	a.conn = conn
+	a.mu.Unlock()
 
 	// Send messages in a loop to the remote peer
 	go func() {
@@ -147,6 +200,7 @@ func (a *IceAgent) Start(remoteUfrag, remotePwd string) error {
 					a.Warnln("write, conn send error:", err)
 					return
 				}
+				atomic.AddUint64(&a.bytesOut, uint64(len(data)))
 			case err := <-a.ch_err:
 				a.Println("write, recv error:", err)
 				return
@@ -164,15 +218,47 @@ func (a *IceAgent) Start(remoteUfrag, remotePwd string) error {
 				a.ch_err <- nil
 				return
 			}
-			a.ch_recv <- buf[0:n]
+			atomic.AddUint64(&a.bytesIn, uint64(n))
+			data := make([]byte, n)
+			copy(data, buf[0:n])
+			select {
+			case a.ch_recv <- data:
+			case <-a.ch_done:
+				return
+			}
 		}
 	}()
 
 	return nil
 }
 
+// write one packet to ice conn directly, not queued by ch_send.
+// the packet is unreliable, see TunnelConn.
+func (a *IceAgent) WritePacket(data []byte) error {
+	a.mu.Lock()
+	conn := a.conn
+	a.mu.Unlock()
+	if conn == nil {
+		return errTunnelNotExist
+	}
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	atomic.AddUint64(&a.bytesOut, uint64(len(data)))
+	return nil
+}
+
+// no-op if not started
 func (a *IceAgent) Stop() {
-	a.ch_err <- nil
+	select {
+	case a.ch_err <- nil:
+	default:
+	}
+}
+
+// return bytes received/sent by ice conn
+func (a *IceAgent) GetBytes() (in uint64, out uint64) {
+	return atomic.LoadUint64(&a.bytesIn), atomic.LoadUint64(&a.bytesOut)
 }
 
 func (a *IceAgent) AddRemoteCandidate(candidate string) error {
@@ -216,11 +302,11 @@ func (a *IceAgent) RestartIce(ufrag, pwd string) error {
 }
 
 func (a *IceAgent) GatherCandidates() error {
-	return a.GatherCandidates()
+	return a.agent.GatherCandidates()
 }
 
 func (a *IceAgent) GetCandidatePairsStats() []ice.CandidatePairStats {
-	return a.GetCandidatePairsStats()
+	return a.agent.GetCandidatePairsStats()
 }
 
 func (a *IceAgent) GetLocalCandidatesStats() []ice.CandidateStats {
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	kKeyringUser    = "user"
+	kKeyringService = "service"
+)
+
+/**
+ * Keyring, encrypted credentials per profile in ~/.netpie/<profile>.keyring
+ *	file: json of salt/nonce/data, data = aes-gcm(json of entries)
+ *	key: scrypt(passphrase, salt)
+ */
+type keyringFile struct {
+	Salt  []byte
+	Nonce []byte
+	Data  []byte
+}
+
+func NewKeyring(profile string) *Keyring {
+	k := &Keyring{}
+	if dir, err := GetProfileDir(); err == nil {
+		k.fname = filepath.Join(dir, profile+".keyring")
+	}
+	return k
+}
+
+type Keyring struct {
+	fname   string
+	salt    []byte
+	key     []byte
+	entries map[string]string // kind/name => secret
+}
+
+func (k *Keyring) IsExist() bool {
+	if len(k.fname) == 0 {
+		return false
+	}
+	_, err := os.Stat(k.fname)
+	return err == nil
+}
+
+func (k *Keyring) IsUnlocked() bool {
+	return k.entries != nil
+}
+
+// unlock existing keyring or create new one with passphrase
+func (k *Keyring) Unlock(passphrase string) error {
+	if len(k.fname) == 0 {
+		return errNoProfileDir
+	}
+
+	if !k.IsExist() {
+		k.salt = make([]byte, 16)
+		if _, err := rand.Read(k.salt); err != nil {
+			return err
+		}
+		if err := k.deriveKey(passphrase); err != nil {
+			return err
+		}
+		k.entries = make(map[string]string)
+		return k.save()
+	}
+
+	data, err := os.ReadFile(k.fname)
+	if err != nil {
+		return err
+	}
+	var kf keyringFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return err
+	}
+
+	k.salt = kf.Salt
+	if err := k.deriveKey(passphrase); err != nil {
+		return err
+	}
+	plain, err := k.open(kf.Nonce, kf.Data)
+	if err != nil {
+		k.key = nil
+		return errKeyringPassword
+	}
+
+	entries := make(map[string]string)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return err
+	}
+	k.entries = entries
+	return nil
+}
+
+func (k *Keyring) Lock() {
+	k.key = nil
+	k.entries = nil
+}
+
+func (k *Keyring) Get(kind, name string) (string, error) {
+	if !k.IsUnlocked() {
+		return "", errKeyringLocked
+	}
+	if secret, ok := k.entries[kind+"/"+name]; ok {
+		return secret, nil
+	}
+	return "", errKeyringNotFound
+}
+
+func (k *Keyring) Set(kind, name, secret string) error {
+	if !k.IsUnlocked() {
+		return errKeyringLocked
+	}
+	k.entries[kind+"/"+name] = secret
+	return k.save()
+}
+
+func (k *Keyring) Remove(kind, name string) error {
+	if !k.IsUnlocked() {
+		return errKeyringLocked
+	}
+	if _, ok := k.entries[kind+"/"+name]; !ok {
+		return errKeyringNotFound
+	}
+	delete(k.entries, kind+"/"+name)
+	return k.save()
+}
+
+func (k *Keyring) List() ([]string, error) {
+	if !k.IsUnlocked() {
+		return nil, errKeyringLocked
+	}
+	var names []string
+	for key := range k.entries {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (k *Keyring) deriveKey(passphrase string) (err error) {
+	k.key, err = scrypt.Key([]byte(passphrase), k.salt, 32768, 8, 1, 32)
+	return
+}
+
+func (k *Keyring) newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) open(nonce, data []byte) ([]byte, error) {
+	gcm, err := k.newGCM()
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+func (k *Keyring) save() error {
+	plain, err := json.Marshal(k.entries)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := k.newGCM()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	kf := &keyringFile{
+		Salt:  k.salt,
+		Nonce: nonce,
+		Data:  gcm.Seal(nil, nonce, plain, nil),
+	}
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(k.fname, data, 0600)
+}
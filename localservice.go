@@ -1,31 +1,190 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
+	"sync"
 	"time"
 
+	util "github.com/PeterXu/goutil"
 	gn "github.com/panjf2000/gnet"
 )
 
-func NewLocalService(name string, isServer bool) *LocalService {
+const (
+	kLocalRoleProvider  = "provider"  // dial to local service
+	kLocalRoleRequester = "requester" // listen for local users
+
+	kLocalDialTimeout = 3 * time.Second
+	kLocalReadSize    = 16 * 1024
+	kLocalBusyWait    = 10 * time.Millisecond
+	kLocalWriteQueue  = 1024 // messages of one stream to local conn
+)
+
+// remote side of LocalService, e.g. PeerConnection of gateway
+type LocalServiceSink interface {
+	SendData(data []byte) bool
+}
+
+func NewLocalService(name, peerId string, isServer bool) *LocalService {
 	return &LocalService{
 		name:     name,
+		peerId:   peerId,
 		isServer: isServer,
+		accepted: make(map[uint32]gn.Conn),
+		dialed:   make(map[uint32]*localStream),
+		TimeInfo: NewTimeInfo(),
 	}
 }
 
+/**
+ * One tunnel of service@peer, between local conns and remote
+ *	a. ice tunnel: streams over TunnelConn, one stream per local conn,
+ *	   requester accepts conns and opens streams by id,
+ *	   provider dials local service for each opened stream.
+ *	b. gateway: one raw stream to sink(data-channel), provider only.
+ *	c. fields are guarded by mu, gnet callbacks never block.
+ *	d. tunnel messages never block: provider dials and writes by
+ *	   goroutine of each stream, and closes the stream if its queue is full.
+ */
 type LocalService struct {
 	gn.EventServer
 
 	name     string // serviceName
+	peerId   string // remote peer
 	isServer bool
-	conn     gn.Conn
-	client   *gn.Client
 
-	agent *IceAgent
+	mu         sync.Mutex
+	proto      string
+	addr       string
+	conn       gn.Conn // raw stream of sink
+	client     *gn.Client
+	serving    bool // listening by gnet server
+	closed     bool
+	nextStream uint32
+	accepted   map[uint32]gn.Conn      // requester streams
+	dialed     map[uint32]*localStream // provider streams
+
+	agent   *IceAgent
+	tunnel  *TunnelConn
+	sink    LocalServiceSink
+	onClose func()
+
+	*TimeInfo
+}
+
+/**
+ * Local service stats, for tunnels/tunnel-stats
+ */
+type LocalServiceStats struct {
+	Service       string
+	PeerId        string
+	Role          string
+	Bind          string
+	CandidatePair string
+	BytesIn       uint64
+	BytesOut      uint64
+	Streams       int
+	Uptime        int64 // seconds
+}
+
+// provider stream, written by its own goroutine
+type localStream struct {
+	conn     net.Conn    // nil until dialed
+	ch_write chan []byte // closed when stream is removed
+}
+
+// remove stream with lock held, return it if exist
+func (s *LocalService) removeStreamLocked(id uint32) *localStream {
+	st, ok := s.dialed[id]
+	if !ok {
+		return nil
+	}
+	delete(s.dialed, id)
+	close(st.ch_write)
+	return st
+}
+
+func (s *LocalService) Role() string {
+	if s.isServer {
+		return kLocalRoleRequester
+	} else {
+		return kLocalRoleProvider
+	}
+}
+
+func (s *LocalService) GetStats() *LocalServiceStats {
+	s.mu.Lock()
+	stats := &LocalServiceStats{
+		Service: s.name,
+		PeerId:  s.peerId,
+		Role:    s.Role(),
+		Streams: len(s.accepted) + len(s.dialed),
+		Uptime:  (util.NowMs() - s.ctime) / 1000,
+	}
+	if s.conn != nil {
+		stats.Streams += 1
+	}
+	if len(s.addr) > 0 {
+		stats.Bind = fmt.Sprintf("%s://%s", s.proto, s.addr)
+	}
+	agent := s.agent
+	s.mu.Unlock()
+
+	if agent != nil && agent.agent != nil {
+		if pair, err := agent.GetSelectedCandidatePair(); err == nil && pair != nil {
+			stats.CandidatePair = pair.String()
+		}
+		stats.BytesIn, stats.BytesOut = agent.GetBytes()
+	}
+	return stats
+}
+
+func (s *LocalService) SetAddr(proto, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proto = proto
+	s.addr = addr
+}
+
+func (s *LocalService) GetAddr() (proto, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proto, s.addr
+}
+
+// called once when uninit
+func (s *LocalService) SetOnClose(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClose = fn
+}
+
+func (s *LocalService) SetSink(sink LocalServiceSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sink = sink
+}
+
+// init with addr set before
+func (s *LocalService) Start() error {
+	proto, addr := s.GetAddr()
+	return s.Init(proto, addr)
+}
+
+// raw data from sink, write to local conn
+func (s *LocalService) OnRemoteData(data []byte) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.AsyncWrite(data)
+	}
 }
 
 func (s *LocalService) Init(proto, addr string) error {
+	s.SetAddr(proto, addr)
 	if s.isServer {
 		return s.InitServer(proto, addr)
 	} else {
@@ -37,77 +196,348 @@ func (s *LocalService) InitClient(proto, addr string) error {
 	if cli, conn, err := startClient(proto, addr, s); err != nil {
 		return err
 	} else {
+		s.mu.Lock()
 		s.conn = conn
 		s.client = cli
+		s.mu.Unlock()
 		return nil
 	}
 }
 
 func (s *LocalService) InitServer(proto, addr string) error {
+	s.mu.Lock()
+	s.serving = true
+	s.mu.Unlock()
 	go startServer(proto, addr, s)
 	return nil
 }
 
 func (s *LocalService) Uninit() {
-	if s.conn != nil {
-		s.conn.Close()
-		s.conn = nil
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
 	}
-	if s.client != nil {
-		s.client.Stop()
-		s.client = nil
+	s.closed = true
+	conn, client, agent, tunnel := s.conn, s.client, s.agent, s.tunnel
+	s.conn, s.client, s.agent, s.tunnel = nil, nil, nil, nil
+	accepted, dialed := s.accepted, s.dialed
+	s.accepted = make(map[uint32]gn.Conn)
+	s.dialed = make(map[uint32]*localStream)
+	serving, uri := s.serving, fmt.Sprintf("%s://%s", s.proto, s.addr)
+	s.serving = false
+	fn := s.onClose
+	s.onClose = nil
+	s.mu.Unlock()
+
+	if tunnel != nil {
+		tunnel.Close()
+	}
+	for _, c := range accepted {
+		c.Close()
+	}
+	for _, st := range dialed {
+		close(st.ch_write)
+		if st.conn != nil {
+			st.conn.Close()
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if client != nil {
+		client.Stop()
+	}
+	if agent != nil {
+		agent.Uninit()
 	}
-	if s.agent != nil {
-		s.agent.Uninit()
-		s.agent = nil
+	if serving {
+		go gn.Stop(context.Background(), uri)
+	}
+	if fn != nil {
+		fn()
 	}
 }
 
-func (s *LocalService) InitIce(controlling bool, client *SignalClient) {
-	s.agent = NewIceAgent(controlling)
-	s.agent.Init([]string{})
+// requester is controlling, and remote is the peer of tunnel
+func (s *LocalService) InitIce(controlling bool, client *SignalClient, iceNet *IceNet) error {
+	agent := NewIceAgent(controlling)
+	agent.lite = false
+	agent.SetNet(iceNet)
 
 	// listen ice-agent's events
-	s.agent.ListenEvent("ice-auth", func(e evEvent) error {
-		candidate := e.Get("candidate").(string)
-		if len(candidate) > 0 {
-			client.SendIceCandidate(candidate, s.name)
+	agent.ListenEvent("ice-auth", func(e evEvent) error {
+		ufrag, _ := e.Get("ufrag").(string)
+		pwd, _ := e.Get("pwd").(string)
+		if len(ufrag) > 0 && len(pwd) > 0 {
+			client.SendIceAuth(ufrag, pwd, s.name, s.peerId)
 		}
 		return nil
 	})
-	s.agent.ListenEvent("ice-candidate", func(e evEvent) error {
-		ufrag := e.Get("ufrag").(string)
-		pwd := e.Get("pwd").(string)
-		if len(ufrag) > 0 && len(pwd) > 0 {
-			client.SendIceAuth(ufrag, pwd, s.name)
+	agent.ListenEvent("ice-candidate", func(e evEvent) error {
+		if candidate, _ := e.Get("candidate").(string); len(candidate) > 0 {
+			client.SendIceCandidate(candidate, s.name, s.peerId)
 		}
 		return nil
 	})
+	if err := agent.Init([]string{}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.agent = agent
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *LocalService) getAgent() *IceAgent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agent
 }
 
+// start ice once remote auth is known, dial/accept is blocking
 func (s *LocalService) OnIceAuth(ufrag, pwd string) error {
-	return s.agent.Start(ufrag, pwd)
+	agent := s.getAgent()
+	if agent == nil {
+		return errTunnelNotExist
+	}
+
+	go func() {
+		if err := agent.Start(ufrag, pwd); err != nil {
+			log.Println("tunnel ice start error:", s.name, s.peerId, err)
+			s.Uninit()
+			return
+		}
+
+		tunnel := NewTunnelConn(agent.WritePacket, s.OnTunnelMessage, s.Uninit)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			tunnel.Close()
+			return
+		}
+		s.tunnel = tunnel
+		s.mu.Unlock()
+
+		// requester accepts local conns after connected
+		if s.isServer {
+			if err := s.Start(); err != nil {
+				log.Println("tunnel start local service error:", s.name, s.peerId, err)
+				s.Uninit()
+				return
+			}
+		}
+		for {
+			select {
+			case data := <-agent.ch_recv:
+				tunnel.Input(data)
+			case <-agent.ch_done:
+				return
+			}
+		}
+	}()
+	return nil
 }
 
 func (s *LocalService) OnIceCandidate(candidate string) error {
-	return s.agent.AddRemoteCandidate(candidate)
+	if agent := s.getAgent(); agent != nil {
+		return agent.AddRemoteCandidate(candidate)
+	}
+	return errTunnelNotExist
+}
+
+// message of stream from tunnel, in order and never blocks
+func (s *LocalService) OnTunnelMessage(kind byte, id uint32, data []byte) {
+	s.mu.Lock()
+	tunnel := s.tunnel
+	accepted := s.accepted[id]
+	full := false
+	switch kind {
+	case kTunnelStreamData:
+		if st, ok := s.dialed[id]; ok {
+			select {
+			case st.ch_write <- data:
+			default:
+				full = true
+			}
+		}
+	case kTunnelStreamClose:
+		// queued data is written before local conn is closed
+		delete(s.accepted, id)
+		s.removeStreamLocked(id)
+	}
+	s.mu.Unlock()
+	if tunnel == nil {
+		return
+	}
+
+	switch kind {
+	case kTunnelStreamOpen:
+		if !s.isServer {
+			s.openStream(tunnel, id)
+		}
+	case kTunnelStreamData:
+		if accepted != nil {
+			accepted.AsyncWrite(data)
+		} else if full {
+			log.Println("tunnel stream queue full:", s.name, id)
+			s.closeStream(tunnel, id)
+		}
+	case kTunnelStreamClose:
+		if accepted != nil {
+			accepted.Close()
+		}
+	}
+}
+
+// provider dials local service for stream opened by remote, in background
+func (s *LocalService) openStream(tunnel *TunnelConn, id uint32) {
+	s.mu.Lock()
+	if _, ok := s.dialed[id]; s.closed || ok {
+		s.mu.Unlock()
+		return
+	}
+	st := &localStream{ch_write: make(chan []byte, kLocalWriteQueue)}
+	s.dialed[id] = st
+	s.mu.Unlock()
+
+	go s.runStream(tunnel, id, st)
+}
+
+// dial, then write queued data to local conn until stream removed
+func (s *LocalService) runStream(tunnel *TunnelConn, id uint32, st *localStream) {
+	proto, addr := s.GetAddr()
+	conn, err := net.DialTimeout(proto, addr, kLocalDialTimeout)
+	if err != nil {
+		log.Println("tunnel dial local service error:", s.name, addr, err)
+		s.closeStream(tunnel, id)
+		return
+	}
+
+	s.mu.Lock()
+	if s.dialed[id] != st {
+		// closed by remote or uninit when dialing
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	st.conn = conn
+	s.mu.Unlock()
+
+	go s.readStream(tunnel, id, conn)
+	for data := range st.ch_write {
+		if _, err := conn.Write(data); err != nil {
+			s.closeStream(tunnel, id)
+			break
+		}
+	}
+	conn.Close()
+}
+
+// read local conn of provider stream, and send to tunnel
+func (s *LocalService) readStream(tunnel *TunnelConn, id uint32, conn net.Conn) {
+	buf := make([]byte, kLocalReadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			s.closeStream(tunnel, id)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		// wait for acks if tunnel is busy
+		for {
+			err = tunnel.Send(kTunnelStreamData, id, data)
+			if err != errTunnelBusy {
+				break
+			}
+			time.Sleep(kLocalBusyWait)
+		}
+		if err != nil {
+			s.closeStream(tunnel, id)
+			return
+		}
+	}
+}
+
+// close local conn of provider stream, and notify remote
+func (s *LocalService) closeStream(tunnel *TunnelConn, id uint32) {
+	s.mu.Lock()
+	st := s.removeStreamLocked(id)
+	s.mu.Unlock()
+	if st != nil {
+		if st.conn != nil {
+			st.conn.Close()
+		}
+		tunnel.Send(kTunnelStreamClose, id, nil)
+	}
 }
 
 func (s *LocalService) OnInitComplete(server gn.Server) (action gn.Action) {
 	return
 }
 
+// new local conn of requester, open stream of tunnel
 func (s *LocalService) OnOpened(conn gn.Conn) (out []byte, action gn.Action) {
-	s.conn = conn
+	s.mu.Lock()
+	tunnel := s.tunnel
+	if !s.isServer || tunnel == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.nextStream += 1
+	id := s.nextStream
+	conn.SetContext(id)
+	s.accepted[id] = conn
+	s.mu.Unlock()
+
+	if err := tunnel.Send(kTunnelStreamOpen, id, nil); err != nil {
+		action = gn.Close
+	}
 	return
 }
 
 func (s *LocalService) OnClosed(conn gn.Conn, err error) (action gn.Action) {
-	s.conn = nil
+	id, ok := conn.Context().(uint32)
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	tunnel := s.tunnel
+	if ok && s.accepted[id] != conn {
+		ok = false
+	}
+	if ok {
+		delete(s.accepted, id)
+	}
+	s.mu.Unlock()
+
+	if ok && tunnel != nil {
+		tunnel.Send(kTunnelStreamClose, id, nil)
+	}
 	return
 }
 
+// never blocks: queued by tunnel, and closed if tunnel is busy
 func (s *LocalService) React(frame []byte, conn gn.Conn) (out []byte, action gn.Action) {
+	if len(frame) == 0 {
+		return
+	}
+	data := make([]byte, len(frame))
+	copy(data, frame)
+
+	s.mu.Lock()
+	tunnel, sink := s.tunnel, s.sink
+	s.mu.Unlock()
+
+	if id, ok := conn.Context().(uint32); ok {
+		if tunnel == nil || tunnel.Send(kTunnelStreamData, id, data) != nil {
+			action = gn.Close
+		}
+	} else if sink != nil {
+		sink.SendData(data)
+	}
 	return
 }
 
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// tcp server which accepts and never reads
+func startTestSink(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch_conns := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		ln.Close()
+		for {
+			select {
+			case conn := <-ch_conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ch_conns <- conn
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestLocalServiceNeverBlocks(t *testing.T) {
+	s := NewLocalService("svc", "peer", false)
+	s.SetAddr("tcp", startTestSink(t))
+	tunnel := NewTunnelConn(func(pkt []byte) error { return nil }, nil, nil)
+	s.tunnel = tunnel
+	defer s.Uninit()
+
+	// slow consumer of stream 1
+	data := make([]byte, kTunnelMaxChunk)
+	start := time.Now()
+	s.OnTunnelMessage(kTunnelStreamOpen, 1, nil)
+	for i := 0; i < 4*kLocalWriteQueue; i++ {
+		s.OnTunnelMessage(kTunnelStreamData, 1, data)
+	}
+	// stream 2 of unreachable local service
+	s.SetAddr("tcp", "10.255.255.1:9")
+	s.OnTunnelMessage(kTunnelStreamOpen, 2, nil)
+	s.OnTunnelMessage(kTunnelStreamData, 2, data)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("tunnel messages blocked for %v", elapsed)
+	}
+
+	// stream 1 closed by full queue
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		_, ok := s.dialed[1]
+		s.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream of slow consumer not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
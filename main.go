@@ -5,20 +5,82 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	util "github.com/PeterXu/goutil"
 )
 
 func main() {
 	var client_signal_addr string
+	var client_json bool
+	var client_profile string
 	clientFlags := flag.NewFlagSet("client", flag.ExitOnError)
-	clientFlags.StringVar(&client_signal_addr, "sigaddr", "127.0.0.1:9527", "The address of signal server")
+	clientFlags.StringVar(&client_signal_addr, "sigaddr", "127.0.0.1:9527", "The address of signal server, or a comma-separated list for failover")
+	clientFlags.BoolVar(&client_json, "json", false, "Output results and events as json lines")
+	clientFlags.StringVar(&client_profile, "profile", kDefaultProfile, "The profile of history and keyring")
 
 	var server_signal_addr string
+	var server_json bool
+	var server_profile string
+	var server_gw_ip string
+	var server_gw_port int
+	var server_gw_tcp bool
 	serverFlags := flag.NewFlagSet("server", flag.ExitOnError)
-	serverFlags.StringVar(&server_signal_addr, "sigaddr", "127.0.0.1:9527", "The address of signal server")
+	serverFlags.StringVar(&server_signal_addr, "sigaddr", "127.0.0.1:9527", "The address of signal server, or a comma-separated list for failover")
+	serverFlags.BoolVar(&server_json, "json", false, "Output results and events as json lines")
+	serverFlags.StringVar(&server_profile, "profile", kDefaultProfile, "The profile of history and keyring")
+	serverFlags.StringVar(&server_gw_ip, "gwip", "127.0.0.1", "The advertised ip of webrtc gateway")
+	serverFlags.IntVar(&server_gw_port, "gwport", 0, "The udp port of webrtc gateway(0: disabled)")
+	serverFlags.BoolVar(&server_gw_tcp, "gwtcp", false, "Enable ice-tcp of webrtc gateway on the same tcp port")
 
 	var signal_listen_addr string
+	var signal_admin_id string
+	var signal_admin_pwd_file string
+	var signal_register_mode string
+	var signal_api_addr string
+	var signal_api_token string
+	var signal_audit_file string
+	var signal_drain_timeout time.Duration
+	var signal_slow_policy string
+	var signal_node, signal_redis_addr, signal_redis_prefix string
 	signalFlags := flag.NewFlagSet("signal", flag.ExitOnError)
 	signalFlags.StringVar(&signal_listen_addr, "addr", "0.0.0.0:9527", "The address of signal listen")
+	signalFlags.StringVar(&signal_admin_id, "admin", kDefaultAdminId, "The admin id created at first start")
+	signalFlags.StringVar(&signal_admin_pwd_file, "adminpwd", kDefaultAdminPwdFile, "The file(mode 0600) of generated admin password, or from $"+kEnvAdminPassword)
+	signalFlags.StringVar(&signal_register_mode, "regmode", "", "The register mode: open|invite|admin (default: keep stored, or open)")
+	signalFlags.StringVar(&signal_api_addr, "apiaddr", "127.0.0.1:9528", "The address of http api(/api, /healthz, /metrics), empty to disable")
+	signalFlags.StringVar(&signal_api_token, "apitoken", "", "The bearer token of /api (default: random and printed)")
+	signalFlags.StringVar(&signal_audit_file, "audit", kDefaultAuditFile, "The audit log file(json lines, rotated), empty to disable")
+	signalFlags.DurationVar(&signal_drain_timeout, "drain", kDefaultDrainTimeout, "The deadline of draining clients when shutdown by SIGINT/SIGTERM")
+	signalFlags.StringVar(&signal_slow_policy, "slow", kSlowPolicyClose, "The policy of slow client whose send queue is full: close|drop")
+	signalFlags.StringVar(&signal_redis_addr, "redis", "", "The redis address of cluster store and bus, empty for single node")
+	signalFlags.StringVar(&signal_redis_prefix, "rediskey", "netpie", "The key prefix of cluster in redis")
+	signalFlags.StringVar(&signal_node, "node", "", "The unique node name in cluster (default: hostname and listen addr)")
+
+	var daemon_signal_addr, daemon_sock_addr string
+	var daemon_is_server bool
+	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	daemonFlags.StringVar(&daemon_signal_addr, "sigaddr", "127.0.0.1:9527", "The address of signal server, or a comma-separated list for failover")
+	daemonFlags.StringVar(&daemon_sock_addr, "sock", DefaultCtlSock(), "The unix socket of control api")
+	daemonFlags.BoolVar(&daemon_is_server, "server", false, "Run as server(service owner), else client")
+
+	var ctl_sock_addr string
+	var ctl_json bool
+	ctlFlags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	ctlFlags.StringVar(&ctl_sock_addr, "sock", DefaultCtlSock(), "The unix socket of daemon")
+	ctlFlags.BoolVar(&ctl_json, "json", false, "Output result as json")
+
+	var bench_signal_addr, bench_flows, bench_prefix string
+	var bench_clients, bench_rounds int
+	var bench_interval time.Duration
+	benchFlags := flag.NewFlagSet("bench", flag.ExitOnError)
+	benchFlags.StringVar(&bench_signal_addr, "sigaddr", "", "The address of target signal server(default: in-process loopback)")
+	benchFlags.IntVar(&bench_clients, "clients", 100, "The number of simulated clients, one service owner per 10")
+	benchFlags.IntVar(&bench_rounds, "rounds", 10, "The rounds of services/connect-service/ice-candidate per client")
+	benchFlags.DurationVar(&bench_interval, "interval", 200*time.Millisecond, "The interval between rounds of one client")
+	benchFlags.StringVar(&bench_flows, "flows", strings.Join(kBenchFlows, ","), "The comma-separated flows to run")
+	benchFlags.StringVar(&bench_prefix, "prefix", "", "The prefix of client ids(default: random)")
 
 	usage := func() {
 		fmt.Printf("usage: %s command\n", os.Args[0])
@@ -28,6 +90,12 @@ func main() {
 		serverFlags.PrintDefaults()
 		fmt.Println("signal")
 		signalFlags.PrintDefaults()
+		fmt.Println("daemon")
+		daemonFlags.PrintDefaults()
+		fmt.Println("ctl [command args...]")
+		ctlFlags.PrintDefaults()
+		fmt.Println("bench (load test of signal server)")
+		benchFlags.PrintDefaults()
 	}
 
 	if len(os.Args) < 2 {
@@ -45,17 +113,125 @@ func main() {
 		clientFlags.Parse(os.Args[2:])
 		fmt.Println(client_signal_addr)
 		client := NewClient(client_signal_addr)
+		if client_json {
+			client.ep.SetOutput(kOutputJson)
+		}
+		if err := client.ep.SetProfile(client_profile); err != nil {
+			fmt.Println("profile error:", err)
+			os.Exit(1)
+		}
 		client.StartShell()
 	case "server":
 		serverFlags.Parse(os.Args[2:])
 		fmt.Println(server_signal_addr)
 		server := NewServer(server_signal_addr)
+		if server_json {
+			server.ep.SetOutput(kOutputJson)
+		}
+		if err := server.ep.SetProfile(server_profile); err != nil {
+			fmt.Println("profile error:", err)
+			os.Exit(1)
+		}
+		if server_gw_port > 0 {
+			if err := server.EnableGateway(server_gw_ip, server_gw_port, server_gw_tcp); err != nil {
+				fmt.Println("gateway error:", err)
+				os.Exit(1)
+			}
+		}
 		server.StartShell()
 	case "signal":
 		signalFlags.Parse(os.Args[2:])
 		fmt.Println(signal_listen_addr)
 		signal := NewSignalServer()
+		if err := signal.SetSlowPolicy(signal_slow_policy); err != nil {
+			fmt.Println("slow policy error:", err)
+			os.Exit(1)
+		}
+		if len(signal_redis_addr) > 0 {
+			if len(signal_node) == 0 {
+				hostname, _ := os.Hostname()
+				signal_node = hostname + "/" + signal_listen_addr
+			}
+			signal.SetStore(NewRedisStore(NewRedisClient(signal_redis_addr), signal_redis_prefix))
+			if err := signal.EnableCluster(signal_node, NewRedisBus(signal_redis_addr, signal_redis_prefix)); err != nil {
+				fmt.Println("cluster error:", err)
+				os.Exit(1)
+			}
+		}
+		if err := signal.Bootstrap(signal_admin_id, signal_register_mode, signal_admin_pwd_file); err != nil {
+			fmt.Println("bootstrap error:", err)
+		}
+		if len(signal_audit_file) > 0 {
+			if err := signal.EnableAudit(signal_audit_file); err != nil {
+				fmt.Println("audit error:", err)
+				os.Exit(1)
+			}
+		}
+		if len(signal_api_addr) > 0 {
+			if len(signal_api_token) == 0 {
+				signal_api_token = util.RandomString(24)
+				fmt.Println("api token:", signal_api_token)
+			}
+			signal.StartApi(signal_api_addr, signal_api_token)
+		}
+		go signal.ShutdownOnSignal(signal_drain_timeout)
 		signal.Start(signal_listen_addr)
+	case "daemon":
+		daemonFlags.Parse(os.Args[2:])
+		fmt.Println(daemon_signal_addr, daemon_sock_addr)
+		daemon := NewDaemon(daemon_signal_addr, daemon_sock_addr, daemon_is_server)
+		if err := daemon.Start(); err != nil {
+			fmt.Println("daemon error:", err)
+			os.Exit(1)
+		}
+	case "ctl":
+		ctlFlags.Parse(os.Args[2:])
+		ctl := NewCtlClient(ctl_sock_addr)
+		args := ctlFlags.Args()
+		if len(args) == 0 || args[0] == "help" {
+			if actions, err := ctl.Actions(); err != nil {
+				fmt.Println("ctl error:", err)
+				os.Exit(1)
+			} else {
+				fmt.Println("All avaiable commands: ")
+				for _, item := range actions {
+					fmt.Printf("  %s\n", item)
+				}
+			}
+			return
+		}
+		output := kOutputText
+		if ctl_json {
+			output = kOutputJson
+		}
+		ret, err := ctl.Run(args[0], args[1:])
+		PrintResult(output, args[0], ret, err)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "bench":
+		benchFlags.Parse(os.Args[2:])
+		flows, err := ParseBenchFlows(bench_flows)
+		if err != nil {
+			fmt.Println("bench error:", err)
+			os.Exit(1)
+		}
+		result, err := RunBench(&BenchOptions{
+			Addr:     bench_signal_addr,
+			Clients:  bench_clients,
+			Rounds:   bench_rounds,
+			Interval: bench_interval,
+			Flows:    flows,
+			Prefix:   bench_prefix,
+		})
+		if err != nil {
+			fmt.Println("bench error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(result)
+		if result.Errors > 0 {
+			os.Exit(1)
+		}
 	default:
 		usage()
 		os.Exit(1)
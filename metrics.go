@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latency buckets(seconds) of request
+var kLatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+/**
+ * Counters of one action, updated by OnReceiveRequest
+ */
+type ActionMetrics struct {
+	Count   int64
+	Errors  int64
+	Seconds float64 // sum of latency
+	buckets []int64
+}
+
+func (am *ActionMetrics) AvgMs() float64 {
+	if am.Count == 0 {
+		return 0
+	}
+	return am.Seconds * 1000 / float64(am.Count)
+}
+
+/**
+ * Metrics of signal server, accessed by Run loop and http api
+ */
+type SignalMetrics struct {
+	mu sync.Mutex
+
+	logins        int64
+	loginFailures int64
+	iceForwarded  int64
+	slowConsumers int64
+	actions       map[string]*ActionMetrics
+}
+
+func NewSignalMetrics() *SignalMetrics {
+	return &SignalMetrics{
+		actions: make(map[string]*ActionMetrics),
+	}
+}
+
+func isIceForwardAction(action string) bool {
+	switch action {
+	case kActionEventIceOpen, kActionEventIceClose, kActionEventIceOpenAck, kActionEventIceCloseAck,
+		kActionEventIceAuth, kActionEventIceCandidate, kActionEventOffer, kActionEventAnswer:
+		return true
+	}
+	return false
+}
+
+func (sm *SignalMetrics) OnRequest(action string, err error, elapsed time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	am, ok := sm.actions[action]
+	if !ok {
+		am = &ActionMetrics{buckets: make([]int64, len(kLatencyBuckets))}
+		sm.actions[action] = am
+	}
+	seconds := elapsed.Seconds()
+	am.Count += 1
+	am.Seconds += seconds
+	for i, bound := range kLatencyBuckets {
+		if seconds <= bound {
+			am.buckets[i] += 1
+		}
+	}
+	if err != nil {
+		am.Errors += 1
+	}
+
+	switch {
+	case action == kActionLogin && err == nil:
+		sm.logins += 1
+	case action == kActionLogin:
+		sm.loginFailures += 1
+	case isIceForwardAction(action) && err == nil:
+		sm.iceForwarded += 1
+	}
+}
+
+func (sm *SignalMetrics) OnSlowConsumer() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.slowConsumers += 1
+}
+
+// copy of per-action counters
+func (sm *SignalMetrics) Counters() map[string]ActionMetrics {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	counters := make(map[string]ActionMetrics)
+	for action, am := range sm.actions {
+		counters[action] = ActionMetrics{Count: am.Count, Errors: am.Errors, Seconds: am.Seconds}
+	}
+	return counters
+}
+
+// prometheus text format(version 0.0.4), gauges are from server snapshot
+func (sm *SignalMetrics) WritePrometheus(w io.Writer, gauges map[string]int) {
+	var names []string
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE signal_%s gauge\n", name)
+		fmt.Fprintf(w, "signal_%s %d\n", name, gauges[name])
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	fmt.Fprintf(w, "# TYPE signal_logins_total counter\n")
+	fmt.Fprintf(w, "signal_logins_total %d\n", sm.logins)
+	fmt.Fprintf(w, "# TYPE signal_login_failures_total counter\n")
+	fmt.Fprintf(w, "signal_login_failures_total %d\n", sm.loginFailures)
+	fmt.Fprintf(w, "# TYPE signal_ice_forwarded_total counter\n")
+	fmt.Fprintf(w, "signal_ice_forwarded_total %d\n", sm.iceForwarded)
+	fmt.Fprintf(w, "# TYPE signal_slow_consumers_total counter\n")
+	fmt.Fprintf(w, "signal_slow_consumers_total %d\n", sm.slowConsumers)
+
+	var actions []string
+	for action := range sm.actions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	fmt.Fprintf(w, "# TYPE signal_requests_total counter\n")
+	for _, action := range actions {
+		fmt.Fprintf(w, "signal_requests_total{action=%q} %d\n", action, sm.actions[action].Count)
+	}
+	fmt.Fprintf(w, "# TYPE signal_request_errors_total counter\n")
+	for _, action := range actions {
+		fmt.Fprintf(w, "signal_request_errors_total{action=%q} %d\n", action, sm.actions[action].Errors)
+	}
+	fmt.Fprintf(w, "# TYPE signal_request_duration_seconds histogram\n")
+	for _, action := range actions {
+		am := sm.actions[action]
+		for i, bound := range kLatencyBuckets {
+			fmt.Fprintf(w, "signal_request_duration_seconds_bucket{action=%q,le=\"%g\"} %d\n", action, bound, am.buckets[i])
+		}
+		fmt.Fprintf(w, "signal_request_duration_seconds_bucket{action=%q,le=\"+Inf\"} %d\n", action, am.Count)
+		fmt.Fprintf(w, "signal_request_duration_seconds_sum{action=%q} %g\n", action, am.Seconds)
+		fmt.Fprintf(w, "signal_request_duration_seconds_count{action=%q} %d\n", action, am.Count)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/**
+ * Output mode of shell/ctl
+ *	text: human readable(default)
+ *	json: one json object per line, for commands and events
+ */
+const (
+	kOutputText = "text"
+	kOutputJson = "json"
+)
+
+func IsValidOutput(mode string) bool {
+	return mode == kOutputText || mode == kOutputJson
+}
+
+type JsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type JsonResult struct {
+	Action string      `json:"action"`
+	Ok     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *JsonError  `json:"error,omitempty"`
+}
+
+type JsonEvent struct {
+	Event   string            `json:"event"`
+	FromId  string            `json:"from"`
+	Service string            `json:"service,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+func NewJsonError(err error) *JsonError {
+	return &JsonError{Code: ErrorCode(err), Message: err.Error()}
+}
+
+func PrintJson(v interface{}) {
+	if data, err := json.Marshal(v); err != nil {
+		fmt.Printf("{\"error\":{\"code\":\"%s\",\"message\":%q}}\n", kErrorCodeUnknown, err.Error())
+	} else {
+		fmt.Println(string(data))
+	}
+}
+
+func PrintResult(mode, action string, ret *Result, err error) {
+	if mode == kOutputJson {
+		out := &JsonResult{Action: action, Ok: (err == nil)}
+		if ret != nil {
+			out.Result = ret.Value()
+		}
+		if err != nil {
+			out.Error = NewJsonError(err)
+		}
+		PrintJson(out)
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("== %s failed: %v\n", action, err)
+	} else {
+		fmt.Printf("== %s success\n", action)
+	}
+	if ret != nil {
+		fmt.Println("== result: \n", ret.data)
+	}
+}
+
+func PrintEvent(mode string, resp *SignalResponse) {
+	if mode != kOutputJson {
+		return
+	}
+	PrintJson(&JsonEvent{
+		Event:   resp.Event,
+		FromId:  resp.FromId,
+		Service: resp.ServiceName,
+		Data:    resp.ResultM,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// stdout of fn, as lines
+func captureTestStdout(t *testing.T, fn func()) []string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	fn()
+	os.Stdout = stdout
+	w.Close()
+
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	r.Close()
+	text := strings.TrimSpace(buf.String())
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+func decodeTestJson(t *testing.T, line string) map[string]interface{} {
+	t.Helper()
+	out := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(line), &out); err != nil {
+		t.Fatalf("not json: %q, %v", line, err)
+	}
+	return out
+}
+
+func TestJsonResultShape(t *testing.T) {
+	info := &SignalServiceInfo{Name: "svc", Owner: "owner", Enabled: true, Active: true, State: kServiceStateJoined}
+	ret, err := NewSignalClient().ParseServiceInfos(kActionServices, []string{util.JsonEncode(info)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := captureTestStdout(t, func() {
+		PrintResult(kOutputJson, kActionServices, ret, nil)
+		PrintResult(kOutputJson, kActionLogin, nil, errWrongPassword)
+	})
+	if len(lines) != 2 {
+		t.Fatalf("lines: %q", lines)
+	}
+
+	out := decodeTestJson(t, lines[0])
+	if out["action"] != kActionServices || out["ok"] != true || out["error"] != nil {
+		t.Errorf("result: %s", lines[0])
+	}
+	items, _ := out["result"].([]interface{})
+	if len(items) != 1 {
+		t.Fatalf("services: %s", lines[0])
+	}
+	item, _ := items[0].(map[string]interface{})
+	if item["Name"] != "svc" || item["Owner"] != "owner" || item["Enabled"] != true ||
+		item["Active"] != true || item["State"] != kServiceStateJoined {
+		t.Errorf("service object: %v", item)
+	}
+
+	// stable code, never the message
+	out = decodeTestJson(t, lines[1])
+	errObj, _ := out["error"].(map[string]interface{})
+	if out["ok"] != false || out["result"] != nil || errObj == nil ||
+		errObj["code"] != ErrorCode(errWrongPassword) || errObj["message"] != errWrongPassword.Error() {
+		t.Errorf("error result: %s", lines[1])
+	}
+}
+
+func TestJsonEventShape(t *testing.T) {
+	ev := NewSignalResponse("")
+	ev.Event = kActionEventServiceRevoked
+	ev.FromId = "owner"
+	ev.ServiceName = "svc"
+	ev.ResultM["reason"] = "kicked"
+
+	if lines := captureTestStdout(t, func() { PrintEvent(kOutputText, ev) }); len(lines) != 0 {
+		t.Errorf("event of text mode: %q", lines)
+	}
+	lines := captureTestStdout(t, func() { PrintEvent(kOutputJson, ev) })
+	if len(lines) != 1 {
+		t.Fatalf("lines: %q", lines)
+	}
+	out := decodeTestJson(t, lines[0])
+	data, _ := out["data"].(map[string]interface{})
+	if out["event"] != kActionEventServiceRevoked || out["from"] != "owner" || out["service"] != "svc" ||
+		data == nil || data["reason"] != "kicked" {
+		t.Errorf("event: %s", lines[0])
+	}
+}
@@ -1,11 +1,38 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pc "github.com/PeterXu/gopc"
+	util "github.com/PeterXu/goutil"
 )
 
+const (
+	kConnCheckInterval = 1000 // ms, re-rank interval of connections
+	kConnLossPenalty   = 10   // ms of rtt per loss percent
+	kConnSwitchRatio   = 2    // switch when active score is worse than best*ratio
+	kConnSwitchMinGap  = 50   // ms, ignore small score difference
+)
+
+/**
+ * PeerConnection, dtls/sctp terminated by gopc's DcPeer.
+ *	a. Connection(stun/dtls from one remote addr) -> onRecvDtlsData -> dc
+ *	b. dc -> ToSendData -> active Connection
+ *	c. dc -> OnSctpData -> LocalService, and LocalService -> SendData -> dc
+ */
 type PeerConnection struct {
 	TAG string
 
@@ -14,9 +41,14 @@ type PeerConnection struct {
 	tlsKey   string
 	sdpOffer string
 
+	mu          sync.Mutex
 	connections map[string]*Connection // key: addr
 	activeConn  *Connection
+	checkTime   int64 // last ranking of connections
+	rtpPackets  int64 // rtp/rtcp received, media is not supported
 	dc          *pc.DcPeer
+	service     *LocalService
+	closed      bool
 }
 
 func NewPeerConnection(stunName, tlsCrt, tlsKey, offer string) *PeerConnection {
@@ -27,6 +59,7 @@ func NewPeerConnection(stunName, tlsCrt, tlsKey, offer string) *PeerConnection {
 		return nil
 	}
 	pc := &PeerConnection{
+		TAG:         "[PC]",
 		stunName:    stunName,
 		tlsCrt:      tlsCrt,
 		tlsKey:      tlsKey,
@@ -39,19 +72,66 @@ func NewPeerConnection(stunName, tlsCrt, tlsKey, offer string) *PeerConnection {
 	return pc
 }
 
+func (pc *PeerConnection) setService(service *LocalService) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.service = service
+	service.SetSink(pc)
+}
+
 func (pc *PeerConnection) addConnection(conn *Connection) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	conn.pc = pc
+	pc.connections[connectionKey(conn.getRemoteAddr(), conn.tcp)] = conn
+}
+
+func (pc *PeerConnection) removeConnection(conn *Connection) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.connections, connectionKey(conn.getRemoteAddr(), conn.tcp))
+	if pc.activeConn == conn {
+		pc.activeConn = nil
+	}
+}
+
+// consent of conn expired, fail over to other ready one
+func (pc *PeerConnection) onConnectionDead(conn *Connection) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.activeConn == conn {
+		log.Println(pc.TAG, "active conn dead, addr=", conn.getRemoteAddr(), pc.stunName)
+		pc.activeConn = nil
+	}
+}
+
+func (pc *PeerConnection) hasConnection() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.connections) > 0
+}
+
+func (pc *PeerConnection) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
 }
 
 func (pc *PeerConnection) getActiveConn() *Connection {
-	const TAG string = "[PC]"
-	if pc.activeConn == nil {
-		for k, v := range pc.connections {
-			if v.isReady() {
-				pc.activeConn = v
-				log.Println("choose active conn, addr=", k, pc.stunName)
-				break
-			}
-		}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := util.NowMs()
+	if pc.activeConn != nil && !pc.activeConn.isReady() {
+		log.Println(pc.TAG, "active conn not ready, addr=", pc.activeConn.getRemoteAddr(), pc.stunName)
+		pc.activeConn = nil
+	}
+	if pc.activeConn == nil || now > pc.checkTime+kConnCheckInterval {
+		pc.checkTime = now
+		pc.selectActiveConn()
 	}
 	if pc.activeConn == nil {
 		log.Println("no active conn, id=", pc.stunName)
@@ -60,26 +140,165 @@ func (pc *PeerConnection) getActiveConn() *Connection {
 	return pc.activeConn
 }
 
+// score of path quality by rtt and loss, lower is better, -1 if unknown
+func connScore(conn *Connection) int {
+	rtt := conn.getRtt()
+	if rtt < 0 {
+		return -1
+	}
+	return rtt + conn.getLoss()*kConnLossPenalty
+}
+
+// rank ready connections, switch only when the active path degrades,
+// dtls/sctp are kept since dc is independent of Connection.
+func (pc *PeerConnection) selectActiveConn() {
+	var best *Connection
+	bestScore := -1
+	for _, v := range pc.connections {
+		if !v.isReady() {
+			continue
+		}
+		score := connScore(v)
+		if best == nil || (score >= 0 && (bestScore < 0 || score < bestScore)) {
+			best, bestScore = v, score
+		}
+	}
+	if best == nil || best == pc.activeConn {
+		return
+	}
+
+	if pc.activeConn != nil {
+		activeScore := connScore(pc.activeConn)
+		if bestScore < 0 || activeScore < 0 {
+			return
+		}
+		if activeScore < bestScore*kConnSwitchRatio || activeScore-bestScore < kConnSwitchMinGap {
+			return
+		}
+		log.Println(pc.TAG, "switch active conn, from=", pc.activeConn.getRemoteAddr(), activeScore,
+			"to=", best.getRemoteAddr(), bestScore, pc.stunName)
+	} else {
+		log.Println(pc.TAG, "choose active conn, addr=", best.getRemoteAddr(), pc.stunName)
+	}
+	pc.activeConn = best
+}
+
 func (pc *PeerConnection) onRecvDtlsData(data []byte) {
+	pc.dc.RecvData(data)
+}
+
+// send to remote by sctp, called by LocalService
+func (pc *PeerConnection) SendData(data []byte) bool {
+	if pc.isClosed() {
+		return false
+	}
+	return pc.dc.SendSctpData(data)
+}
+
+func (pc *PeerConnection) Close() {
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	service := pc.service
+	pc.service = nil
+	pc.mu.Unlock()
+
+	pc.dc.Close()
+	if service != nil {
+		service.Uninit()
+	}
 }
 
 // callback of DcConnSink
 func (pc *PeerConnection) OnDtlsStatus(err error, id string) {
+	log.Println(pc.TAG, "dtls status:", id, err)
+	if err != nil {
+		pc.Close()
+	}
 }
 
 // callback of DcConnSink
 func (pc *PeerConnection) OnSctpStatus(err error, id string) {
+	log.Println(pc.TAG, "sctp status:", id, err)
+	if err != nil {
+		pc.Close()
+		return
+	}
+
+	// data-channel ready, connect to local service
+	pc.mu.Lock()
+	service := pc.service
+	pc.mu.Unlock()
+	if service != nil {
+		if err := service.Start(); err != nil {
+			log.Println(pc.TAG, "start local service error:", err)
+			pc.Close()
+		}
+	}
 }
 
 // callback of DcConnSink
 func (pc *PeerConnection) OnSctpData(data []byte, id string) {
+	pc.mu.Lock()
+	service := pc.service
+	pc.mu.Unlock()
+	if service != nil {
+		service.OnRemoteData(data)
+	}
 }
 
 // callback of DcConnSink
 func (pc *PeerConnection) OnRtpRtcpData(data []byte, id string) {
+	if atomic.AddInt64(&pc.rtpPackets, 1) == 1 {
+		log.Println(pc.TAG, "drop rtp/rtcp of data-channel session:", id)
+	}
 }
 
 // callback of DcConnSink
 func (pc *PeerConnection) ToSendData(data []byte, id string) bool {
+	if conn := pc.getActiveConn(); conn != nil {
+		return conn.sendData(data)
+	}
 	return false
 }
+
+// self-signed certificate for dtls, return pem of crt/key and sdp fingerprint
+func GenerateCertificate() (crtPem, keyPem, fingerprint string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "netpie"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	crtPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPem = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+
+	sum := sha256.Sum256(der)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	fingerprint = "sha-256 " + strings.Join(parts, ":")
+	return
+}
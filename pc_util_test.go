@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func setTestConnStat(conn *Connection, rtt, sent, lost int) {
+	conn.mu.Lock()
+	conn.rtt, conn.sent, conn.lost = rtt, sent, lost
+	conn.mu.Unlock()
+}
+
+// rank by rtt and loss, switch only when active path degrades
+func TestSelectActiveConn(t *testing.T) {
+	a, b, c := newTestConnection(1000), newTestConnection(2000), newTestConnection(3000)
+	pc := newTestPeerConnection(a, b, c)
+	setTestConnStat(a, 100, 10, 0)
+	setTestConnStat(b, 20, 10, 0)
+
+	// c without measurement is never preferred
+	pc.selectActiveConn()
+	if pc.activeConn != b {
+		t.Fatalf("best conn not chosen: %v", pc.activeConn.getRemoteAddr())
+	}
+
+	cases := []struct {
+		name   string
+		aStat  [3]int
+		bStat  [3]int
+		expect *Connection
+	}{
+		{"small gain", [3]int{10, 10, 0}, [3]int{20, 10, 0}, b},
+		{"active degraded", [3]int{20, 10, 0}, [3]int{300, 10, 0}, a},
+		{"active lossy", [3]int{20, 10, 5}, [3]int{100, 10, 0}, b},
+		{"active unknown", [3]int{10, 10, 0}, [3]int{0, 10, 10}, b},
+	}
+	for _, item := range cases {
+		setTestConnStat(a, item.aStat[0], item.aStat[1], item.aStat[2])
+		setTestConnStat(b, item.bStat[0], item.bStat[1], item.bStat[2])
+		pc.selectActiveConn()
+		if pc.activeConn != item.expect {
+			t.Errorf("%s: active %v, want %v", item.name,
+				pc.activeConn.getRemoteAddr(), item.expect.getRemoteAddr())
+		}
+	}
+
+	// not ready path is dropped at once
+	b.close()
+	if active := pc.getActiveConn(); active != a {
+		t.Errorf("active after close: %v", active)
+	}
+	pc.removeConnection(a)
+	if active := pc.getActiveConn(); active != c {
+		t.Errorf("active after remove: %v", active)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kAuthMaxFails        = 5  // per account/service from one source ip
+	kAuthMaxFailsIp      = 20 // per source ip, allow NAT
+	kAuthMaxFailsAccount = 20 // per account/service from all ips, then delayed
+	kAuthLockBase        = 2 * 1000
+	kAuthLockMax         = 15 * 60 * 1000
+	kAuthDelayBase       = 500
+	kAuthDelayMax        = 8 * 1000
+	kAuthForget          = 60 * 60 * 1000           // remove idle failures
+	kAuthKnownExpire     = 30 * 24 * 60 * 60 * 1000 // known-good ip of account
+
+	kConnRequestRate  = 20 // requests per second
+	kConnRequestBurst = 40
+)
+
+/**
+ * Brute-force protection of password checks(login, service password)
+ *	a. failures are counted by key(account/service@ip, or source ip),
+ *	   so attackers never lock out the owner from other ips.
+ *	b. locked after max fails, lock time doubled by each more failure
+ *	c. success resets the account@ip key and marks the ip known-good,
+ *	   ip key is only forgot when idle
+ *	d. failures of account from all ips are soft: responses to unknown
+ *	   ips are delayed, doubled by each more failure, never blocked.
+ */
+type AuthFailure struct {
+	Fails     int
+	LockUntil int64 // ms
+	Last      int64 // ms
+}
+
+// guarded by mu, as password is checked by shared-lock actions too
+type AuthGuard struct {
+	mu       sync.Mutex
+	maxFails int
+	failures map[string]*AuthFailure
+	known    map[string]int64 // key => last success(ms)
+}
+
+func NewAuthGuard(maxFails int) *AuthGuard {
+	return &AuthGuard{
+		maxFails: maxFails,
+		failures: make(map[string]*AuthFailure),
+		known:    make(map[string]int64),
+	}
+}
+
+func (g *AuthGuard) IsLocked(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if item, ok := g.failures[key]; ok {
+		return util.NowMs() < item.LockUntil
+	}
+	return false
+}
+
+// delay(ms) after max fails, instead of lock
+func (g *AuthGuard) Delay(key string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	item, ok := g.failures[key]
+	if !ok || item.Fails < g.maxFails {
+		return 0
+	}
+	delay := int64(kAuthDelayMax)
+	if shift := item.Fails - g.maxFails; shift < 20 {
+		if n := int64(kAuthDelayBase) << uint(shift); n < delay {
+			delay = n
+		}
+	}
+	return delay
+}
+
+func (g *AuthGuard) OnFailure(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := util.NowMs()
+	item, ok := g.failures[key]
+	if !ok {
+		item = &AuthFailure{}
+		g.failures[key] = item
+	}
+	item.Fails += 1
+	item.Last = now
+	if item.Fails >= g.maxFails {
+		lock := int64(kAuthLockMax)
+		if shift := item.Fails - g.maxFails; shift < 20 {
+			if n := int64(kAuthLockBase) << uint(shift); n < lock {
+				lock = n
+			}
+		}
+		item.LockUntil = now + lock
+	}
+}
+
+// success of key, reset and mark it known
+func (g *AuthGuard) Reset(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, key)
+	g.known[key] = util.NowMs()
+}
+
+func (g *AuthGuard) IsKnown(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.known[key]
+	return ok
+}
+
+func (g *AuthGuard) Prune() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := util.NowMs()
+	for key, item := range g.failures {
+		if now > item.LockUntil && now-item.Last > kAuthForget {
+			delete(g.failures, key)
+		}
+	}
+	for key, last := range g.known {
+		if now-last > kAuthKnownExpire {
+			delete(g.known, key)
+		}
+	}
+}
+
+// host of remote addr, e.g. "1.2.3.4:5678" => "1.2.3.4"
+func RemoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+/// signal server operations
+
+// check lockout of key(e.g. "peer:id")@ip and source ip before verifying password,
+// and delay the response to unknown ip if key is under attack.
+func (ss *SignalServer) CheckAuthLock(key string, conn *SignalConnection) error {
+	host := conn.RemoteHost()
+	if ss.authGuard.IsLocked(key+"@"+host) || ss.ipGuard.IsLocked(host) {
+		return errTooManyAttempts
+	}
+	if conn != nil && !ss.authGuard.IsKnown(key+"@"+host) {
+		if delay := ss.accountGuard.Delay(key); delay > 0 {
+			conn.authDelay = time.Duration(delay) * time.Millisecond
+		}
+	}
+	return nil
+}
+
+func (ss *SignalServer) OnAuthResult(key string, conn *SignalConnection, ok bool) {
+	host := conn.RemoteHost()
+	if ok {
+		ss.authGuard.Reset(key + "@" + host)
+		return
+	}
+
+	ss.authGuard.OnFailure(key + "@" + host)
+	ss.ipGuard.OnFailure(host)
+	ss.accountGuard.OnFailure(key)
+}
+
+/// signal connection operations
+
+// source ip, empty if no conn
+func (c *SignalConnection) RemoteHost() string {
+	if c == nil {
+		return ""
+	}
+	return RemoteHost(c.RemoteAddr())
+}
+
+// token bucket of requests, only accessed by readPump of connection
+func (c *SignalConnection) AllowRequest() bool {
+	now := util.NowMs()
+	if c.tokenTime == 0 {
+		c.tokens = kConnRequestBurst
+	} else {
+		c.tokens += float64(now-c.tokenTime) * kConnRequestRate / 1000
+		if c.tokens > kConnRequestBurst {
+			c.tokens = kConnRequestBurst
+		}
+	}
+	c.tokenTime = now
+
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens -= 1
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// login by conn from addr, return error code
+func loginTestFrom(t *testing.T, ss *SignalServer, addr, id, pwd string) (*SignalConnection, string) {
+	t.Helper()
+	conn := newTestConn(ss)
+	conn.addr = addr
+	req := NewSignalRequest(id)
+	req.Action = kActionLogin
+	req.Sequence = util.RandomString(8)
+	req.PwdMd5 = util.MD5SumGenerate([]string{pwd})
+	req.conn = conn
+	resp := ss.HandleRequest(req)
+	return conn, resp.ErrorCode
+}
+
+func TestAuthLockPerSourceIp(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestPeer(t, ss, "alice", "")
+
+	for i := 0; i < kAuthMaxFails; i++ {
+		loginTestFrom(t, ss, "6.6.6.6:1000", "alice", "wrong")
+	}
+	if _, code := loginTestFrom(t, ss, "6.6.6.6:1000", "alice", kTestPassword); code != ErrorCode(errTooManyAttempts) {
+		t.Errorf("attacker login: %q, want too-many-attempts", code)
+	}
+
+	// owner from other ip is not locked out
+	if _, code := loginTestFrom(t, ss, "1.1.1.1:1000", "alice", kTestPassword); len(code) > 0 {
+		t.Errorf("owner login: %q", code)
+	}
+}
+
+func TestAuthLockGlobalIp(t *testing.T) {
+	ss := newTestSignalServer()
+	for i := 0; i < kAuthMaxFailsIp; i++ {
+		loginTestFrom(t, ss, "6.6.6.6:1000", fmt.Sprintf("peer%d", i), "wrong")
+	}
+	newTestPeer(t, ss, "bobby", "")
+	if _, code := loginTestFrom(t, ss, "6.6.6.6:1000", "bobby", kTestPassword); code != ErrorCode(errTooManyAttempts) {
+		t.Errorf("login from locked ip: %q, want too-many-attempts", code)
+	}
+}
+
+func TestAuthSoftAccountLock(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestPeer(t, ss, "alice", "")
+
+	// known-good ip of alice
+	if conn, code := loginTestFrom(t, ss, "1.1.1.1:1000", "alice", kTestPassword); len(code) > 0 || conn.authDelay > 0 {
+		t.Fatalf("owner login: %q, delay %v", code, conn.authDelay)
+	}
+
+	// distributed attack, under lock of each ip
+	for i := 0; i < kAuthMaxFailsAccount; i++ {
+		addr := fmt.Sprintf("6.6.6.%d:1000", i%(kAuthMaxFails-1))
+		loginTestFrom(t, ss, addr, "alice", "wrong")
+	}
+
+	// delayed but not blocked from unknown ip
+	conn, code := loginTestFrom(t, ss, "2.2.2.2:1000", "alice", kTestPassword)
+	if len(code) > 0 || conn.authDelay == 0 {
+		t.Errorf("login from new ip: %q, delay %v", code, conn.authDelay)
+	}
+	conn, code = loginTestFrom(t, ss, "1.1.1.1:1000", "alice", kTestPassword)
+	if len(code) > 0 || conn.authDelay > 0 {
+		t.Errorf("login from known ip: %q, delay %v", code, conn.authDelay)
+	}
+}
+
+func TestServiceAuthLockPerSourceIp(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestService(t, ss)
+	mallory := newTestPeer(t, ss, "mallory", "")
+	mallory.addr = "6.6.6.6:1000"
+	carol := newTestPeer(t, ss, "carol", "")
+	carol.addr = "1.1.1.1:1000"
+
+	join := func(conn *SignalConnection, id, pwd string) string {
+		req := NewSignalRequest(id)
+		req.ServiceName = "svc"
+		req.ServicePwdMd5 = util.MD5SumGenerate([]string{pwd})
+		return doTestRequest(t, conn, kActionJoinService, req).ErrorCode
+	}
+	for i := 0; i < kAuthMaxFails; i++ {
+		join(mallory, "mallory", "wrong")
+	}
+	if code := join(mallory, "mallory", kTestPassword); code != ErrorCode(errTooManyAttempts) {
+		t.Errorf("join by attacker: %q, want too-many-attempts", code)
+	}
+	if code := join(carol, "carol", kTestPassword); len(code) > 0 {
+		t.Errorf("join from other ip: %q", code)
+	}
+}
+
+// unknown id is same as wrong password, never probed
+func TestLoginUnknownId(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestPeer(t, ss, "alice", "")
+
+	_, wrong := loginTestFrom(t, ss, "6.6.6.6:1000", "alice", "wrong")
+	_, unknown := loginTestFrom(t, ss, "6.6.6.6:1001", "nobody", "wrong")
+	if wrong != ErrorCode(errWrongPassword) || unknown != wrong {
+		t.Errorf("login errors: wrong password %q, unknown id %q", wrong, unknown)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	kRedisDialTimeout = 3 * time.Second
+	kRedisRetryWait   = time.Second
+	kRedisMaxBulk     = 64 * 1024 * 1024
+
+	// KEYS[1]: version, KEYS[2]: data
+	kRedisSaveScript = `redis.call('SET', KEYS[2], ARGV[1]) return redis.call('INCR', KEYS[1])`
+	kRedisCasScript  = `if (tonumber(redis.call('GET', KEYS[1])) or 0) ~= tonumber(ARGV[1]) then return 0 end
+redis.call('SET', KEYS[2], ARGV[2]) redis.call('INCR', KEYS[1]) return 1`
+)
+
+/**
+ * Redis backend of cluster, shared by signal servers of processes
+ *	a. store: db and its version in two keys, saved by lua script,
+ *	   compare-and-save is atomic in redis
+ *	b. bus: pub/sub by channels of "<prefix>.<topic>", one subscribing
+ *	   conn per topic, resubscribed after reconnected.
+ *	   messages are lost when disconnected, and db is reloaded by version.
+ *	c. only RESP2 commands used by cluster, no extra dependency
+ */
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(addr string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kRedisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// one command of bulk strings
+func (c *redisConn) send(args ...[]byte) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// one reply: string/[]byte/int64/[]interface{}, nil if null, error if redis error
+func (c *redisConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > kRedisMaxBulk {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, errRedisProtocol
+	}
+}
+
+// error reply of redis, conn is still valid
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func bulkArgs(args ...string) [][]byte {
+	items := make([][]byte, len(args))
+	for i, arg := range args {
+		items[i] = []byte(arg)
+	}
+	return items
+}
+
+/**
+ * Redis client of request-reply, reconnected on error
+ */
+type RedisClient struct {
+	addr string
+	mu   sync.Mutex
+	conn *redisConn
+}
+
+func NewRedisClient(addr string) *RedisClient {
+	return &RedisClient{addr: addr}
+}
+
+func (rc *RedisClient) Do(args ...[]byte) (interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.conn == nil {
+		conn, err := dialRedis(rc.addr)
+		if err != nil {
+			return nil, err
+		}
+		rc.conn = conn
+	}
+	err := rc.conn.send(args...)
+	if err == nil {
+		var reply interface{}
+		reply, err = rc.conn.receive()
+		if _, ok := err.(redisError); err == nil || ok {
+			return reply, err
+		}
+	}
+	// broken conn, dial again by next
+	rc.conn.Close()
+	rc.conn = nil
+	return nil, err
+}
+
+func (rc *RedisClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.conn != nil {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+	return nil
+}
+
+/**
+ * Redis store, SignalSharedStore of cluster
+ */
+type RedisStore struct {
+	client     *RedisClient
+	keyData    string
+	keyVersion string
+}
+
+func NewRedisStore(client *RedisClient, prefix string) *RedisStore {
+	return &RedisStore{
+		client:     client,
+		keyData:    prefix + ".db",
+		keyVersion: prefix + ".version",
+	}
+}
+
+func (rs *RedisStore) Load() ([]byte, error) {
+	reply, err := rs.client.Do(bulkArgs("GET", rs.keyData)...)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := reply.([]byte); ok {
+		return data, nil
+	}
+	return nil, errors.New("empty store")
+}
+
+func (rs *RedisStore) Save(data []byte) error {
+	args := append(bulkArgs("EVAL", kRedisSaveScript, "2", rs.keyVersion, rs.keyData), data)
+	_, err := rs.client.Do(args...)
+	return err
+}
+
+func (rs *RedisStore) Version() (uint64, error) {
+	reply, err := rs.client.Do(bulkArgs("GET", rs.keyVersion)...)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	if data, ok := reply.([]byte); ok {
+		return strconv.ParseUint(string(data), 10, 64)
+	}
+	return 0, errRedisProtocol
+}
+
+func (rs *RedisStore) CompareAndSave(version uint64, data []byte) error {
+	args := bulkArgs("EVAL", kRedisCasScript, "2", rs.keyVersion, rs.keyData, fmt.Sprint(version))
+	reply, err := rs.client.Do(append(args, data)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n != 1 {
+		return errStoreConflict
+	}
+	return nil
+}
+
+/**
+ * Redis bus, SignalBus of cluster
+ */
+type RedisBus struct {
+	addr   string
+	prefix string
+	pub    *RedisClient
+
+	mu     sync.Mutex
+	subs   []*redisConn
+	closed bool
+}
+
+func NewRedisBus(addr, prefix string) *RedisBus {
+	return &RedisBus{addr: addr, prefix: prefix, pub: NewRedisClient(addr)}
+}
+
+func (b *RedisBus) channel(topic string) string {
+	return b.prefix + "." + topic
+}
+
+func (b *RedisBus) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *RedisBus) Publish(topic string, data []byte) error {
+	if b.isClosed() {
+		return errClusterClosed
+	}
+	args := append(bulkArgs("PUBLISH", b.channel(topic)), data)
+	_, err := b.pub.Do(args...)
+	return err
+}
+
+// messages are delivered in order by one goroutine
+func (b *RedisBus) Subscribe(topic string, fn func(data []byte)) error {
+	conn, err := b.subscribe(topic)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			b.receive(conn, fn)
+			b.removeSub(conn)
+			for {
+				if b.isClosed() {
+					return
+				}
+				time.Sleep(kRedisRetryWait)
+				if conn, err = b.subscribe(topic); err == nil {
+					break
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBus) subscribe(topic string) (*redisConn, error) {
+	conn, err := dialRedis(b.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.send(bulkArgs("SUBSCRIBE", b.channel(topic))...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return nil, errClusterClosed
+	}
+	b.subs = append(b.subs, conn)
+	return conn, nil
+}
+
+// until conn broken or closed
+func (b *RedisBus) receive(conn *redisConn, fn func(data []byte)) {
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return
+		}
+		// ["message", channel, data], others are confirmations
+		if items, ok := reply.([]interface{}); ok && len(items) == 3 {
+			kind, _ := items[0].([]byte)
+			data, _ := items[2].([]byte)
+			if string(kind) == "message" && data != nil {
+				fn(data)
+			}
+		}
+	}
+}
+
+func (b *RedisBus) removeSub(conn *redisConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn.Close()
+	for i, item := range b.subs {
+		if item == conn {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *RedisBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, conn := range b.subs {
+		conn.Close()
+	}
+	b.subs = nil
+	return b.pub.Close()
+}
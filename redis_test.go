@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// in-process redis of commands used by cluster, scripts are known
+type testRedis struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+	subs map[string][]*redisConn // channel => ..
+}
+
+func startTestRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	tr := &testRedis{keys: make(map[string][]byte), subs: make(map[string][]*redisConn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go tr.serve(&redisConn{conn: conn, r: bufio.NewReader(conn)})
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (tr *testRedis) serve(c *redisConn) {
+	for {
+		reply, err := c.receive()
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, item := range items {
+			data, _ := item.([]byte)
+			args = append(args, string(data))
+		}
+		if len(args) == 0 {
+			return
+		}
+		tr.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if data, ok := tr.keys[args[1]]; ok {
+				writeTestBulk(c, data)
+			} else {
+				c.conn.Write([]byte("$-1\r\n"))
+			}
+		case "EVAL":
+			version, _ := strconv.ParseUint(string(tr.keys[args[3]]), 10, 64)
+			if args[1] == kRedisCasScript && args[5] != fmt.Sprint(version) {
+				c.conn.Write([]byte(":0\r\n"))
+				break
+			}
+			tr.keys[args[4]] = []byte(args[len(args)-1])
+			tr.keys[args[3]] = []byte(fmt.Sprint(version + 1))
+			fmt.Fprintf(c.conn, ":%d\r\n", 1)
+		case "PUBLISH":
+			for _, sub := range tr.subs[args[1]] {
+				sub.conn.Write([]byte("*3\r\n"))
+				writeTestBulk(sub, []byte("message"))
+				writeTestBulk(sub, []byte(args[1]))
+				writeTestBulk(sub, []byte(args[2]))
+			}
+			fmt.Fprintf(c.conn, ":%d\r\n", len(tr.subs[args[1]]))
+		case "SUBSCRIBE":
+			tr.subs[args[1]] = append(tr.subs[args[1]], c)
+			c.conn.Write([]byte("*3\r\n"))
+			writeTestBulk(c, []byte("subscribe"))
+			writeTestBulk(c, []byte(args[1]))
+			c.conn.Write([]byte(":1\r\n"))
+		default:
+			fmt.Fprintf(c.conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		tr.mu.Unlock()
+	}
+}
+
+func writeTestBulk(c *redisConn, data []byte) {
+	fmt.Fprintf(c.conn, "$%d\r\n", len(data))
+	c.conn.Write(append(data, "\r\n"...))
+}
+
+// real redis by NETPIE_TEST_REDIS, else in-process
+func getTestRedisAddr(t *testing.T) string {
+	if addr := os.Getenv("NETPIE_TEST_REDIS"); len(addr) > 0 {
+		return addr
+	}
+	return startTestRedis(t)
+}
+
+func TestRedisReply(t *testing.T) {
+	data := "+OK\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n-ERR bad\r\n"
+	c := &redisConn{r: bufio.NewReader(strings.NewReader(data))}
+	expects := []string{"OK", "42", "[104 101 13 10 111]", "<nil>", "[[97] 1]"}
+	for i, expect := range expects {
+		reply, err := c.receive()
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if got := fmt.Sprint(reply); got != expect {
+			t.Errorf("reply %d: %s, want %s", i, got, expect)
+		}
+	}
+	if _, err := c.receive(); err != redisError("ERR bad") {
+		t.Errorf("error reply: %v", err)
+	}
+}
+
+func TestRedisStoreCompareAndSave(t *testing.T) {
+	prefix := "netpie-test-" + strconv.Itoa(os.Getpid())
+	rs := NewRedisStore(NewRedisClient(getTestRedisAddr(t)), prefix)
+	version, err := rs.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CompareAndSave(version, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CompareAndSave(version, []byte("b")); err != errStoreConflict {
+		t.Fatalf("stale save: %v, want conflict", err)
+	}
+	if data, _ := rs.Load(); string(data) != "a" {
+		t.Fatalf("data: %q, want a", data)
+	}
+	if next, _ := rs.Version(); next != version+1 {
+		t.Fatalf("version: %d, want %d", next, version+1)
+	}
+}
+
+// nodes of separate redis conns, as of processes
+func TestRedisClusterConcurrentRegister(t *testing.T) {
+	addr := getTestRedisAddr(t)
+	prefix := "netpie-test-cluster-" + strconv.Itoa(os.Getpid())
+	nodes := newTestClusterOf(t, 2, func(i int) (SignalSharedStore, SignalBus) {
+		return NewRedisStore(NewRedisClient(addr), prefix), NewRedisBus(addr, prefix)
+	})
+	testClusterRegister(t, nodes)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kDtlsSetupActpass = "actpass"
+	kDtlsSetupActive  = "active"
+	kDtlsSetupPassive = "passive"
+)
+
+var kDtlsHashAlgorithms = map[string]int{
+	"sha-1":   20,
+	"sha-224": 28,
+	"sha-256": 32,
+	"sha-384": 48,
+	"sha-512": 64,
+}
+
+const (
+	kSdpDefaultMid        = "0"
+	kSdpDefaultSctpPort   = 5000
+	kSdpMaxMessageSize    = 256 * 1024
+	kSdpApplicationFormat = "webrtc-datachannel"
+)
+
+/**
+ * Sdp info of one data-channel session(m=application)
+ */
+type SdpInfo struct {
+	IceUfrag    string
+	IcePwd      string
+	Fingerprint string // e.g. "sha-256 AB:CD:.."
+	Setup       string // actpass/active/passive
+	Mid         string
+	SctpPort    int
+	Candidates  []string
+}
+
+func ParseSdp(sdp string) *SdpInfo {
+	info := &SdpInfo{
+		Mid:      kSdpDefaultMid,
+		SctpPort: kSdpDefaultSctpPort,
+	}
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=") {
+			continue
+		}
+
+		key, value := line[2:], ""
+		if idx := strings.Index(key, ":"); idx >= 0 {
+			key, value = key[:idx], key[idx+1:]
+		}
+		switch key {
+		case "ice-ufrag":
+			info.IceUfrag = value
+		case "ice-pwd":
+			info.IcePwd = value
+		case "fingerprint":
+			info.Fingerprint = value
+		case "setup":
+			info.Setup = value
+		case "mid":
+			info.Mid = value
+		case "sctp-port":
+			if port, err := strconv.Atoi(value); err == nil {
+				info.SctpPort = port
+			}
+		case "candidate":
+			info.Candidates = append(info.Candidates, value)
+		}
+	}
+	return info
+}
+
+func (info *SdpInfo) Check() error {
+	if len(info.IceUfrag) == 0 || len(info.IcePwd) == 0 {
+		return errSdpInvalid("no ice ufrag/pwd")
+	}
+	return CheckDtlsFingerprint(info.Fingerprint)
+}
+
+// offer could be actpass/active/passive, answer must be active/passive(RFC 5763)
+func (info *SdpInfo) CheckSetup(isOffer bool) error {
+	switch info.Setup {
+	case kDtlsSetupActive, kDtlsSetupPassive:
+		return nil
+	case kDtlsSetupActpass, "":
+		if isOffer {
+			return nil
+		}
+	}
+	return errSdpInvalid("invalid dtls setup: " + info.Setup)
+}
+
+// fingerprint: "sha-256 AB:CD:..", hash algorithm and hex length must match
+func CheckDtlsFingerprint(fingerprint string) error {
+	items := strings.Fields(fingerprint)
+	if len(items) != 2 {
+		return errSdpInvalid("invalid dtls fingerprint")
+	}
+	size, ok := kDtlsHashAlgorithms[strings.ToLower(items[0])]
+	if !ok {
+		return errSdpInvalid("unsupported dtls hash: " + items[0])
+	}
+	bytes := strings.Split(items[1], ":")
+	if len(bytes) != size {
+		return errSdpInvalid("invalid dtls fingerprint length")
+	}
+	for _, b := range bytes {
+		if _, err := strconv.ParseUint(b, 16, 8); err != nil || len(b) != 2 {
+			return errSdpInvalid("invalid dtls fingerprint value")
+		}
+	}
+	return nil
+}
+
+// setup role of answerer by offerer's role
+func NegotiateDtlsSetup(offerSetup string) string {
+	if offerSetup == kDtlsSetupPassive {
+		return kDtlsSetupActive
+	}
+	return kDtlsSetupPassive
+}
+
+// answer for data-channel offer, local is ice-lite with host candidates
+func BuildAnswerSdp(offer, local *SdpInfo) string {
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 2 IN IP4 127.0.0.1", util.NowMs()),
+		"s=-",
+		"t=0 0",
+		"a=ice-lite",
+		fmt.Sprintf("a=group:BUNDLE %s", offer.Mid),
+		fmt.Sprintf("m=application 9 UDP/DTLS/SCTP %s", kSdpApplicationFormat),
+		"c=IN IP4 0.0.0.0",
+	}
+	for _, candidate := range local.Candidates {
+		lines = append(lines, "a=candidate:"+candidate)
+	}
+	lines = append(lines,
+		"a=end-of-candidates",
+		"a=ice-ufrag:"+local.IceUfrag,
+		"a=ice-pwd:"+local.IcePwd,
+		"a=fingerprint:"+local.Fingerprint,
+		"a=setup:"+local.Setup,
+		"a=mid:"+offer.Mid,
+		fmt.Sprintf("a=sctp-port:%d", local.SctpPort),
+		fmt.Sprintf("a=max-message-size:%d", kSdpMaxMessageSize),
+	)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// host candidate, e.g. "1 1 udp 2130706431 1.2.3.4 9530 typ host"
+func BuildHostCandidate(foundation int, proto, ip string, port int) string {
+	priority := 2130706431
+	return fmt.Sprintf("%d 1 %s %d %s %d typ host", foundation, proto, priority, ip, port)
+}
+
+// passive ice-tcp candidate(RFC 6544), lower priority than udp,
+// e.g. "2 1 tcp 1518280447 1.2.3.4 9530 typ host tcptype passive"
+func BuildTcpCandidate(foundation int, ip string, port int) string {
+	priority := 1518280447
+	return fmt.Sprintf("%d 1 tcp %d %s %d typ host tcptype passive", foundation, priority, ip, port)
+}
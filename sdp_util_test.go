@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestFingerprint(hash string, size int) string {
+	bytes := make([]string, size)
+	for i := range bytes {
+		bytes[i] = "AB"
+	}
+	return hash + " " + strings.Join(bytes, ":")
+}
+
+// offer of browser => answer of gateway => parsed again
+func TestSdpAnswerRoundTrip(t *testing.T) {
+	offerFingerprint := newTestFingerprint("sha-256", 32)
+	offerSdp := strings.Join([]string{
+		"v=0",
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"a=group:BUNDLE data",
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel",
+		"c=IN IP4 0.0.0.0",
+		"a=ice-ufrag:offerUfrag",
+		"a=ice-pwd:offerPassword0123456789",
+		"a=fingerprint:" + offerFingerprint,
+		"a=setup:actpass",
+		"a=mid:data",
+		"a=sctp-port:5000",
+	}, "\r\n") + "\r\n"
+
+	offer := ParseSdp(offerSdp)
+	if err := offer.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := offer.CheckSetup(true); err != nil {
+		t.Fatal(err)
+	}
+	if offer.Fingerprint != offerFingerprint || offer.Setup != kDtlsSetupActpass || offer.Mid != "data" {
+		t.Fatalf("offer: %+v", offer)
+	}
+
+	local := &SdpInfo{
+		IceUfrag:    "localUfrag",
+		IcePwd:      "localPassword0123456789",
+		Fingerprint: newTestFingerprint("sha-256", 32),
+		Setup:       NegotiateDtlsSetup(offer.Setup),
+		SctpPort:    kSdpDefaultSctpPort,
+		Candidates: []string{
+			BuildHostCandidate(1, "udp", "1.2.3.4", 9530),
+			BuildTcpCandidate(2, "1.2.3.4", 9530),
+		},
+	}
+	answer := ParseSdp(BuildAnswerSdp(offer, local))
+	if err := answer.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := answer.CheckSetup(false); err != nil {
+		t.Fatal(err)
+	}
+	local.Mid = offer.Mid
+	if !reflect.DeepEqual(answer, local) {
+		t.Errorf("answer: %+v, want %+v", answer, local)
+	}
+}
+
+func TestDtlsSetup(t *testing.T) {
+	cases := map[string]string{
+		kDtlsSetupActpass: kDtlsSetupPassive,
+		kDtlsSetupActive:  kDtlsSetupPassive,
+		kDtlsSetupPassive: kDtlsSetupActive,
+		"":                kDtlsSetupPassive,
+	}
+	for offer, expect := range cases {
+		if setup := NegotiateDtlsSetup(offer); setup != expect {
+			t.Errorf("answer setup of %q: %s, want %s", offer, setup, expect)
+		}
+	}
+
+	for _, setup := range []string{kDtlsSetupActpass, "", "holdconn"} {
+		if err := (&SdpInfo{Setup: setup}).CheckSetup(false); err == nil {
+			t.Errorf("answer setup %q accepted", setup)
+		}
+	}
+	if err := (&SdpInfo{Setup: "holdconn"}).CheckSetup(true); err == nil {
+		t.Error("offer setup holdconn accepted")
+	}
+}
+
+func TestDtlsFingerprint(t *testing.T) {
+	valid := []string{
+		newTestFingerprint("sha-1", 20),
+		newTestFingerprint("SHA-256", 32),
+		newTestFingerprint("sha-512", 64),
+	}
+	for _, item := range valid {
+		if err := CheckDtlsFingerprint(item); err != nil {
+			t.Errorf("%s: %v", item, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		newTestFingerprint("md5", 16),
+		newTestFingerprint("sha-1", 32),
+		newTestFingerprint("sha-256", 32)[:len("sha-256 AB:")] + "XY",
+		strings.Replace(newTestFingerprint("sha-256", 32), "AB", "ABC", 1),
+		newTestFingerprint("sha-256", 32) + " extra",
+	}
+	for _, item := range invalid {
+		if err := CheckDtlsFingerprint(item); err == nil {
+			t.Errorf("%q accepted", item)
+		}
+	}
+}
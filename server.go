@@ -36,10 +36,33 @@ func (s *Server) PostRunSignal(params []string, err error) {
 			s.ep.CheckEnableLocalService("enable", params[1])
 		case "disable-service":
 			s.ep.CheckEnableLocalService("disable", params[1])
+		case "kick-member":
+			s.ep.CheckOpenLocalService("ev_close", params[1], params[3])
+		case "rotate-service-password":
+			if params[4] == "yes" {
+				s.ep.CloseServiceTunnels(params[1])
+			}
 		}
 	}
 }
 
+// run webrtc gateway on udp port(and passive ice-tcp), ip is advertised in answer
+func (s *Server) EnableGateway(ip string, port int, tcp bool) error {
+	tcpPort := 0
+	if tcp {
+		tcpPort = port
+	}
+	if err := defaultGateway.Init(ip, port, tcpPort); err != nil {
+		return err
+	}
+	go startUdpService(port, 0)
+	if tcpPort > 0 {
+		go startTcpService(tcpPort, 0)
+	}
+	s.ep.gateway = defaultGateway
+	return nil
+}
+
 func (s *Server) StartShell() {
 	s.ep.StartShell("server")
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	kDefaultDrainTimeout = 10 * time.Second
+	kShutdownReconnectMs = 5 * 1000 // reconnect hint to clients
+	kShutdownPollMs      = 200
+)
+
+/**
+ * Graceful shutdown of signal server
+ *	a. stop accepting new websocket upgrades(listener closed, /ws rejected)
+ *	b. server-shutdown event to all clients, with reconnect hint(ms)
+ *	c. wait clients to leave until deadline, then close with going-away
+ *	d. stop Run loop and flush storage atomically
+ */
+func (ss *SignalServer) IsDraining() bool {
+	return atomic.LoadInt32(&ss.draining) == 1
+}
+
+func (ss *SignalServer) Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&ss.draining, 0, 1) {
+		return
+	}
+	ss.Println("shutdown begin, timeout:", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// hijacked websockets are not tracked by http.Server
+	if ss.httpServer != nil {
+		ss.httpServer.Shutdown(ctx)
+	}
+
+	ss.Query(func() {
+		ss.NotifyShutdown(timeout)
+	})
+
+	// draining
+	for {
+		count := -1 // unknown if query timeout
+		ss.Query(func() {
+			count = len(ss.connections) + len(ss.onlines)
+		})
+		if count == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			ss.Println("shutdown deadline, left connections:", count)
+			ss.Query(ss.CloseConnections)
+			time.Sleep(kShutdownPollMs * time.Millisecond)
+		case <-time.After(kShutdownPollMs * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	ss.StopRun()
+	ss.Println("shutdown end")
+}
+
+// wait SIGINT/SIGTERM and shutdown
+func (ss *SignalServer) ShutdownOnSignal(timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	ss.Println("exit by signal")
+	ss.Shutdown(timeout)
+}
+
+func (ss *SignalServer) NotifyShutdown(timeout time.Duration) {
+	var conns []*SignalConnection
+	for conn := range ss.connections {
+		conns = append(conns, conn)
+	}
+	for _, conn := range ss.onlines {
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns {
+		ev := NewSignalResponse("")
+		ev.Event = kActionEventServerShutdown
+		ev.ResultM["reconnect-ms"] = fmt.Sprint(kShutdownReconnectMs)
+		ev.ResultM["deadline-ms"] = fmt.Sprint(timeout.Milliseconds())
+		conn.Send(ev)
+	}
+}
+
+// close remaining, readPump will remove them
+func (ss *SignalServer) CloseConnections() {
+	for conn := range ss.connections {
+		conn.CloseGoingAway()
+	}
+	for _, conn := range ss.onlines {
+		conn.CloseGoingAway()
+	}
+}
+
+/// signal connection operations
+
+func (c *SignalConnection) CloseGoingAway() {
+	if c.conn != nil {
+		data := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+		c.conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(writeWait))
+		c.conn.Close()
+	}
+}
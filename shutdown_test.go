@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeErrorStopsRun(t *testing.T) {
+	ss := newTestSignalServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	ch_served := make(chan bool)
+	go func() {
+		ss.Serve(ln)
+		close(ch_served)
+	}()
+	select {
+	case <-ch_served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve not returned on closed listener")
+	}
+	select {
+	case <-ss.ch_stopped:
+	default:
+		t.Fatal("Run not stopped after Serve error")
+	}
+
+	// Run stopped already
+	ch_shutdown := make(chan bool)
+	go func() {
+		ss.Shutdown(time.Second)
+		close(ch_shutdown)
+	}()
+	select {
+	case <-ch_shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked after Run stopped")
+	}
+}
+
+func TestShutdownNotifyClients(t *testing.T) {
+	ss := newTestSignalServer()
+	go ss.Run()
+	conn := newTestConn(ss)
+
+	go func() {
+		// client leaves on event
+		for resp := range conn.ch_send {
+			if resp.Event == kActionEventServerShutdown {
+				ss.RemoveConnection(conn)
+			}
+		}
+	}()
+	ss.Shutdown(2 * time.Second)
+
+	select {
+	case <-ss.ch_stopped:
+	default:
+		t.Fatal("Run not stopped by Shutdown")
+	}
+	if !ss.IsDraining() {
+		t.Error("not draining after shutdown")
+	}
+}
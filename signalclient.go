@@ -1,10 +1,12 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	util "github.com/PeterXu/goutil"
@@ -20,9 +22,9 @@ func NewSignalClient() *SignalClient {
 	client := &SignalClient{
 		EvObject: NewEvObject(),
 		ch_send:  make(chan *SignalRequest, 3),
-		ch_exit:  make(chan error),
 		pending:  make(map[string]*SignalRequest),
 		actions:  make(map[string]fnSignalClientAction),
+		services: make(map[string]string),
 	}
 
 	client.TAG = "sigclient"
@@ -33,6 +35,21 @@ func NewSignalClient() *SignalClient {
 	client.actions[kActionRegister] = client.Register
 	client.actions[kActionLogin] = client.Login
 	client.actions[kActionLogout] = client.Logout
+	client.actions[kActionChangePassword] = client.ChangePassword
+	client.actions[kActionDeleteAccount] = client.DeleteAccount
+	client.actions[kActionSetProfile] = client.SetProfile
+	client.actions[kActionInfo] = client.AccountInfo
+
+	client.actions[kActionPeers] = client.ControlAdmin
+	client.actions[kActionDisablePeer] = client.ControlAdmin
+	client.actions[kActionEnablePeer] = client.ControlAdmin
+	client.actions[kActionForceDisconnect] = client.ControlAdmin
+	client.actions[kActionSetRole] = client.ControlAdmin
+	client.actions[kActionForceRemoveService] = client.ControlAdmin
+	client.actions[kActionSetRegisterMode] = client.ControlAdmin
+	client.actions[kActionCreateRegisterInvite] = client.ControlAdmin
+	client.actions[kActionCreateAccount] = client.ControlAdmin
+	client.actions[kActionAudit] = client.QueryAudit
 
 	client.actions[kActionServices] = client.GoCheckService0
 	client.actions[kActionMyServices] = client.GoCheckService0
@@ -47,6 +64,17 @@ func NewSignalClient() *SignalClient {
 	client.actions[kActionRemoveService] = client.GoCheckService2
 	client.actions[kActionEnableService] = client.GoCheckService2
 	client.actions[kActionDisableService] = client.GoCheckService2
+	client.actions[kActionRotateServicePassword] = client.RotateServicePassword
+	client.actions[kActionKickMember] = client.KickMember
+
+	client.actions[kActionAllowPeer] = client.ControlServiceAcl
+	client.actions[kActionDenyPeer] = client.ControlServiceAcl
+	client.actions[kActionResetPeer] = client.ControlServiceAcl
+	client.actions[kActionAcceptJoin] = client.ControlServiceAcl
+	client.actions[kActionRejectJoin] = client.ControlServiceAcl
+	client.actions[kActionSetServiceApproval] = client.ControlServiceAcl
+	client.actions[kActionCreateInvite] = client.ControlServiceAcl
+	client.actions[kActionShowServiceAcl] = client.ControlServiceAcl
 
 	return client
 }
@@ -57,29 +85,60 @@ type SignalClient struct {
 
 	id      string
 	ch_send chan *SignalRequest
-	ch_exit chan error
 
+	pmu     sync.Mutex // pending is accessed by read goroutine
 	pending map[string]*SignalRequest
 	actions map[string]fnSignalClientAction
 
+	// network/online are written by run goroutine and read by callers
+	smu     sync.Mutex
 	network NetworkStatus
 	online  bool
+	ch_stop chan struct{} // of current Start, closed by Close
+
 	sigaddr string
+	retryMs int64 // atomic, reconnect hint of server-shutdown
+
+	// credentials for re-login after failover, cleared by logout/disconnect
+	cmu      sync.Mutex
+	pwdMd5   string
+	services map[string]string // connected services, value: pwd md5
 }
 
 func (sc *SignalClient) Start() {
+	ch_stop := make(chan struct{})
+	sc.smu.Lock()
+	sc.ch_stop = ch_stop
+	sc.smu.Unlock()
+
 	go func() {
 		defer func() {
-			sc.network = kNetworkDisconnected
+			// not changed if started again
+			sc.smu.Lock()
+			if sc.ch_stop == nil || sc.ch_stop == ch_stop {
+				sc.network = kNetworkDisconnected
+			}
+			sc.smu.Unlock()
 		}()
 
-		for {
-			addr := sc.sigaddr
+		// fail over between addresses, e.g. "host1:9527,host2:9527"
+		for index := 0; ; index++ {
+			addrs := strings.Split(sc.sigaddr, ",")
+			addr := strings.TrimSpace(addrs[index%len(addrs)])
 			sc.Println("client connecting to ", addr)
-			sc.network = kNetworkConnecting
-			if err := sc.Run(addr); err != nil {
+			sc.SetNetwork(kNetworkConnecting)
+			if err := sc.run(addr, ch_stop); err != nil {
 				sc.Println("client error and reconnect for err:", err)
-				time.Sleep(3 * time.Second)
+				delay := 3 * time.Second
+				if ms := atomic.SwapInt64(&sc.retryMs, 0); ms > 0 {
+					delay = time.Duration(ms) * time.Millisecond
+				}
+				select {
+				case <-time.After(delay):
+				case <-ch_stop:
+					sc.Println("client exit when retrying")
+					return
+				}
 			} else {
 				sc.Println("client exit")
 				return
@@ -88,7 +147,8 @@ func (sc *SignalClient) Start() {
 	}()
 }
 
-func (sc *SignalClient) Run(addr string) error {
+// until connection failed(error) or stopped(nil)
+func (sc *SignalClient) run(addr string, ch_stop chan struct{}) error {
 	u := url.URL{Scheme: "ws", Host: addr, Path: "/ws"}
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
@@ -96,21 +156,22 @@ func (sc *SignalClient) Run(addr string) error {
 	}
 
 	sc.Println("run, connecting success")
-	sc.network = kNetworkConnected
+	sc.SetNetwork(kNetworkConnected)
 	ticker := time.NewTicker(30 * time.Second)
 
 	defer func() {
-		sc.online = false
+		sc.SetOnline(false)
 		c.Close()
 		ticker.Stop()
 	}()
 
-	// read
+	// read, error of this connection only, never blocks after Run returned
+	ch_read := make(chan error, 1)
 	go func() {
 		for {
 			if _, data, err := c.ReadMessage(); err != nil {
 				sc.Println("run, read fail:", err)
-				sc.ch_exit <- err
+				ch_read <- err
 				return
 			} else {
 				//sc.Println("run, read len:", len(data))
@@ -121,16 +182,22 @@ func (sc *SignalClient) Run(addr string) error {
 					sequence := resp.Sequence
 					if len(resp.Event) == 0 {
 						// this is request-response
-						if item, ok := sc.pending[sequence]; ok {
+						sc.pmu.Lock()
+						item, ok := sc.pending[sequence]
+						delete(sc.pending, sequence)
+						sc.pmu.Unlock()
+						if ok {
 							sc.Println("run, read response for seq:", sequence)
 							item.ch_resp <- resp
-							delete(sc.pending, sequence)
 						} else {
 							sc.Println("run, read not found seq:", sequence)
 						}
 					} else {
 						// this is server event
 						sc.Println("run, read event resp:", resp)
+						if resp.Event == kActionEventServerShutdown {
+							atomic.StoreInt64(&sc.retryMs, util.Atoi64(resp.ResultM["reconnect-ms"]))
+						}
 						sc.FireEvent(resp.Event, evData{"data": resp})
 					}
 				}
@@ -145,6 +212,11 @@ func (sc *SignalClient) Run(addr string) error {
 		<-sc.ch_send
 	}
 
+	// session lost by failover
+	if sc.HasCredentials() {
+		go sc.Relogin()
+	}
+
 	// write
 	for {
 		select {
@@ -152,19 +224,25 @@ func (sc *SignalClient) Run(addr string) error {
 			if buf, err := util.GobEncode(req); err != nil {
 				sc.Printf("run, encode fail: %v\n", err)
 			} else {
+				// pending before write, response may arrive at once
+				if req.ch_resp != nil {
+					sc.pmu.Lock()
+					sc.pending[req.Sequence] = req
+					sc.pmu.Unlock()
+				}
 				if err := c.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
 					sc.Printf("run, write fail: %v\n", err)
 					return err
 				}
-				if req.ch_resp != nil {
-					sc.pending[req.Sequence] = req
-				}
 			}
-		case err := <-sc.ch_exit:
+		case err := <-ch_read:
 			return err
+		case <-ch_stop:
+			return nil
 		case <-ticker.C:
 			var seqs []string
 			nowTime := util.NowMs()
+			sc.pmu.Lock()
 			for k, v := range sc.pending {
 				if nowTime > v.ctime+5*1000 {
 					seqs = append(seqs, k)
@@ -173,23 +251,96 @@ func (sc *SignalClient) Run(addr string) error {
 			for _, s := range seqs {
 				delete(sc.pending, s)
 			}
+			sc.pmu.Unlock()
 		}
 	}
 }
 
+// stop connection or retrying of Start, never blocks
 func (sc *SignalClient) Close() {
 	sc.Println("client close")
-	sc.ch_exit <- nil
+	sc.smu.Lock()
+	defer sc.smu.Unlock()
+	if sc.ch_stop != nil {
+		close(sc.ch_stop)
+		sc.ch_stop = nil
+	}
+}
+
+func (sc *SignalClient) Network() NetworkStatus {
+	sc.smu.Lock()
+	defer sc.smu.Unlock()
+	return sc.network
+}
+
+func (sc *SignalClient) SetNetwork(network NetworkStatus) {
+	sc.smu.Lock()
+	defer sc.smu.Unlock()
+	sc.network = network
+}
+
+func (sc *SignalClient) IsOnline() bool {
+	sc.smu.Lock()
+	defer sc.smu.Unlock()
+	return sc.online
+}
+
+func (sc *SignalClient) SetOnline(online bool) {
+	sc.smu.Lock()
+	defer sc.smu.Unlock()
+	sc.online = online
+}
+
+func (sc *SignalClient) HasCredentials() bool {
+	sc.cmu.Lock()
+	defer sc.cmu.Unlock()
+	return len(sc.pwdMd5) > 0
+}
+
+func (sc *SignalClient) ClearCredentials() {
+	sc.cmu.Lock()
+	defer sc.cmu.Unlock()
+	sc.pwdMd5 = ""
+	sc.services = make(map[string]string)
+}
+
+// login with cached credentials and connect services again
+func (sc *SignalClient) Relogin() error {
+	sc.cmu.Lock()
+	req := NewSignalRequest(sc.id)
+	req.PwdMd5 = sc.pwdMd5
+	services := make(map[string]string)
+	for name, pwdMd5 := range sc.services {
+		services[name] = pwdMd5
+	}
+	sc.cmu.Unlock()
+
+	if _, err := sc.SendRequest(kActionLogin, req); err != nil {
+		sc.Println("relogin fail:", req.FromId, err)
+		return err
+	}
+	sc.SetOnline(true)
+	sc.Println("relogin success:", req.FromId)
+
+	for name, pwdMd5 := range services {
+		req := NewSignalRequest(sc.id)
+		req.ServiceName = name
+		req.ServicePwdMd5 = pwdMd5
+		if _, err := sc.SendRequest(kActionConnectService, req); err != nil {
+			sc.Println("relogin, connect service fail:", name, err)
+		}
+	}
+	return nil
 }
 
 func (sc *SignalClient) CheckOnline(expectOnline bool) error {
-	if sc.network != kNetworkConnected {
+	if sc.Network() != kNetworkConnected {
 		return errNetworkNotConnected
 	}
-	if sc.online && !expectOnline {
-		return fmt.Errorf("user %s is logined", sc.id)
-	} else if !sc.online && expectOnline {
-		return fmt.Errorf("user %s not login", sc.id)
+	if online := sc.IsOnline(); online && !expectOnline {
+		return errFnClientLogined(sc.id)
+	} else if !online && expectOnline {
+		return errFnClientNotLogin(sc.id)
 	} else {
 		return nil
 	}
@@ -203,7 +354,7 @@ func (sc *SignalClient) Status(action string, params []string) (*Result, error)
 	}
 
 	var result string
-	switch sc.network {
+	switch sc.Network() {
 	case kNetworkConnecting:
 		result = "network connecting"
 	case kNetworkConnected:
@@ -226,7 +377,7 @@ func (sc *SignalClient) Connect(action string, params []string) (*Result, error)
 	}
 	sigaddr := params[0]
 
-	if sc.network == kNetworkConnecting || sc.network == kNetworkConnected {
+	if network := sc.Network(); network == kNetworkConnecting || network == kNetworkConnected {
 		result := "You need to disconnect at first!"
 		return NewResult(result), errNetworkHadConnected
 	} else {
@@ -241,7 +392,8 @@ func (sc *SignalClient) Disconnect(action string, params []string) (*Result, err
 		return nil, errFnInvalidParamters(params)
 	}
 
-	if sc.network == kNetworkConnecting || sc.network == kNetworkConnected {
+	if network := sc.Network(); network == kNetworkConnecting || network == kNetworkConnected {
+		sc.ClearCredentials()
 		sc.Close()
 		return nil, nil
 	} else {
@@ -251,8 +403,9 @@ func (sc *SignalClient) Disconnect(action string, params []string) (*Result, err
 
 /// user operations
 
+// register id pwd [invite], invite is required if invite-only
 func (sc *SignalClient) Register(action string, params []string) (*Result, error) {
-	if len(params) != 2 {
+	if len(params) != 2 && len(params) != 3 {
 		return nil, errFnInvalidParamters(params)
 	}
 
@@ -264,6 +417,9 @@ func (sc *SignalClient) Register(action string, params []string) (*Result, error
 	req := NewSignalRequest(params[0])
 	req.PwdMd5 = util.MD5SumGenerate([]string{params[1]})
 	req.Salt = util.RandomString(4)
+	if len(params) == 3 {
+		req.InviteMd5 = util.MD5SumGenerate([]string{params[2]})
+	}
 	if _, err := sc.SendRequest(action, req); err == nil {
 		result := "Now you could login with them!"
 		return NewResult(result), nil
@@ -286,7 +442,10 @@ func (sc *SignalClient) Login(action string, params []string) (*Result, error) {
 	req.PwdMd5 = util.MD5SumGenerate([]string{params[1]})
 	if _, err := sc.SendRequest(action, req); err == nil {
 		sc.id = req.FromId
-		sc.online = true
+		sc.SetOnline(true)
+		sc.cmu.Lock()
+		sc.pwdMd5 = req.PwdMd5
+		sc.cmu.Unlock()
 		return nil, nil
 	} else {
 		return nil, err
@@ -305,13 +464,111 @@ func (sc *SignalClient) Logout(action string, params []string) (*Result, error)
 	req := NewSignalRequest(sc.id)
 	if _, err := sc.SendRequest(action, req); err == nil {
 		sc.id = ""
-		sc.online = false
+		sc.SetOnline(false)
+		sc.ClearCredentials()
+		return nil, nil
+	} else {
+		return nil, err
+	}
+}
+
+/// account operations
+
+func (sc *SignalClient) ChangePassword(action string, params []string) (*Result, error) {
+	if len(params) != 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.PwdMd5 = util.MD5SumGenerate([]string{params[0]})
+	req.NewPwdMd5 = util.MD5SumGenerate([]string{params[1]})
+	req.Salt = util.RandomString(4)
+	if _, err := sc.SendRequest(action, req); err != nil {
+		return nil, err
+	}
+	sc.cmu.Lock()
+	sc.pwdMd5 = req.NewPwdMd5
+	sc.cmu.Unlock()
+	return nil, nil
+}
+
+func (sc *SignalClient) DeleteAccount(action string, params []string) (*Result, error) {
+	if len(params) != 1 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.PwdMd5 = util.MD5SumGenerate([]string{params[0]})
+	if _, err := sc.SendRequest(action, req); err == nil {
+		sc.id = ""
+		sc.SetOnline(false)
+		sc.ClearCredentials()
 		return nil, nil
 	} else {
 		return nil, err
 	}
 }
 
+func (sc *SignalClient) SetProfile(action string, params []string) (*Result, error) {
+	if len(params) != 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ProfileKey = params[0]
+	req.ProfileValue = params[1]
+	if _, err := sc.SendRequest(action, req); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (sc *SignalClient) AccountInfo(action string, params []string) (*Result, error) {
+	if len(params) != 0 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	resp, err := sc.SendRequest(action, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ResultL) != 1 {
+		return nil, errFnInvalidParamters(resp.ResultL)
+	}
+
+	info := &AccountInfo{}
+	if err := json.Unmarshal([]byte(resp.ResultL[0]), info); err != nil {
+		return nil, err
+	}
+	lines := []string{
+		fmt.Sprintf("id: %s", info.Id),
+		fmt.Sprintf("name: %s", info.DisplayName),
+		fmt.Sprintf("contact: %s", info.Contact),
+		fmt.Sprintf("created: %s", FormatTimeMs(info.Ctime)),
+		fmt.Sprintf("last login: %s from %s", FormatTimeMs(info.LastLogin), info.LastAddr),
+		fmt.Sprintf("owned: %s", strings.Join(info.Owned, ",")),
+		fmt.Sprintf("joined: %s", strings.Join(info.Joined, ",")),
+	}
+	return NewResultValue(strings.Join(lines, "\n"), info), nil
+}
+
 /// service operations
 
 func (sc *SignalClient) GoCheckService0(action string, params []string) (*Result, error) {
@@ -354,6 +611,18 @@ func (sc *SignalClient) ControlService(action string, params []string, count int
 	}
 
 	if resp, err := sc.SendRequest(action, req); err == nil {
+		switch action {
+		case kActionServices, kActionMyServices, kActionShowService:
+			return sc.ParseServiceInfos(action, resp.ResultL)
+		case kActionConnectService:
+			sc.cmu.Lock()
+			sc.services[req.ServiceName] = req.ServicePwdMd5
+			sc.cmu.Unlock()
+		case kActionDisconnectService, kActionLeaveService, kActionRemoveService:
+			sc.cmu.Lock()
+			delete(sc.services, req.ServiceName)
+			sc.cmu.Unlock()
+		}
 		result := strings.Join(resp.ResultL, "\n")
 		return NewResult(result), nil
 	} else {
@@ -361,9 +630,83 @@ func (sc *SignalClient) ControlService(action string, params []string, count int
 	}
 }
 
+// rotate-service-password serviceName pwd newPwd revoke(yes|no)
+func (sc *SignalClient) RotateServicePassword(action string, params []string) (*Result, error) {
+	if len(params) != 4 || (params[3] != "yes" && params[3] != "no") {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ServiceName = params[0]
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{params[1]})
+	req.NewPwdMd5 = util.MD5SumGenerate([]string{params[2]})
+	req.ServiceSalt = util.RandomString(4)
+	req.RevokeMembers = (params[3] == "yes")
+	if resp, err := sc.SendRequest(action, req); err == nil {
+		result := fmt.Sprintf("revoked members: %s", strings.Join(resp.ResultL, ","))
+		return NewResultValue(result, resp.ResultL), nil
+	} else {
+		return nil, err
+	}
+}
+
+// kick-member serviceName pwd peerId
+func (sc *SignalClient) KickMember(action string, params []string) (*Result, error) {
+	if len(params) != 3 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ServiceName = params[0]
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{params[1]})
+	req.ToId = params[2]
+	if _, err := sc.SendRequest(action, req); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (sc *SignalClient) ParseServiceInfos(action string, items []string) (*Result, error) {
+	var lines []string
+	infos := []*SignalServiceInfo{}
+	for _, item := range items {
+		info := &SignalServiceInfo{}
+		if err := json.Unmarshal([]byte(item), info); err != nil {
+			sc.Warnln("parse service info fail:", err)
+			continue
+		}
+		infos = append(infos, info)
+
+		switch {
+		case action == kActionShowService:
+			lines = append(lines, item)
+		case info.State == kServiceStateOwned:
+			lines = append(lines, fmt.Sprintf("%s - my owned", info.Name))
+		case action == kActionServices:
+			lines = append(lines, fmt.Sprintf("%s - %s owned", info.Name, info.Owner))
+		default:
+			lines = append(lines, fmt.Sprintf("%s - my %s", info.Name, info.State))
+		}
+	}
+
+	if action == kActionShowService && len(infos) == 1 {
+		return NewResultValue(strings.Join(lines, "\n"), infos[0]), nil
+	}
+	return NewResultValue(strings.Join(lines, "\n"), infos), nil
+}
+
 /// ice message
 
-func (sc *SignalClient) SendIceAuth(ufrag, pwd string, serviceName string) (*Result, error) {
+// toId is required for service owner
+func (sc *SignalClient) SendIceAuth(ufrag, pwd string, serviceName, toId string) (*Result, error) {
 	action := kActionEventIceAuth
 	if err := sc.CheckOnline(true); err != nil {
 		return nil, err
@@ -373,16 +716,18 @@ func (sc *SignalClient) SendIceAuth(ufrag, pwd string, serviceName string) (*Res
 	req.IceUfrag = ufrag
 	req.IcePwd = pwd
 	req.ServiceName = serviceName
+	req.ToId = toId
 
 	if resp, err := sc.SendRequest(action, req); err == nil {
-		fmt.Println(resp)
+		sc.Println("send ice-auth, resp:", resp)
 		return nil, nil
 	} else {
 		return nil, err
 	}
 }
 
-func (sc *SignalClient) SendIceCandidate(candidate string, serviceName string) (*Result, error) {
+// toId is required for service owner
+func (sc *SignalClient) SendIceCandidate(candidate string, serviceName, toId string) (*Result, error) {
 	action := kActionEventIceCandidate
 	if err := sc.CheckOnline(true); err != nil {
 		return nil, err
@@ -391,15 +736,99 @@ func (sc *SignalClient) SendIceCandidate(candidate string, serviceName string) (
 	req := NewSignalRequest(sc.id)
 	req.IceCandidate = candidate
 	req.ServiceName = serviceName
+	req.ToId = toId
 
 	if resp, err := sc.SendRequest(action, req); err == nil {
-		fmt.Println(resp)
+		sc.Println("send ice-candidate, resp:", resp)
+		return nil, nil
+	} else {
+		return nil, err
+	}
+}
+
+// offer/answer with dtls params from sdp, toId is required for service owner
+func (sc *SignalClient) SendSdp(action string, sdp string, serviceName, toId string) (*Result, error) {
+	if action != kActionEventOffer && action != kActionEventAnswer {
+		return nil, errFnInvalidAction(action)
+	}
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	info := ParseSdp(sdp)
+	req := NewSignalRequest(sc.id)
+	req.ToId = toId
+	req.ServiceName = serviceName
+	req.Sdp = sdp
+	req.DtlsFingerprint = info.Fingerprint
+	req.DtlsSetup = info.Setup
+
+	if _, err := sc.SendRequest(action, req); err == nil {
 		return nil, nil
 	} else {
 		return nil, err
 	}
 }
 
+/// conference operations
+
+// create-conference/conferences without params, invite-conference with
+// conferenceId and peerId, others with conferenceId
+func (sc *SignalClient) ControlConference(action string, params []string) (*SignalResponse, error) {
+	count := 1
+	if action == kActionCreateConference || action == kActionConferences {
+		count = 0
+	} else if action == kActionInviteConference {
+		count = 2
+	}
+	if len(params) != count {
+		return nil, errFnInvalidParamters(params)
+	}
+	if err := sc.CheckOnline(true); err != nil {
+		return nil, err
+	}
+
+	req := NewSignalRequest(sc.id)
+	if count >= 1 {
+		if id, err := ParseConferenceId(params[0]); err != nil {
+			return nil, err
+		} else {
+			req.ConferenceId = id
+		}
+	}
+	if count == 2 {
+		req.ToId = params[1]
+	}
+	return sc.SendRequest(action, req)
+}
+
+func (sc *SignalClient) SendConferenceIceAuth(id uint32, toId string, ufrag, pwd string) error {
+	if err := sc.CheckOnline(true); err != nil {
+		return err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ConferenceId = id
+	req.ToId = toId
+	req.IceUfrag = ufrag
+	req.IcePwd = pwd
+	_, err := sc.SendRequest(kActionEventIceAuth, req)
+	return err
+}
+
+func (sc *SignalClient) SendConferenceIceCandidate(id uint32, toId string, candidate string) error {
+	if err := sc.CheckOnline(true); err != nil {
+		return err
+	}
+
+	req := NewSignalRequest(sc.id)
+	req.ConferenceId = id
+	req.ToId = toId
+	req.IceCandidate = candidate
+	_, err := sc.SendRequest(kActionEventIceCandidate, req)
+	return err
+}
+
 /// send request and wait response
 
 func (sc *SignalClient) SendRequest(action string, req *SignalRequest) (*SignalResponse, error) {
@@ -418,12 +847,12 @@ func (sc *SignalClient) SendRequest(action string, req *SignalRequest) (*SignalR
 	select {
 	case resp, ok := <-req.ch_resp:
 		if !ok {
-			return nil, errors.New("closed by other")
+			return nil, errRequestClosed
 		}
 		if len(resp.Error) == 0 {
 			return resp, nil
 		} else {
-			return nil, errors.New(resp.Error)
+			return nil, ErrorFromCode(resp.ErrorCode, resp.Error)
 		}
 	case <-ticker.C:
 		return nil, errRequestTimeout
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// client whose requests are handled by ss with the current conn
+func newTestClient(ss *SignalServer, conn *SignalConnection) (sc *SignalClient, setConn func(*SignalConnection)) {
+	var mu sync.Mutex
+	sc = NewSignalClient()
+	sc.SetNetwork(kNetworkConnected)
+	go func() {
+		for req := range sc.ch_send {
+			mu.Lock()
+			req.conn = conn
+			mu.Unlock()
+			req.ch_resp <- ss.HandleRequest(req)
+		}
+	}()
+	setConn = func(c *SignalConnection) {
+		mu.Lock()
+		defer mu.Unlock()
+		conn = c
+	}
+	return
+}
+
+// wait ice-open event from fromId
+func waitTestIceOpen(t *testing.T, conn *SignalConnection, fromId string) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case resp := <-conn.ch_send:
+			if resp.Event == kActionEventIceOpen && resp.FromId == fromId {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no ice-open from %s", fromId)
+		}
+	}
+}
+
+func TestClientReloginAfterFailover(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, member := newTestService(t, ss)
+	ss.RemoveConnection(member)
+
+	conn := newTestConn(ss)
+	sc, setConn := newTestClient(ss, conn)
+	if _, err := sc.Login(kActionLogin, []string{"member", kTestPassword}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.GoCheckService2(kActionConnectService, []string{"svc", kTestPassword}); err != nil {
+		t.Fatal(err)
+	}
+	waitTestIceOpen(t, owner, "member")
+
+	// connection lost and another node
+	ss.RemoveConnection(conn)
+	sc.SetOnline(false)
+	conn = newTestConn(ss)
+	setConn(conn)
+
+	if err := sc.Relogin(); err != nil {
+		t.Fatalf("relogin: %v", err)
+	}
+	if err := sc.CheckOnline(true); err != nil {
+		t.Error(err)
+	}
+	if ss.onlines["member"] != conn {
+		t.Error("member not online by new connection")
+	}
+	waitTestIceOpen(t, owner, "member")
+
+	if _, err := sc.Logout(kActionLogout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if sc.HasCredentials() {
+		t.Error("credentials kept after logout")
+	}
+}
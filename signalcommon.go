@@ -11,20 +11,62 @@ const (
 	kActionConnect    = "connect"
 	kActionDisconnect = "disconnect"
 
-	kActionRegister          = "register"
-	kActionLogin             = "login"
-	kActionLogout            = "logout"
-	kActionServices          = "services"
-	kActionMyServices        = "myservices"
-	kActionShowService       = "show-service"
-	kActionJoinService       = "join-service"
-	kActionLeaveService      = "leave-service"
-	kActionCreateService     = "create-service"
-	kActionRemoveService     = "remove-service"
-	kActionEnableService     = "enable-service"
-	kActionDisableService    = "disable-service"
-	kActionConnectService    = "connect-service"
-	kActionDisconnectService = "disconnect-service"
+	kActionRegister       = "register"
+	kActionLogin          = "login"
+	kActionLogout         = "logout"
+	kActionChangePassword = "change-password"
+	kActionDeleteAccount  = "delete-account"
+	kActionSetProfile     = "set-profile"
+	kActionInfo           = "info"
+
+	// admin actions
+	kActionPeers                = "peers"
+	kActionDisablePeer          = "disable-peer"
+	kActionEnablePeer           = "enable-peer"
+	kActionForceDisconnect      = "force-disconnect"
+	kActionSetRole              = "set-role"
+	kActionForceRemoveService   = "force-remove-service"
+	kActionSetRegisterMode      = "set-register-mode"
+	kActionCreateRegisterInvite = "create-register-invite"
+	kActionCreateAccount        = "create-account"
+	kActionAudit                = "audit"
+	kActionServices             = "services"
+	kActionMyServices           = "myservices"
+	kActionShowService          = "show-service"
+	kActionJoinService          = "join-service"
+	kActionLeaveService         = "leave-service"
+	kActionCreateService        = "create-service"
+	kActionRemoveService        = "remove-service"
+	kActionEnableService        = "enable-service"
+	kActionDisableService       = "disable-service"
+	kActionConnectService       = "connect-service"
+	kActionDisconnectService    = "disconnect-service"
+
+	kActionRotateServicePassword = "rotate-service-password"
+	kActionKickMember            = "kick-member"
+
+	// service acl, only owner
+	kActionAllowPeer          = "allow-peer"
+	kActionDenyPeer           = "deny-peer"
+	kActionResetPeer          = "reset-peer"
+	kActionAcceptJoin         = "accept-join"
+	kActionRejectJoin         = "reject-join"
+	kActionSetServiceApproval = "set-service-approval"
+	kActionCreateInvite       = "create-invite"
+	kActionShowServiceAcl     = "service-acl"
+
+	// local actions of endpoint
+	kActionTunnels     = "tunnels"
+	kActionTunnelStats = "tunnel-stats"
+	kActionCloseTunnel = "close-tunnel"
+	kActionBindService = "bind-service"
+
+	kActionCreateConference = "create-conference"
+	kActionJoinConference   = "join-conference"
+	kActionInviteConference = "invite-conference"
+	kActionLeaveConference  = "leave-conference"
+	kActionConferences      = "conferences"
+	kActionConferenceSend   = "conference-send"
 
 	kActionEventIceOpen      = "ice-open"
 	kActionEventIceOpenAck   = "ice-open-ack"
@@ -32,6 +74,21 @@ const (
 	kActionEventIceCloseAck  = "ice-close-ack"
 	kActionEventIceAuth      = "ice-auth"
 	kActionEventIceCandidate = "ice-candidate"
+
+	kActionEventServiceRevoked = "service-revoked" // membership revoked by owner
+	kActionEventJoinRequest    = "join-request"    // to owner, if approval required
+	kActionEventJoinAccepted   = "join-accepted"
+	kActionEventJoinRejected   = "join-rejected"
+	kActionEventServerShutdown = "server-shutdown" // with reconnect hint
+
+	// webrtc-relative
+	kActionEventOffer  = "offer"
+	kActionEventAnswer = "answer"
+
+	// conference-relative
+	kActionEventConferenceJoin    = "conference-join"
+	kActionEventConferenceLeave   = "conference-leave"
+	kActionEventConferenceMessage = "conference-message" // local, data from member
 )
 
 /**
@@ -60,20 +117,40 @@ type SignalRequest struct {
 	Sequence string
 	Action   string
 
-	FromId string
-	PwdMd5 string
-	Salt   string
-	ToId   string
+	FromId    string
+	PwdMd5    string
+	Salt      string
+	ToId      string
+	NewPwdMd5 string // change-password, with new Salt
+
+	ProfileKey   string // name/contact
+	ProfileValue string
+
+	Role         string // set-role
+	RegisterMode string // set-register-mode
+	InviteMd5    string // register when invite-only
+	AuditRows    int    // audit
+	AuditFilter  string // audit, peer id/service name/action
 
 	ServiceName   string
 	ServicePwdMd5 string
 	ServiceDesc   string
 	ServiceSalt   string
+	RevokeMembers bool  // rotate-service-password
+	Approval      bool  // set-service-approval
+	InviteTtl     int64 // create-invite, seconds
+	InviteUses    int
 
 	IceCandidate string
 	IceUfrag     string
 	IcePwd       string
 
+	Sdp             string
+	DtlsFingerprint string // e.g. "sha-256 AB:CD:.."
+	DtlsSetup       string // actpass/active/passive
+
+	ConferenceId uint32 // ice-auth/ice-candidate to ToId of conference
+
 	conn    *SignalConnection
 	ch_resp chan *SignalResponse
 	ctime   int64
@@ -92,12 +169,18 @@ type SignalResponse struct {
 	FromId      string
 	ServiceName string
 
-	Token   string
-	ResultL []string
-	ResultM map[string]string
-	Error   string
+	ConferenceId uint32
+
+	Token     string
+	ResultL   []string
+	ResultM   map[string]string
+	Error     string
+	ErrorCode string
 
 	conn *SignalConnection
+	toId string // forward by cluster if conn is nil
+
+	audits []*AuditEntry // tunnels closed by request, audited out of lock
 }
 
 /**
@@ -109,6 +192,7 @@ func NewSignalPeer(id string, pwd_md5, salt string) *SignalPeer {
 		PwdMd5:     pwd_md5,
 		Salt:       salt,
 		InServices: make(map[string]bool),
+		Profile:    User{Ctime: util.NowMs()},
 	}
 }
 
@@ -117,6 +201,16 @@ type SignalPeer struct {
 	PwdMd5     string
 	Salt       string
 	InServices map[string]bool // name=>.., client join/leave
+	Profile    User
+	Role       string // admin/user("")
+	Disabled   bool
+}
+
+func (p *SignalPeer) GetRole() string {
+	if len(p.Role) == 0 {
+		return kRoleUser
+	}
+	return p.Role
 }
 
 /**
@@ -139,4 +233,30 @@ type SignalService struct {
 	PwdMd5      string `json:"-"`
 	Salt        string `json:"-"`
 	Ctime       int64  `json:"-"`
+
+	// acl, see acl.go
+	Allows   map[string]bool           `json:"-"`
+	Denies   map[string]bool           `json:"-"`
+	Invites  map[string]*ServiceInvite `json:"-"` // key: md5 of code with salt
+	Approval bool                      `json:"-"`
+	Requests map[string]int64          `json:"-"` // pending join requests
+}
+
+/**
+ * Signal service info, returned to requester by services/myservices/show-service
+ */
+const (
+	kServiceStateNone   = ""
+	kServiceStateOwned  = "owned"
+	kServiceStateJoined = "joined"
+	kServiceStateLeft   = "left"
+)
+
+type SignalServiceInfo struct {
+	Name        string
+	Owner       string
+	Description string
+	Enabled     bool
+	Active      bool
+	State       string // relative to requester
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	util "github.com/PeterXu/goutil"
@@ -13,6 +15,7 @@ import (
  * Signal connection
  *	a. incoming: recv data -> SignalRequest -> SignalMessage -> ...
  *  b. outgoing: send SignalResponse -> data -> ...,
+ *  c. codec: gob by default, json for browsers(/ws?codec=json)
  */
 
 var upgrader = websocket.Upgrader{
@@ -24,7 +27,10 @@ const (
 	writeWait      = 3 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 1024
+	maxMessageSize = 8 * 1024 // enough for sdp
+
+	kCodecGob  = "gob"
+	kCodecJson = "json"
 )
 
 type SignalConnection struct {
@@ -32,9 +38,19 @@ type SignalConnection struct {
 	conn    *websocket.Conn
 	ch_send chan *SignalResponse
 	id      string
+	codec   string
+	addr    string // remote addr of websocket
+
+	mu     sync.Mutex // guard ch_send and closed
+	closed bool
+
+	// request rate limit, see ratelimit.go
+	tokens    float64
+	tokenTime int64
+	authDelay time.Duration // of current response, by soft lock of account
 }
 
-func (c SignalConnection) String() string {
+func (c *SignalConnection) String() string {
 	if c.conn != nil {
 		return fmt.Sprintf("id=%s_raddr=%s", c.id, c.conn.RemoteAddr())
 	} else {
@@ -42,9 +58,23 @@ func (c SignalConnection) String() string {
 	}
 }
 
+func (c *SignalConnection) RemoteAddr() string {
+	return c.addr
+}
+
+// close websocket, readPump will exit and notify server.
+// without websocket(e.g. in-process), only sending is closed.
+func (c *SignalConnection) Close() {
+	if c.conn != nil {
+		c.conn.Close()
+	} else {
+		c.closeSend()
+	}
+}
+
 func (c *SignalConnection) readPump() {
 	defer func() {
-		c.ss.ch_close <- c
+		c.ss.RemoveConnection(c)
 		c.conn.Close()
 	}()
 
@@ -70,11 +100,11 @@ func (c *SignalConnection) readPump() {
 		}
 
 		req := NewSignalRequest("")
-		if err := util.GobDecode(data, req); err != nil {
+		if err := c.decode(data, req); err != nil {
 			c.ss.Printf("conn, decode error: %v\n", err)
 		} else {
 			req.conn = c
-			c.ss.ch_receive <- req
+			c.ss.OnReceiveRequest(req)
 		}
 	}
 }
@@ -96,10 +126,10 @@ func (c *SignalConnection) writePump() {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			if buf, err := util.GobEncode(resp); err != nil {
+			if mt, data, err := c.encode(resp); err != nil {
 				c.ss.Printf("conn, encode err: %v\n", err)
 			} else {
-				if err := c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				if err := c.conn.WriteMessage(mt, data); err != nil {
 					c.ss.Printf("conn, write err: %v\n", err)
 				}
 			}
@@ -113,6 +143,25 @@ func (c *SignalConnection) writePump() {
 	}
 }
 
+func (c *SignalConnection) decode(data []byte, req *SignalRequest) error {
+	if c.codec == kCodecJson {
+		return json.Unmarshal(data, req)
+	}
+	return util.GobDecode(data, req)
+}
+
+func (c *SignalConnection) encode(resp *SignalResponse) (int, []byte, error) {
+	if c.codec == kCodecJson {
+		data, err := json.Marshal(resp)
+		return websocket.TextMessage, data, err
+	}
+	if buf, err := util.GobEncode(resp); err != nil {
+		return 0, nil, err
+	} else {
+		return websocket.BinaryMessage, buf.Bytes(), nil
+	}
+}
+
 func serveWs(ss *SignalServer, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -120,12 +169,19 @@ func serveWs(ss *SignalServer, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	codec := kCodecGob
+	if r.URL.Query().Get("codec") == kCodecJson {
+		codec = kCodecJson
+	}
+
 	sconn := &SignalConnection{
 		ss:      ss,
 		conn:    conn,
-		ch_send: make(chan *SignalResponse),
+		ch_send: make(chan *SignalResponse, kSendQueueSize),
+		addr:    conn.RemoteAddr().String(),
+		codec:   codec,
 	}
-	ss.ch_connect <- sconn
+	ss.AddConnection(sconn)
 
 	go sconn.writePump()
 	go sconn.readPump()
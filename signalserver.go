@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	util "github.com/PeterXu/goutil"
@@ -20,6 +22,18 @@ const (
 type SignalDatabase struct {
 	Peers    map[string]*SignalPeer    // id=>..
 	Services map[string]*SignalService // name=>..
+
+	RegisterMode string                    // open(default)/invite/admin
+	Invites      map[string]*ServiceInvite // register invites
+
+	Version uint64 // increased by each change in cluster
+}
+
+func (db *SignalDatabase) GetRegisterMode() string {
+	if len(db.RegisterMode) == 0 {
+		return kRegisterOpen
+	}
+	return db.RegisterMode
 }
 
 /**
@@ -34,19 +48,42 @@ func NewSignalServer() *SignalServer {
 			Services: make(map[string]*SignalService),
 		},
 
-		ch_connect: make(chan *SignalConnection),
-		ch_close:   make(chan *SignalConnection),
-		ch_receive: make(chan *SignalRequest),
-
-		connections: make(map[*SignalConnection]bool),
-		onlines:     make(map[string]*SignalConnection),
-		actions:     make(map[string]fnSignalServerAction),
+		ch_quit:    make(chan chan bool),
+		ch_stopped: make(chan bool),
+		ch_cluster: make(chan *ClusterMessage, 64),
+		store:      NewFileStore(kDefaultDBFile, kMaxDBSize),
+		slowPolicy: kSlowPolicyClose,
+
+		connections:  make(map[*SignalConnection]bool),
+		onlines:      make(map[string]*SignalConnection),
+		actions:      make(map[string]fnSignalServerAction),
+		conferences:  make(map[uint32]*Conference),
+		metrics:      NewSignalMetrics(),
+		authGuard:    NewAuthGuard(kAuthMaxFails),
+		ipGuard:      NewAuthGuard(kAuthMaxFailsIp),
+		accountGuard: NewAuthGuard(kAuthMaxFailsAccount),
 	}
 
 	server.TAG = "sigserver"
 	server.actions[kActionRegister] = server.Register
 	server.actions[kActionLogin] = server.Login
 	server.actions[kActionLogout] = server.Logout
+	server.actions[kActionChangePassword] = server.ChangePassword
+	server.actions[kActionDeleteAccount] = server.DeleteAccount
+	server.actions[kActionSetProfile] = server.SetProfile
+	server.actions[kActionInfo] = server.AccountInfo
+
+	// admin-relative
+	server.actions[kActionPeers] = server.ListPeers
+	server.actions[kActionDisablePeer] = server.CheckAdminPeer
+	server.actions[kActionEnablePeer] = server.CheckAdminPeer
+	server.actions[kActionForceDisconnect] = server.CheckAdminPeer
+	server.actions[kActionSetRole] = server.CheckAdminPeer
+	server.actions[kActionForceRemoveService] = server.ForceRemoveService
+	server.actions[kActionSetRegisterMode] = server.SetRegisterMode
+	server.actions[kActionCreateRegisterInvite] = server.CreateRegisterInvite
+	server.actions[kActionCreateAccount] = server.CreateAccount
+	server.actions[kActionAudit] = server.QueryAudit
 
 	server.actions[kActionServices] = server.Services
 	server.actions[kActionMyServices] = server.MyServices
@@ -60,6 +97,18 @@ func NewSignalServer() *SignalServer {
 	server.actions[kActionDisableService] = server.CheckEnableService
 	server.actions[kActionConnectService] = server.CheckConnectService
 	server.actions[kActionDisconnectService] = server.CheckConnectService
+	server.actions[kActionRotateServicePassword] = server.RotateServicePassword
+	server.actions[kActionKickMember] = server.KickMember
+
+	// acl-relative
+	server.actions[kActionAllowPeer] = server.CheckServicePeer
+	server.actions[kActionDenyPeer] = server.CheckServicePeer
+	server.actions[kActionResetPeer] = server.CheckServicePeer
+	server.actions[kActionAcceptJoin] = server.CheckServicePeer
+	server.actions[kActionRejectJoin] = server.CheckServicePeer
+	server.actions[kActionSetServiceApproval] = server.SetServiceApproval
+	server.actions[kActionCreateInvite] = server.CreateInvite
+	server.actions[kActionShowServiceAcl] = server.ShowServiceAcl
 
 	// ice-relative
 	server.actions[kActionEventIceOpen] = server.CheckOnIceStatus
@@ -69,6 +118,17 @@ func NewSignalServer() *SignalServer {
 	server.actions[kActionEventIceAuth] = server.OnIceAuth
 	server.actions[kActionEventIceCandidate] = server.OnIceCandidate
 
+	// webrtc-relative
+	server.actions[kActionEventOffer] = server.OnSdp
+	server.actions[kActionEventAnswer] = server.OnSdp
+
+	// conference-relative
+	server.actions[kActionCreateConference] = server.CreateConference
+	server.actions[kActionJoinConference] = server.JoinConference
+	server.actions[kActionInviteConference] = server.InviteConference
+	server.actions[kActionLeaveConference] = server.LeaveConference
+	server.actions[kActionConferences] = server.Conferences
+
 	// init
 	server.SyncFromStorage()
 
@@ -78,26 +138,74 @@ func NewSignalServer() *SignalServer {
 type SignalServer struct {
 	util.Logging
 
+	// guard db/connections/onlines/conferences/guards/cluster,
+	// read-only actions are dispatched with read lock, see dispatcher.go
+	mu sync.RWMutex
 	db *SignalDatabase
 
-	ch_connect chan *SignalConnection
-	ch_close   chan *SignalConnection
-	ch_receive chan *SignalRequest
-
-	connections map[*SignalConnection]bool
-	onlines     map[string]*SignalConnection // uid => ..
-	actions     map[string]fnSignalServerAction
+	ch_quit    chan chan bool
+	ch_stopped chan bool // closed when Run exits
+	ch_cluster chan *ClusterMessage
+
+	connections  map[*SignalConnection]bool
+	onlines      map[string]*SignalConnection // uid => ..
+	actions      map[string]fnSignalServerAction
+	conferences  map[uint32]*Conference // in memory only
+	metrics      *SignalMetrics
+	authGuard    *AuthGuard // per account/service@ip
+	ipGuard      *AuthGuard // per source ip
+	accountGuard *AuthGuard // per account/service, soft
+	audit        *AuditLog  // nil if disabled
+	tunnelCloses []*AuditEntry
+
+	store   SignalStore
+	cluster *SignalCluster // nil if single node
+
+	httpServer *http.Server
+	draining   int32  // atomic, see shutdown.go
+	slowPolicy string // close/drop for slow consumer
 }
 
+// block until Shutdown completed or listen failed
 func (ss *SignalServer) Start(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ss.Println("Listen err", err)
+		return
+	}
+	ss.Serve(ln)
+}
+
+// serve on listener, e.g. loopback with random port
+func (ss *SignalServer) Serve(ln net.Listener) {
 	go ss.Run()
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if ss.IsDraining() {
+			http.Error(w, "server shutdown", http.StatusServiceUnavailable)
+			return
+		}
 		serveWs(ss, w, r)
 	})
+	mux.Handle("/", webHandler())
+
+	ss.httpServer = &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	if err := ss.httpServer.Serve(ln); err != http.ErrServerClosed {
+		ss.Println("Serve err", err)
+		ss.StopRun()
+		return
+	}
+	<-ss.ch_stopped
+}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		ss.Println("ListenAndServe err", err)
+// stop Run loop and flush storage, no-op if stopped already
+func (ss *SignalServer) StopRun() {
+	done := make(chan bool)
+	select {
+	case ss.ch_quit <- done:
+		<-done
+	case <-ss.ch_stopped:
 	}
 }
 
@@ -107,31 +215,45 @@ func (ss *SignalServer) Run() {
 
 	for {
 		select {
-		case conn := <-ss.ch_connect:
-			ss.Printf("add one connection: %v\n", conn)
-			ss.connections[conn] = true
-		case conn := <-ss.ch_close:
-			ss.Printf("close one connection:%v\n", conn)
-			if _, ok := ss.connections[conn]; ok {
-				delete(ss.connections, conn)
-			} else {
-				delete(ss.onlines, conn.id)
-			}
-			close(conn.ch_send)
-		case req := <-ss.ch_receive:
-			ss.OnReceiveRequest(req)
+		case msg := <-ss.ch_cluster:
+			ss.mu.Lock()
+			ss.OnClusterMessage(msg)
+			ss.mu.Unlock()
+		case done := <-ss.ch_quit:
+			tickChan.Stop()
+			ss.SyncToStorage()
+			ss.Println("running end")
+			close(done)
+			close(ss.ch_stopped)
+			return
 		case <-tickChan.C:
 			ss.SyncToStorage()
+			ss.mu.Lock()
+			ss.authGuard.Prune()
+			ss.ipGuard.Prune()
+			ss.accountGuard.Prune()
+			ss.PublishPresence()
+			ss.CheckClusterNodes()
+			ss.mu.Unlock()
 		}
 	}
 }
 
+// single node only, db of cluster is committed by each request
 func (ss *SignalServer) SyncToStorage() {
-	if buf, err := util.GobEncode(ss.db); err != nil {
+	ss.mu.RLock()
+	if ss.cluster != nil {
+		ss.mu.RUnlock()
+		return
+	}
+	buf, err := util.GobEncode(ss.db)
+	ss.mu.RUnlock()
+
+	if err != nil {
 		ss.Warnln("SyncTo gob err: ", err)
 	} else {
 		//_ = buf
-		if err := WriteFile(kDefaultDBFile, buf.Bytes()); err != nil {
+		if err := ss.store.Save(buf.Bytes()); err != nil {
 			ss.Warnln("SyncTo write err: ", err)
 		} else {
 			//ss.Println("SyncTo success")
@@ -140,13 +262,13 @@ func (ss *SignalServer) SyncToStorage() {
 }
 
 func (ss *SignalServer) SyncFromStorage() {
-	if data, err := ReadFile(kDefaultDBFile, kMaxDBSize); err != nil {
+	if data, err := ss.store.Load(); err != nil {
 		ss.Warnln("SyncFrom, read err: ", err)
 	} else {
 		if err := util.GobDecode(data, ss.db); err != nil {
 			ss.Warnln("SyncFrom gob err: ", err)
 		} else {
-			ss.Println("SyncFrom success:", ss.db)
+			ss.Printf("SyncFrom success: %d peers, %d services\n", len(ss.db.Peers), len(ss.db.Services))
 		}
 	}
 }
@@ -175,68 +297,148 @@ func (ss *SignalServer) CheckOnlineConn(id string) (*SignalConnection, error) {
 	}
 }
 
+// called by readPump of each connection, requests of one connection are in order
 func (ss *SignalServer) OnReceiveRequest(req *SignalRequest) {
+	resp := ss.HandleRequest(req)
+
+	// soft lock of account, delayed out of server lock
+	if conn := req.conn; conn != nil && conn.authDelay > 0 {
+		delay := conn.authDelay
+		conn.authDelay = 0
+		time.Sleep(delay)
+	}
+	req.conn.Send(resp)
+}
+
+// dispatch request with lock, return the response.
+// metrics and audit are out of lock, which may write files.
+func (ss *SignalServer) HandleRequest(req *SignalRequest) *SignalResponse {
 	ss.Printf("receive request: %s, seq: %s, conn: %v\n", req.Action, req.Sequence, req.conn)
 
 	var err error
+	forwarded := false
+	start := time.Now()
+	action := strings.ToLower(req.Action)
 	resp := NewSignalResponse(req.Sequence)
-	if fn, ok := ss.actions[strings.ToLower(req.Action)]; ok {
-		err = fn(req, resp)
+	if req.conn != nil && !req.conn.AllowRequest() {
+		err = errRateLimited
+	} else if fn, ok := ss.actions[action]; ok {
+		forwarded, err = ss.dispatchRequest(action, fn, req, resp)
 	} else {
+		action = "unknown" // limit metric labels
 		err = errFnInvalidAction(req.Action)
 	}
+	ss.metrics.OnRequest(action, err, time.Since(start))
+	ss.RecordAudit(action, req, resp, err)
 
 	ss.Printf("complete request: %s, seq: %s, err: %v\n", req.Action, req.Sequence, err)
 
+	// reply to request
 	if err != nil {
 		resp.Error = fmt.Sprint(err)
+		resp.ErrorCode = ErrorCode(err)
+	} else if forwarded {
+		resp = NewSignalResponse(req.Sequence)
+	}
+	return resp
+}
+
+// run action with lock, and forward its response if to another
+func (ss *SignalServer) dispatchRequest(action string, fn fnSignalServerAction, req *SignalRequest, resp *SignalResponse) (bool, error) {
+	if kSharedLockActions[action] {
+		ss.mu.RLock()
+		defer ss.mu.RUnlock()
 	} else {
-		if resp.conn != nil {
-			// forward to another
-			resp.conn.ch_send <- resp
-			resp = nil
-		}
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
 	}
 
-	// reply to request
-	if resp == nil {
-		resp = NewSignalResponse(req.Sequence)
+	if !kAnonymousActions[action] && !ss.IsSessionOf(req) {
+		return false, errClientNotLogin
 	}
-	req.conn.ch_send <- resp
-}
+	err := ss.CommitAction(action, fn, req, resp)
+	audits := ss.takeTunnelCloses()
+	if err != nil {
+		return false, err
+	}
+	resp.audits = audits
 
-func (ss *SignalServer) Register(req *SignalRequest, resp *SignalResponse) error {
-	if len(req.FromId) < 5 {
-		ss.Warnf("client: %s, invalid id length\n", req.FromId)
-		return errInvalidClientId
+	switch action {
+	case kActionLogin, kActionLogout, kActionDeleteAccount:
+		ss.PublishPresence()
 	}
+	if resp.conn != nil {
+		// forward to another
+		resp.toId = resp.conn.id
+		resp.conn.Send(resp)
+		return true, nil
+	} else if len(resp.toId) > 0 {
+		// forward to another node
+		ss.SendEvent(resp.toId, resp)
+		return true, nil
+	}
+	return false, nil
+}
 
-	if len(req.PwdMd5) < 32 || len(req.Salt) < 4 {
-		ss.Warnf("client: %s, invalid password: %s:%s\n", req.FromId, req.PwdMd5, req.Salt)
-		return errInvalidPassword
+// actions before login, others are bound to the id of login
+var kAnonymousActions = map[string]bool{
+	kActionRegister: true,
+	kActionLogin:    true,
+}
+
+// FromId is claimed by client, it must be the login of this connection
+func (ss *SignalServer) IsSessionOf(req *SignalRequest) bool {
+	if req.conn == nil || len(req.FromId) == 0 || req.conn.id != req.FromId {
+		return false
 	}
+	return ss.onlines[req.FromId] == req.conn
+}
 
-	if _, ok := ss.db.Peers[req.FromId]; ok {
-		return errClientExisted
-	} else {
-		new_pwd_md5 := util.MD5SumGenerate([]string{req.PwdMd5, req.Salt})
-		peer := NewSignalPeer(req.FromId, new_pwd_md5, req.Salt)
-		ss.db.Peers[req.FromId] = peer
-		return nil
+func (ss *SignalServer) Register(req *SignalRequest, resp *SignalResponse) error {
+	if err := ss.CheckNewPeer(req.FromId, req.PwdMd5, req.Salt); err != nil {
+		return err
 	}
+	if err := ss.CheckRegisterMode(req); err != nil {
+		return err
+	}
+	return ss.AddPeer(req.FromId, req.PwdMd5, req.Salt)
 }
 
 func (ss *SignalServer) Login(req *SignalRequest, resp *SignalResponse) error {
 	conn := req.conn
 	ss.Printf("client login with connection:%v\n", conn)
 
+	key := "peer:" + req.FromId
+	if err := ss.CheckAuthLock(key, conn); err != nil {
+		ss.Warnf("client: %s, login locked\n", req.FromId)
+		return err
+	}
+
 	if peer, ok := ss.db.Peers[req.FromId]; !ok {
-		return errClientNotExist
+		// same as wrong password, ids are never probed by login
+		util.MD5SumVerify([]string{req.PwdMd5, ""}, "")
+		ss.Warnf("client: %s, unknown id from %s\n", req.FromId, conn.RemoteAddr())
+		ss.OnAuthResult(key, conn, false)
+		return errWrongPassword
 	} else {
 		if !util.MD5SumVerify([]string{req.PwdMd5, peer.Salt}, peer.PwdMd5) {
-			ss.Warnf("client: %s, wrong password: %s:%s != %s\n", req.FromId, req.PwdMd5, peer.Salt, peer.PwdMd5)
+			ss.Warnf("client: %s, wrong password from %s\n", req.FromId, conn.RemoteAddr())
+			ss.OnAuthResult(key, conn, false)
 			return errWrongPassword
 		}
+		ss.OnAuthResult(key, conn, true)
+		if peer.Disabled {
+			return errClientDisabled
+		}
+
+		peer.Profile.LastLogin = util.NowMs()
+		peer.Profile.LastAddr = conn.RemoteAddr()
+
+		// the latest login wins, e.g. failover from another node
+		if node, ok := ss.RemoteNode(req.FromId); ok {
+			ss.Printf("client: %s, kick login of node %s\n", req.FromId, node)
+			ss.PublishCluster(kTopicNodePrefix+node, &ClusterMessage{ToId: req.FromId, Disconnect: true})
+		}
 
 		// move from pending connections to onlines
 		conn.id = req.FromId
@@ -252,23 +454,43 @@ func (ss *SignalServer) Logout(req *SignalRequest, resp *SignalResponse) error {
 	if _, ok := ss.connections[conn]; !ok {
 		if _, ok := ss.onlines[conn.id]; ok {
 			delete(ss.onlines, conn.id)
+			ss.LeaveConferences(conn.id)
 			ss.connections[conn] = true
 		}
 	}
 	return nil
 }
 
+// return service info relative to peer
+func (ss *SignalServer) GetServiceInfo(service *SignalService, peer *SignalPeer) *SignalServiceInfo {
+	info := &SignalServiceInfo{
+		Name:        service.Name,
+		Owner:       service.Owner,
+		Description: service.Description,
+		Enabled:     service.Enabled,
+	}
+	if service.Enabled {
+		info.Active = ss.IsOnline(service.Owner)
+	}
+	if service.Owner == peer.Id {
+		info.State = kServiceStateOwned
+	} else if isIn, ok := peer.InServices[service.Name]; ok {
+		if isIn {
+			info.State = kServiceStateJoined
+		} else {
+			info.State = kServiceStateLeft
+		}
+	}
+	return info
+}
+
 // return all services
 func (ss *SignalServer) Services(req *SignalRequest, resp *SignalResponse) error {
-	if _, err := ss.CheckOnline(req.FromId); err != nil {
+	if peer, err := ss.CheckOnline(req.FromId); err != nil {
 		return err
 	} else {
-		for name, srv := range ss.db.Services {
-			if srv.Owner == req.FromId {
-				resp.ResultL = append(resp.ResultL, fmt.Sprintf("%s - my owned", name))
-			} else {
-				resp.ResultL = append(resp.ResultL, fmt.Sprintf("%s - %s owned", name, srv.Owner))
-			}
+		for _, srv := range ss.db.Services {
+			resp.ResultL = append(resp.ResultL, util.JsonEncode(ss.GetServiceInfo(srv, peer)))
 		}
 		return nil
 	}
@@ -279,16 +501,10 @@ func (ss *SignalServer) MyServices(req *SignalRequest, resp *SignalResponse) err
 	if peer, err := ss.CheckOnline(req.FromId); err != nil {
 		return err
 	} else {
-		for name, srv := range ss.db.Services {
-			if srv.Owner == req.FromId {
-				resp.ResultL = append(resp.ResultL, fmt.Sprintf("%s - my owned", name))
-			}
-		}
-		for name, ok := range peer.InServices {
-			if ok {
-				resp.ResultL = append(resp.ResultL, fmt.Sprintf("%s - my joined", name))
-			} else {
-				resp.ResultL = append(resp.ResultL, fmt.Sprintf("%s - my left", name))
+		for _, srv := range ss.db.Services {
+			info := ss.GetServiceInfo(srv, peer)
+			if info.State != kServiceStateNone {
+				resp.ResultL = append(resp.ResultL, util.JsonEncode(info))
 			}
 		}
 		return nil
@@ -296,55 +512,67 @@ func (ss *SignalServer) MyServices(req *SignalRequest, resp *SignalResponse) err
 }
 
 func (ss *SignalServer) ShowService(req *SignalRequest, resp *SignalResponse) error {
-	if _, err := ss.CheckOnline(req.FromId); err != nil {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
 		return err
 	}
 
 	if service, ok := ss.db.Services[req.ServiceName]; !ok {
 		return errServiceNotExist
 	} else {
-		if service.Enabled {
-			_, err := ss.CheckOnline(service.Owner)
-			service.Active = (err == nil)
-		}
-		resp.ResultL = append(resp.ResultL, util.JsonEncode(service))
+		resp.ResultL = append(resp.ResultL, util.JsonEncode(ss.GetServiceInfo(service, peer)))
 		return nil
 	}
 }
 
-func (ss *SignalServer) CheckVerifyService(name string, pwdMd5 string) (*SignalService, error) {
-	if service, ok := ss.db.Services[name]; !ok {
+func (ss *SignalServer) CheckVerifyService(req *SignalRequest) (*SignalService, error) {
+	key := "service:" + req.ServiceName
+	if err := ss.CheckAuthLock(key, req.conn); err != nil {
+		ss.Warnf("service:%s, verify locked for %s\n", req.ServiceName, req.FromId)
+		return nil, err
+	}
+
+	if service, ok := ss.db.Services[req.ServiceName]; !ok {
 		return nil, errServiceNotExist
 	} else {
-		if !util.MD5SumVerify([]string{pwdMd5, service.Salt}, service.PwdMd5) {
-			ss.Warnf("service:%s, wrong password: %s:%s != %s\n", name, pwdMd5, service.Salt, service.PwdMd5)
+		if !util.MD5SumVerify([]string{req.ServicePwdMd5, service.Salt}, service.PwdMd5) {
+			ss.Warnf("service:%s, wrong password from %s\n", req.ServiceName, req.FromId)
+			ss.OnAuthResult(key, req.conn, false)
 			return nil, errWrongPassword
 		}
+		ss.OnAuthResult(key, req.conn, true)
 		return service, nil
 	}
 }
 
 func (ss *SignalServer) CheckJoinService(req *SignalRequest, resp *SignalResponse) error {
-	if peer, err := ss.CheckOnline(req.FromId); err != nil {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
 		return err
-	} else {
-		if service, err := ss.CheckVerifyService(req.ServiceName, req.ServicePwdMd5); err != nil {
-			return err
-		} else {
-			if service.Owner == req.FromId {
-				return errFnServiceInvalid("owner should not join/leave")
-			}
-			switch req.Action {
-			case kActionJoinService:
-				peer.InServices[req.ServiceName] = true
-			case kActionLeaveService:
-				if _, ok := peer.InServices[req.ServiceName]; ok {
-					peer.InServices[req.ServiceName] = false
-				}
+	}
+	service, ok := ss.db.Services[req.ServiceName]
+	if !ok {
+		return errServiceNotExist
+	}
+	if service.Owner == req.FromId {
+		return errFnServiceInvalid("owner should not join/leave")
+	}
+
+	switch req.Action {
+	case kActionJoinService:
+		return ss.JoinService(service, peer, req, resp)
+	case kActionLeaveService:
+		// member could leave without password(e.g. joined by invite)
+		if isIn := peer.InServices[req.ServiceName]; !isIn {
+			if _, err := ss.CheckVerifyService(req); err != nil {
+				return err
 			}
 		}
+		if _, ok := peer.InServices[req.ServiceName]; ok {
+			peer.InServices[req.ServiceName] = false
+		}
+		delete(service.Requests, req.FromId)
 	}
-
 	return nil
 }
 
@@ -354,7 +582,7 @@ func (ss *SignalServer) CreateService(req *SignalRequest, resp *SignalResponse)
 	}
 
 	if len(req.ServicePwdMd5) < 32 || len(req.ServiceSalt) < 4 {
-		ss.Warnf("service: %s, invalid password: %s:%s\n", req.ServiceName, req.ServicePwdMd5, req.ServiceSalt)
+		ss.Warnf("service: %s, invalid password from %s\n", req.ServiceName, req.FromId)
 		return errInvalidPassword
 	}
 
@@ -379,7 +607,7 @@ func (ss *SignalServer) RemoveService(req *SignalRequest, resp *SignalResponse)
 	if _, err := ss.CheckOnline(req.FromId); err != nil {
 		return err
 	} else {
-		if service, err := ss.CheckVerifyService(req.ServiceName, req.ServicePwdMd5); err != nil {
+		if service, err := ss.CheckVerifyService(req); err != nil {
 			return err
 		} else {
 			if service.Owner != req.FromId {
@@ -400,7 +628,7 @@ func (ss *SignalServer) CheckEnableService(req *SignalRequest, resp *SignalRespo
 		return err
 	}
 
-	if service, err := ss.CheckVerifyService(req.ServiceName, req.ServicePwdMd5); err != nil {
+	if service, err := ss.CheckVerifyService(req); err != nil {
 		return err
 	} else {
 		if service.Owner != req.FromId {
@@ -418,6 +646,75 @@ func (ss *SignalServer) CheckEnableService(req *SignalRequest, resp *SignalRespo
 	}
 }
 
+// verify online owner of service
+func (ss *SignalServer) CheckOwnerService(req *SignalRequest) (*SignalService, error) {
+	if _, err := ss.CheckOnline(req.FromId); err != nil {
+		return nil, err
+	}
+	if service, err := ss.CheckVerifyService(req); err != nil {
+		return nil, err
+	} else {
+		if service.Owner != req.FromId {
+			return nil, errServiceRequireOwner
+		}
+		return service, nil
+	}
+}
+
+// new password with new salt, members should rejoin if revoked
+func (ss *SignalServer) RotateServicePassword(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+	if len(req.NewPwdMd5) < 32 || len(req.ServiceSalt) < 4 {
+		return errInvalidPassword
+	}
+
+	service.PwdMd5 = util.MD5SumGenerate([]string{req.NewPwdMd5, req.ServiceSalt})
+	service.Salt = req.ServiceSalt
+	service.Invites = nil // invites are bound to old salt
+	if req.RevokeMembers {
+		for _, peer := range ss.db.Peers {
+			if isIn := peer.InServices[service.Name]; isIn {
+				peer.InServices[service.Name] = false
+				resp.ResultL = append(resp.ResultL, peer.Id)
+				ss.NotifyServiceRevoked(peer.Id, service, "password-rotated")
+			}
+		}
+	}
+	return nil
+}
+
+// remove member from service, and notify it to close tunnel
+func (ss *SignalServer) KickMember(req *SignalRequest, resp *SignalResponse) error {
+	service, err := ss.CheckOwnerService(req)
+	if err != nil {
+		return err
+	}
+
+	peer, ok := ss.db.Peers[req.ToId]
+	if !ok {
+		return errClientNotExist
+	}
+	if _, ok := peer.InServices[service.Name]; !ok {
+		return errServiceNotMember
+	}
+	delete(peer.InServices, service.Name)
+	ss.NotifyServiceRevoked(peer.Id, service, "kicked")
+	return nil
+}
+
+func (ss *SignalServer) NotifyServiceRevoked(id string, service *SignalService, reason string) {
+	ev := NewSignalResponse("")
+	ev.Event = kActionEventServiceRevoked
+	ev.FromId = service.Owner
+	ev.ServiceName = service.Name
+	ev.ResultM["reason"] = reason
+	ss.SendEvent(id, ev)
+	ss.OnTunnelClosed(id, service.Name, reason)
+}
+
 func (ss *SignalServer) CheckConnectService(req *SignalRequest, resp *SignalResponse) error {
 	if peer, err := ss.CheckOnline(req.FromId); err != nil {
 		return err
@@ -425,13 +722,17 @@ func (ss *SignalServer) CheckConnectService(req *SignalRequest, resp *SignalResp
 		if isIn, ok := peer.InServices[req.ServiceName]; !ok || !isIn {
 			return errServiceNotJoined
 		}
-		if service, err := ss.CheckVerifyService(req.ServiceName, req.ServicePwdMd5); err != nil {
-			return err
+		// membership is granted by password or invite, and revoked by owner
+		if service, ok := ss.db.Services[req.ServiceName]; !ok {
+			return errServiceNotExist
 		} else {
 			if service.Owner == req.FromId {
 				// owner donot need to connect/disconnect service
 				return errServiceShouldNotOwner
 			}
+			if err := service.CheckAcl(req.FromId); err != nil {
+				return err
+			}
 		}
 
 		switch req.Action {
@@ -452,12 +753,50 @@ func (ss *SignalServer) CheckOnIceStatus(req *SignalRequest, resp *SignalRespons
 
 func (ss *SignalServer) OnIceCandidate(req *SignalRequest, resp *SignalResponse) error {
 	resp.ResultM["ice-candidate"] = req.IceCandidate
+	if req.ConferenceId != 0 {
+		return ss.ForwardConferenceData(req, resp)
+	}
 	return ss.ForwardServiceData(req, resp)
 }
 
 func (ss *SignalServer) OnIceAuth(req *SignalRequest, resp *SignalResponse) error {
 	resp.ResultM["ice-ufrag"] = req.IceUfrag
 	resp.ResultM["ice-pwd"] = req.IcePwd
+	if req.ConferenceId != 0 {
+		return ss.ForwardConferenceData(req, resp)
+	}
+	return ss.ForwardServiceData(req, resp)
+}
+
+// offer/answer, dtls params are filled from sdp if not provided
+func (ss *SignalServer) OnSdp(req *SignalRequest, resp *SignalResponse) error {
+	if len(req.Sdp) == 0 {
+		return errSdpInvalid("empty")
+	}
+
+	info := ParseSdp(req.Sdp)
+	if len(req.DtlsFingerprint) == 0 {
+		req.DtlsFingerprint = info.Fingerprint
+	} else if len(info.Fingerprint) > 0 && !strings.EqualFold(req.DtlsFingerprint, info.Fingerprint) {
+		return errSdpInvalid("dtls fingerprint mismatch")
+	}
+	if len(req.DtlsSetup) == 0 {
+		req.DtlsSetup = info.Setup
+	} else if len(info.Setup) > 0 && req.DtlsSetup != info.Setup {
+		return errSdpInvalid("dtls setup mismatch")
+	}
+
+	if err := CheckDtlsFingerprint(req.DtlsFingerprint); err != nil {
+		return err
+	}
+	info.Setup = req.DtlsSetup
+	if err := info.CheckSetup(req.Action == kActionEventOffer); err != nil {
+		return err
+	}
+
+	resp.ResultM["sdp"] = req.Sdp
+	resp.ResultM["dtls-fingerprint"] = req.DtlsFingerprint
+	resp.ResultM["dtls-setup"] = req.DtlsSetup
 	return ss.ForwardServiceData(req, resp)
 }
 
@@ -470,19 +809,34 @@ func (ss *SignalServer) ForwardServiceData(req *SignalRequest, resp *SignalRespo
 		} else {
 			var toId string
 			if service.Owner == req.FromId {
+				// only to current and permitted member
 				toId = req.ToId
+				if member, ok := ss.db.Peers[toId]; !ok || !member.InServices[req.ServiceName] {
+					return errServiceNotJoined
+				}
+				if err := service.CheckAcl(toId); err != nil {
+					return err
+				}
 			} else {
-				if _, ok := peer.InServices[req.ServiceName]; !ok {
+				// false if revoked by owner
+				if !peer.InServices[req.ServiceName] {
 					return errServiceNotJoined
 				}
+				if err := service.CheckAcl(req.FromId); err != nil {
+					return err
+				}
 				toId = service.Owner
 			}
-			if conn, err := ss.CheckOnlineConn(toId); err != nil {
-				return err
-			} else {
-				resp.Event = req.Action
+			if conn, err := ss.CheckOnlineConn(toId); err == nil {
 				resp.conn = conn
+			} else if _, ok := ss.RemoteNode(toId); ok {
+				resp.toId = toId // by cluster
+			} else {
+				return err
 			}
+			resp.Event = req.Action
+			resp.FromId = req.FromId
+			resp.ServiceName = req.ServiceName
 		}
 		return nil
 	}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+const kTestPassword = "test-password"
+
+// signal server with empty db in memory
+func newTestSignalServer() *SignalServer {
+	ss := NewSignalServer()
+	ss.SetStore(NewMemoryStore())
+	ss.db = &SignalDatabase{
+		Peers:    make(map[string]*SignalPeer),
+		Services: make(map[string]*SignalService),
+	}
+	return ss
+}
+
+// connection without websocket, responses are read from ch_send
+func newTestConn(ss *SignalServer) *SignalConnection {
+	conn := &SignalConnection{ss: ss, ch_send: make(chan *SignalResponse, kSendQueueSize)}
+	ss.AddConnection(conn)
+	return conn
+}
+
+// send request and return its response, events before it are skipped
+func doTestRequest(t testing.TB, conn *SignalConnection, action string, req *SignalRequest) *SignalResponse {
+	t.Helper()
+	req.Action = action
+	req.Sequence = util.RandomString(8)
+	req.conn = conn
+	conn.ss.OnReceiveRequest(req)
+	for {
+		select {
+		case resp := <-conn.ch_send:
+			if resp.Sequence == req.Sequence && len(resp.Event) == 0 {
+				return resp
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no response", action)
+		}
+	}
+}
+
+func newTestPeer(t testing.TB, ss *SignalServer, id string, role string) *SignalConnection {
+	t.Helper()
+	conn := newTestConn(ss)
+	pwdMd5 := util.MD5SumGenerate([]string{kTestPassword})
+
+	req := NewSignalRequest(id)
+	req.PwdMd5 = pwdMd5
+	req.Salt = util.RandomString(4)
+	if resp := doTestRequest(t, conn, kActionRegister, req); len(resp.Error) > 0 {
+		t.Fatalf("register %s: %s", id, resp.Error)
+	}
+	if len(role) > 0 {
+		ss.db.Peers[id].Role = role
+	}
+
+	req = NewSignalRequest(id)
+	req.PwdMd5 = pwdMd5
+	if resp := doTestRequest(t, conn, kActionLogin, req); len(resp.Error) > 0 {
+		t.Fatalf("login %s: %s", id, resp.Error)
+	}
+	return conn
+}
+
+func TestSpoofFromId(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestPeer(t, ss, "admin", kRoleAdmin)
+	mallory := newTestPeer(t, ss, "mallory", "")
+	anonymous := newTestConn(ss)
+
+	for _, conn := range []*SignalConnection{mallory, anonymous} {
+		for _, action := range []string{kActionPeers, kActionSetRole, kActionAudit, kActionDisablePeer} {
+			req := NewSignalRequest("admin")
+			req.ToId = "mallory"
+			req.Role = kRoleAdmin
+			resp := doTestRequest(t, conn, action, req)
+			if resp.ErrorCode != ErrorCode(errClientNotLogin) {
+				t.Errorf("%s by %v as admin: error %q, want client-not-login", action, conn, resp.Error)
+			}
+		}
+	}
+	if role := ss.db.Peers["mallory"].GetRole(); role == kRoleAdmin {
+		t.Errorf("mallory escalated to %s", role)
+	}
+
+	// own id is still allowed
+	if resp := doTestRequest(t, mallory, kActionServices, NewSignalRequest("mallory")); len(resp.Error) > 0 {
+		t.Errorf("services by mallory: %s", resp.Error)
+	}
+}
+
+// owner and one member of service "svc"
+func newTestService(t *testing.T, ss *SignalServer) (owner, member *SignalConnection) {
+	t.Helper()
+	owner = newTestPeer(t, ss, "owner", "")
+	member = newTestPeer(t, ss, "member", "")
+
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	req.ServiceSalt = util.RandomString(4)
+	if resp := doTestRequest(t, owner, kActionCreateService, req); len(resp.Error) > 0 {
+		t.Fatalf("create-service: %s", resp.Error)
+	}
+
+	req = NewSignalRequest("member")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	if resp := doTestRequest(t, member, kActionJoinService, req); len(resp.Error) > 0 {
+		t.Fatalf("join-service: %s", resp.Error)
+	}
+	return
+}
+
+func TestRevokedMemberForward(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, member := newTestService(t, ss)
+
+	req := NewSignalRequest("member")
+	req.ServiceName = "svc"
+	if resp := doTestRequest(t, member, kActionEventIceOpen, req); len(resp.Error) > 0 {
+		t.Fatalf("ice-open by member: %s", resp.Error)
+	}
+
+	req = NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	req.NewPwdMd5 = util.MD5SumGenerate([]string{"new-password"})
+	req.ServiceSalt = util.RandomString(4)
+	req.RevokeMembers = true
+	if resp := doTestRequest(t, owner, kActionRotateServicePassword, req); len(resp.Error) > 0 {
+		t.Fatalf("rotate-service-password: %s", resp.Error)
+	}
+
+	for _, action := range []string{kActionEventIceOpen, kActionEventIceAuth, kActionEventIceCandidate} {
+		req := NewSignalRequest("member")
+		req.ServiceName = "svc"
+		resp := doTestRequest(t, member, action, req)
+		if resp.ErrorCode != ErrorCode(errServiceNotJoined) {
+			t.Errorf("%s by revoked member: error %q, want service-not-joined", action, resp.Error)
+		}
+	}
+}
+
+func TestAclForward(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, member := newTestService(t, ss)
+	newTestPeer(t, ss, "other", "")
+
+	// member is not in new allowlist
+	req := NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ServicePwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	req.ToId = "other"
+	if resp := doTestRequest(t, owner, kActionAllowPeer, req); len(resp.Error) > 0 {
+		t.Fatalf("allow-peer: %s", resp.Error)
+	}
+
+	req = NewSignalRequest("member")
+	req.ServiceName = "svc"
+	if resp := doTestRequest(t, member, kActionEventIceOpen, req); resp.ErrorCode != ErrorCode(errServiceNotAllowed) {
+		t.Errorf("ice-open by member: error %q, want service-not-allowed", resp.Error)
+	}
+
+	req = NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ToId = "member"
+	if resp := doTestRequest(t, owner, kActionEventIceAuth, req); resp.ErrorCode != ErrorCode(errServiceNotAllowed) {
+		t.Errorf("ice-auth to member: error %q, want service-not-allowed", resp.Error)
+	}
+
+	// other is allowed but never joined
+	req = NewSignalRequest("owner")
+	req.ServiceName = "svc"
+	req.ToId = "other"
+	if resp := doTestRequest(t, owner, kActionEventIceAuth, req); resp.ErrorCode != ErrorCode(errServiceNotJoined) {
+		t.Errorf("ice-auth to non-member: error %q, want service-not-joined", resp.Error)
+	}
+}
+
+// errors only, also called in Query
+func checkTestAdminPassword(t *testing.T, ss *SignalServer, id, pwd string) {
+	t.Helper()
+	peer := ss.db.Peers[id]
+	if peer == nil || peer.Role != kRoleAdmin {
+		t.Errorf("no admin %s", id)
+		return
+	}
+	pwdMd5 := util.MD5SumGenerate([]string{pwd})
+	if util.MD5SumGenerate([]string{pwdMd5, peer.Salt}) != peer.PwdMd5 {
+		t.Errorf("admin password mismatch")
+	}
+}
+
+// generated password is only in owner's file, a planted symlink is never followed
+func TestBootstrapPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "admin.pwd")
+	if err := os.Symlink(target, fname); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := newTestSignalServer()
+	if err := ss.Bootstrap(kDefaultAdminId, kRegisterInvite, fname); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "keep" {
+		t.Fatalf("symlink followed: %q", data)
+	}
+	info, err := os.Lstat(fname)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0600 {
+		t.Fatalf("password file: %v, %v", info, err)
+	}
+	data, _ := os.ReadFile(fname)
+	pwd := strings.TrimSpace(string(data))
+	checkTestAdminPassword(t, ss, kDefaultAdminId, pwd)
+	if ss.db.RegisterMode != kRegisterInvite {
+		t.Fatalf("register mode: %s", ss.db.RegisterMode)
+	}
+
+	// admin existed, file is untouched
+	if err := ss.Bootstrap(kDefaultAdminId, "", fname); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(fname); strings.TrimSpace(string(data)) != pwd {
+		t.Fatalf("password file rewritten")
+	}
+}
+
+func TestBootstrapPasswordEnv(t *testing.T) {
+	t.Setenv(kEnvAdminPassword, kTestPassword)
+	fname := filepath.Join(t.TempDir(), "admin.pwd")
+	ss := newTestSignalServer()
+	if err := ss.Bootstrap(kDefaultAdminId, "", fname); err != nil {
+		t.Fatal(err)
+	}
+	checkTestAdminPassword(t, ss, kDefaultAdminId, kTestPassword)
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatalf("password file written: %v", err)
+	}
+}
+
+// admin is not created when its password can not be saved
+func TestBootstrapPasswordFileError(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "nodir", "admin.pwd")
+	ss := newTestSignalServer()
+	if err := ss.Bootstrap(kDefaultAdminId, "", fname); err == nil {
+		t.Fatal("bootstrap without password file")
+	}
+	if _, ok := ss.db.Peers[kDefaultAdminId]; ok {
+		t.Fatal("admin created with lost password")
+	}
+}
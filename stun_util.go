@@ -1,8 +1,166 @@
 package main
 
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+
+	util "github.com/PeterXu/goutil"
+)
+
+// packet type of shared port by first byte(RFC 7983)
+const (
+	kPacketUnknown = iota
+	kPacketStun
+	kPacketDtls
+	kPacketRtp // rtp or rtcp
+)
+
+func DemuxPacket(data []byte) int {
+	if len(data) == 0 {
+		return kPacketUnknown
+	}
+	switch b := data[0]; {
+	case b <= 3:
+		return kPacketStun
+	case b >= 20 && b <= 63:
+		return kPacketDtls
+	case b >= 128 && b <= 191:
+		return kPacketRtp
+	default:
+		return kPacketUnknown
+	}
+}
+
+// ice session negotiated by offer/answer, keyed by local ufrag
 type StunInfo struct {
 	cid   uint32
 	uid   string
 	offer string
 	ctime int64
+
+	service     string
+	localUfrag  string
+	localPwd    string
+	remoteUfrag string
+	remotePwd   string
+}
+
+func NewStunInfo(uid, offer string) *StunInfo {
+	return &StunInfo{
+		uid:   uid,
+		offer: offer,
+		ctime: util.NowMs(),
+	}
+}
+
+// username of binding request from remote: "localUfrag:remoteUfrag"
+func (s *StunInfo) getStunName() string {
+	return s.localUfrag + ":" + s.remoteUfrag
+}
+
+// stun message of RFC 5389, verified before Connection is created or refreshed
+const (
+	kStunHeaderSize      = 20
+	kStunMagicCookie     = 0x2112A442
+	kStunBindingError    = 0x0111
+	kStunAttrErrorCode   = 0x0009
+	kStunAttrIntegrity   = 0x0008
+	kStunAttrFingerprint = 0x8028
+	kStunIntegritySize   = 20 // hmac-sha1
+	kStunFingerprintXor  = 0x5354554e
+)
+
+// check MESSAGE-INTEGRITY by short-term pwd, and FINGERPRINT.
+// both are required, as browsers always send them.
+func VerifyStunMessage(data []byte, pwd string) error {
+	if len(data) < kStunHeaderSize || binary.BigEndian.Uint32(data[4:]) != kStunMagicCookie ||
+		kStunHeaderSize+int(binary.BigEndian.Uint16(data[2:])) != len(data) {
+		return errStunInvalid
+	}
+
+	integrity, fingerprint := false, false
+	for offset := kStunHeaderSize; offset+4 <= len(data); {
+		atype := binary.BigEndian.Uint16(data[offset:])
+		alen := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 4 + alen
+		if end > len(data) {
+			return errStunInvalid
+		}
+
+		switch atype {
+		case kStunAttrIntegrity:
+			if integrity || alen != kStunIntegritySize {
+				return errStunInvalid
+			}
+			mac := hmac.New(sha1.New, []byte(pwd))
+			mac.Write(stunHeaderOfLength(data, end))
+			mac.Write(data[kStunHeaderSize:offset])
+			if len(pwd) == 0 || !hmac.Equal(mac.Sum(nil), data[offset+4:end]) {
+				return errStunUnauthorized
+			}
+			integrity = true
+		case kStunAttrFingerprint:
+			// the last attribute
+			if alen != 4 || end != len(data) {
+				return errStunInvalid
+			}
+			crc := crc32.NewIEEE()
+			crc.Write(stunHeaderOfLength(data, end))
+			crc.Write(data[kStunHeaderSize:offset])
+			if crc.Sum32()^kStunFingerprintXor != binary.BigEndian.Uint32(data[offset+4:]) {
+				return errStunInvalid
+			}
+			fingerprint = true
+		default:
+			// attributes after integrity are ignored, except fingerprint
+		}
+		offset += 4 + (alen+3)&^3
+	}
+
+	if !fingerprint {
+		return errStunInvalid
+	}
+	if !integrity {
+		return errStunUnauthorized
+	}
+	return nil
+}
+
+// header with length of message ending at end, for integrity/fingerprint
+func stunHeaderOfLength(data []byte, end int) []byte {
+	header := make([]byte, kStunHeaderSize)
+	copy(header, data[:kStunHeaderSize])
+	binary.BigEndian.PutUint16(header[2:], uint16(end-kStunHeaderSize))
+	return header
+}
+
+// binding error response with ERROR-CODE and FINGERPRINT, e.g. 401 Unauthorized
+func GenStunErrorResponse(request []byte, code int, reason string) []byte {
+	value := make([]byte, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	copy(value[4:], reason)
+
+	data := make([]byte, kStunHeaderSize, kStunHeaderSize+4+len(value)+3+8)
+	binary.BigEndian.PutUint16(data[0:], kStunBindingError)
+	copy(data[4:], request[4:kStunHeaderSize]) // cookie and transaction id
+	data = appendStunAttribute(data, kStunAttrErrorCode, value)
+
+	crc := crc32.ChecksumIEEE(stunHeaderOfLength(data, len(data)+8)) // length with fingerprint
+	crc = crc32.Update(crc, crc32.IEEETable, data[kStunHeaderSize:])
+	fingerprint := make([]byte, 4)
+	binary.BigEndian.PutUint32(fingerprint, crc^kStunFingerprintXor)
+	data = appendStunAttribute(data, kStunAttrFingerprint, fingerprint)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data)-kStunHeaderSize))
+	return data
+}
+
+func appendStunAttribute(data []byte, atype uint16, value []byte) []byte {
+	attr := make([]byte, 4+(len(value)+3)&^3)
+	binary.BigEndian.PutUint16(attr[0:], atype)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	copy(attr[4:], value)
+	return append(data, attr...)
 }
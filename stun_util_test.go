@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// sample request of RFC 5769 2.1, with integrity and fingerprint
+const (
+	kTestStunPwd     = "VOkJxbRl1RmTxUk/WvJxBt"
+	kTestStunRequest = "000100582112a442b7e7a701bc34d686fa87dfae" +
+		"802200105354554e207465737420636c69656e74" +
+		"002400046e0001ff" +
+		"80290008932ff9b151263b36" +
+		"000600096576746a3a68367659202020" +
+		"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a2" +
+		"80280004e57a3bcf"
+)
+
+func newTestStunRequest(t *testing.T) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(kTestStunRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyStunMessage(t *testing.T) {
+	if err := VerifyStunMessage(newTestStunRequest(t), kTestStunPwd); err != nil {
+		t.Fatalf("valid request: %v", err)
+	}
+
+	if err := VerifyStunMessage(newTestStunRequest(t), "wrong-password"); err != errStunUnauthorized {
+		t.Errorf("wrong password: %v, want unauthorized", err)
+	}
+	if err := VerifyStunMessage(newTestStunRequest(t), ""); err != errStunUnauthorized {
+		t.Errorf("empty password: %v, want unauthorized", err)
+	}
+
+	// username changed
+	data := newTestStunRequest(t)
+	data[strings.Index(kTestStunRequest, "6576746a")/2] ^= 1
+	if err := VerifyStunMessage(data, kTestStunPwd); err != errStunUnauthorized {
+		t.Errorf("tampered username: %v, want unauthorized", err)
+	}
+
+	// fingerprint changed
+	data = newTestStunRequest(t)
+	data[len(data)-1] ^= 1
+	if err := VerifyStunMessage(data, kTestStunPwd); err != errStunInvalid {
+		t.Errorf("tampered fingerprint: %v, want invalid", err)
+	}
+
+	// without integrity and fingerprint
+	data = newTestStunRequest(t)[:strings.Index(kTestStunRequest, "00080014")/2]
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data)-kStunHeaderSize))
+	if err := VerifyStunMessage(data, kTestStunPwd); err == nil {
+		t.Error("request without integrity is verified")
+	}
+
+	if err := VerifyStunMessage(data[:10], kTestStunPwd); err != errStunInvalid {
+		t.Errorf("short message: %v, want invalid", err)
+	}
+}
+
+func TestGenStunErrorResponse(t *testing.T) {
+	request := newTestStunRequest(t)
+	resp := GenStunErrorResponse(request, 401, "Unauthorized")
+
+	if binary.BigEndian.Uint16(resp) != kStunBindingError {
+		t.Errorf("type: %x", binary.BigEndian.Uint16(resp))
+	}
+	if string(resp[8:20]) != string(request[8:20]) {
+		t.Error("transaction id mismatch")
+	}
+	if resp[kStunHeaderSize+6] != 4 || resp[kStunHeaderSize+7] != 1 {
+		t.Errorf("error code: %d%02d", resp[kStunHeaderSize+6], resp[kStunHeaderSize+7])
+	}
+	// valid fingerprint, and no integrity
+	if err := VerifyStunMessage(resp, kTestStunPwd); err != errStunUnauthorized {
+		t.Errorf("verify response: %v, want unauthorized", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"sync"
@@ -30,6 +31,7 @@ func (s *tcpService) OnOpened(c gn.Conn) (out []byte, action gn.Action) {
 func (s *tcpService) OnClosed(c gn.Conn, err error) (action gn.Action) {
 	log.Printf("TCP socket with addr: %s is closing...\n", c.RemoteAddr().String())
 	s.clientSockets.Delete(c.RemoteAddr().String())
+	fireEvent("tcp", evData{"conn": c, "closed": true}, "")
 	return
 }
 
@@ -39,10 +41,35 @@ func (s *tcpService) Tick() (delay time.Duration, action gn.Action) {
 	return
 }
 
+// frame is decoded by rfc4571 codec(without length field)
 func (s *tcpService) React(frame []byte, c gn.Conn) (out []byte, action gn.Action) {
+	if len(frame) > 0 {
+		data := make([]byte, len(frame))
+		copy(data, frame)
+		fireEvent("tcp", evData{"conn": c, "data": data}, "")
+	}
 	return
 }
 
+// RFC 4571: 16-bit length(big-endian) before each stun/dtls packet,
+// AsyncWrite of conn would add the length field.
+func newRfc4571Codec() gn.ICodec {
+	encoderConfig := gn.EncoderConfig{
+		ByteOrder:                       binary.BigEndian,
+		LengthFieldLength:               2,
+		LengthAdjustment:                0,
+		LengthIncludesLengthFieldLength: false,
+	}
+	decoderConfig := gn.DecoderConfig{
+		ByteOrder:           binary.BigEndian,
+		LengthFieldOffset:   0,
+		LengthFieldLength:   2,
+		LengthAdjustment:    0,
+		InitialBytesToStrip: 2,
+	}
+	return gn.NewLengthFieldBasedFrameCodec(encoderConfig, decoderConfig)
+}
+
 func startTcpService(port int, intervalMs int) {
 	multicore := false
 	ticker := false
@@ -57,5 +84,6 @@ func startTcpService(port int, intervalMs int) {
 	log.Fatal(gn.Serve(service, addr,
 		gn.WithMulticore(multicore),
 		gn.WithTicker(ticker),
-		gn.WithReusePort(reuseport)))
+		gn.WithReusePort(reuseport),
+		gn.WithCodec(newRfc4571Codec())))
 }
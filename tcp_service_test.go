@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	gn "github.com/panjf2000/gnet"
+)
+
+// inbound stream of tcp conn, other methods are never called by codec
+type testStreamConn struct {
+	gn.Conn
+	buf []byte
+}
+
+func (c *testStreamConn) Read() []byte      { return c.buf }
+func (c *testStreamConn) ResetBuffer()      { c.buf = nil }
+func (c *testStreamConn) BufferLength() int { return len(c.buf) }
+
+func (c *testStreamConn) ReadN(n int) (int, []byte) {
+	if n > len(c.buf) {
+		n = len(c.buf)
+	}
+	return n, c.buf[:n]
+}
+
+func (c *testStreamConn) ShiftN(n int) int {
+	if n > len(c.buf) {
+		n = len(c.buf)
+	}
+	c.buf = c.buf[n:]
+	return n
+}
+
+// decode all complete frames, as done by event loop after each read
+func decodeTestFrames(t *testing.T, codec gn.ICodec, c *testStreamConn) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for {
+		frame, err := codec.Decode(c)
+		if err != nil || frame == nil {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestRfc4571Framing(t *testing.T) {
+	codec := newRfc4571Codec()
+	packets := [][]byte{
+		append([]byte{0x00, 0x01, 0x00, 0x00}, bytes.Repeat([]byte{0x21}, 16)...), // stun
+		append([]byte{0x16, 0xfe, 0xfd}, bytes.Repeat([]byte{0x01}, 300)...),      // dtls
+		{0x17},
+	}
+
+	var stream []byte
+	for _, packet := range packets {
+		out, err := codec.Encode(nil, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(packet)+2 || int(binary.BigEndian.Uint16(out)) != len(packet) ||
+			!bytes.Equal(out[2:], packet) {
+			t.Fatalf("encoded frame: % x", out)
+		}
+		stream = append(stream, out...)
+	}
+
+	// one read of all frames, or frames split across reads
+	for _, chunk := range []int{len(stream), 1, 3, 7, 200} {
+		c := &testStreamConn{}
+		var frames [][]byte
+		for pos := 0; pos < len(stream); pos += chunk {
+			end := pos + chunk
+			if end > len(stream) {
+				end = len(stream)
+			}
+			c.buf = append(c.buf, stream[pos:end]...)
+			frames = append(frames, decodeTestFrames(t, codec, c)...)
+		}
+		if len(frames) != len(packets) {
+			t.Fatalf("chunk %d: %d frames, want %d", chunk, len(frames), len(packets))
+		}
+		for i := range frames {
+			if !bytes.Equal(frames[i], packets[i]) {
+				t.Errorf("chunk %d: frame %d is % x", chunk, i, frames[i])
+			}
+		}
+		if c.BufferLength() != 0 {
+			t.Errorf("chunk %d: %d bytes left", chunk, c.BufferLength())
+		}
+	}
+}
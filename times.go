@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	util "github.com/PeterXu/goutil"
 )
 
@@ -28,3 +30,11 @@ func (ti *TimeInfo) isTimeout(timeout int) bool {
 func (ti *TimeInfo) sinceLastUpdate() int {
 	return int(util.NowMs() - ti.utime)
 }
+
+// local time of ms, "-" if zero
+func FormatTimeMs(ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+}
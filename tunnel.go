@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Local tunnel operations, a tunnel is one active LocalService(service@peer)
+ */
+
+func (e *Endpoint) GetTunnelStats() []*LocalServiceStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var items []*LocalServiceStats
+	for _, db := range e.services {
+		for _, item := range db.items {
+			items = append(items, item.GetStats())
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Service != items[j].Service {
+			return items[i].Service < items[j].Service
+		}
+		return items[i].PeerId < items[j].PeerId
+	})
+	return items
+}
+
+func (e *Endpoint) Tunnels(action string, params []string) (*Result, error) {
+	if len(params) != 0 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	items := e.GetTunnelStats()
+	var lines []string
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("%s@%s - %s, up %v, streams %d",
+			item.Service, item.PeerId, item.Role, time.Duration(item.Uptime)*time.Second, item.Streams))
+	}
+	return NewResultValue(strings.Join(lines, "\n"), items), nil
+}
+
+func (e *Endpoint) TunnelStats(action string, params []string) (*Result, error) {
+	if len(params) != 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	item := e.GetLocalService(params[0], params[1])
+	if item == nil {
+		return nil, errTunnelNotExist
+	}
+
+	stats := item.GetStats()
+	lines := []string{
+		fmt.Sprintf("service: %s", stats.Service),
+		fmt.Sprintf("peer: %s", stats.PeerId),
+		fmt.Sprintf("role: %s", stats.Role),
+		fmt.Sprintf("bind: %s", stats.Bind),
+		fmt.Sprintf("candidate pair: %s", stats.CandidatePair),
+		fmt.Sprintf("bytes in/out: %d/%d", stats.BytesIn, stats.BytesOut),
+		fmt.Sprintf("streams: %d", stats.Streams),
+		fmt.Sprintf("uptime: %v", time.Duration(stats.Uptime)*time.Second),
+	}
+	return NewResultValue(strings.Join(lines, "\n"), stats), nil
+}
+
+// close local tunnel and notify remote peer
+func (e *Endpoint) CloseTunnel(action string, params []string) (*Result, error) {
+	if len(params) != 2 {
+		return nil, errFnInvalidParamters(params)
+	}
+
+	name, peerId := params[0], params[1]
+	if e.GetLocalService(name, peerId) == nil {
+		return nil, errTunnelNotExist
+	}
+	e.CheckOpenLocalService("ev_close", name, peerId)
+
+	req := NewSignalRequest(e.signal.id)
+	req.ToId = peerId
+	req.ServiceName = name
+	if _, err := e.signal.SendRequest(kActionEventIceClose, req); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// close all local tunnels of service, e.g. members revoked
+func (e *Endpoint) CloseServiceTunnels(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if db, ok := e.services[name]; ok {
+		for srvId, item := range db.items {
+			item.Uninit()
+			delete(db.items, srvId)
+		}
+		e.refreshCompleterTunnels()
+	}
+}
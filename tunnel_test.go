@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+)
+
+const (
+	kTestTunnelService = "tunnel-echo"
+	kTestTunnelTimeout = 15 * time.Second
+	kTestTunnelPollMs  = 100
+	kTestTunnelStreams = 4
+
+	kTestStunIp             = "1.2.3.100"
+	kTestStunPort           = "3478"
+	kTestStunBindingRequest = 0x0001
+	kTestStunBindingSuccess = 0x0101
+	kTestStunAttrXorMapped  = 0x0020
+)
+
+// virtual networks of server and client agents by mode:
+// lan, both on one router; nat1to1, each behind 1:1 nat of wan without port
+// mapping; nat-eim, each behind port-restricted cone nat(endpoint-independent
+// mapping, address/port-dependent filtering) and connected by server reflexive;
+// nat-apdm, server behind symmetric nat(address/port-dependent mapping) and
+// client behind full cone nat, connected by peer reflexive.
+func newTestTunnelNets(t *testing.T, mode string) (server, client *IceNet) {
+	t.Helper()
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "1.2.3.0/24",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stun server on wan, for server reflexive candidates
+	stunNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{kTestStunIp}})
+	if err := wan.AddNet(stunNet); err != nil {
+		t.Fatal(err)
+	}
+	stunUrls := []string{"stun:" + kTestStunIp + ":" + kTestStunPort}
+
+	// public ip of wan, and private ip of lan if nat
+	addNet := func(publicIp, privateIp, cidr string, natType *vnet.NATType) *IceNet {
+		if natType == nil {
+			nw := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{publicIp}})
+			if err := wan.AddNet(nw); err != nil {
+				t.Fatal(err)
+			}
+			return &IceNet{Net: nw}
+		}
+		config := &vnet.RouterConfig{
+			StaticIPs:     []string{publicIp},
+			CIDR:          cidr,
+			NATType:       natType,
+			LoggerFactory: loggerFactory,
+		}
+		if natType.Mode == vnet.NATModeNAT1To1 {
+			config.StaticIPs = []string{publicIp + "/" + privateIp}
+		}
+		lan, err := vnet.NewRouter(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nw := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{privateIp}})
+		if err := lan.AddNet(nw); err != nil {
+			t.Fatal(err)
+		}
+		if err := wan.AddRouter(lan); err != nil {
+			t.Fatal(err)
+		}
+		if natType.Mode == vnet.NATModeNAT1To1 {
+			return &IceNet{Net: nw, NAT1To1IPs: []string{publicIp}}
+		}
+		return &IceNet{Net: nw, StunUrls: stunUrls}
+	}
+
+	var serverNat, clientNat *vnet.NATType
+	switch mode {
+	case "nat1to1":
+		serverNat = &vnet.NATType{Mode: vnet.NATModeNAT1To1}
+		clientNat = serverNat
+	case "nat-eim":
+		serverNat = &vnet.NATType{
+			Mode:              vnet.NATModeNormal,
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		}
+		clientNat = serverNat
+	case "nat-apdm":
+		serverNat = &vnet.NATType{
+			Mode:              vnet.NATModeNormal,
+			MappingBehavior:   vnet.EndpointAddrPortDependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		}
+		clientNat = &vnet.NATType{
+			Mode:              vnet.NATModeNormal,
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		}
+	}
+	server = addNet("1.2.3.4", "10.1.0.4", "10.1.0.0/24", serverNat)
+	client = addNet("1.2.3.5", "10.2.0.5", "10.2.0.0/24", clientNat)
+	if err := wan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wan.Stop() })
+	startTestStun(t, stunNet)
+	return
+}
+
+// stun server of binding request, replies xor-mapped-address
+func startTestStun(t *testing.T, nw *vnet.Net) {
+	t.Helper()
+	conn, err := nw.ListenPacket("udp4", kTestStunIp+":"+kTestStunPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < kStunHeaderSize || binary.BigEndian.Uint16(buf) != kTestStunBindingRequest {
+				continue
+			}
+			udpAddr, ok := addr.(*net.UDPAddr)
+			if !ok || udpAddr.IP.To4() == nil {
+				continue
+			}
+
+			// family ipv4, port and ip xor by magic cookie
+			value := make([]byte, 8)
+			value[1] = 0x01
+			binary.BigEndian.PutUint16(value[2:], uint16(udpAddr.Port)^uint16(kStunMagicCookie>>16))
+			binary.BigEndian.PutUint32(value[4:], binary.BigEndian.Uint32(udpAddr.IP.To4())^kStunMagicCookie)
+
+			resp := make([]byte, kStunHeaderSize)
+			binary.BigEndian.PutUint16(resp[0:], kTestStunBindingSuccess)
+			copy(resp[4:], buf[4:kStunHeaderSize]) // cookie and transaction id
+			resp = appendStunAttribute(resp, kTestStunAttrXorMapped, value)
+			binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)-kStunHeaderSize))
+			conn.WriteTo(resp, addr)
+		}
+	}()
+}
+
+// tcp echo on random port of 127.0.0.1
+func startTestEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// free tcp port of 127.0.0.1, for listener of requester
+func getTestFreeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// poll fn until nil or timeout
+func pollTest(t *testing.T, name string, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(kTestTunnelTimeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %v", name, err)
+		}
+		time.Sleep(kTestTunnelPollMs * time.Millisecond)
+	}
+}
+
+// write payload to tunnel and read it back
+func roundTripTest(addr string, payload []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write(payload)
+	data := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return err
+	}
+	if !bytes.Equal(data, payload) {
+		return fmt.Errorf("echo mismatch: %d bytes", len(data))
+	}
+	return nil
+}
+
+func tunnelsTest(ep *Endpoint, expect int) func() error {
+	return func() error {
+		if n := len(ep.GetTunnelStats()); n != expect {
+			return fmt.Errorf("tunnels: %d, expect: %d", n, expect)
+		}
+		return nil
+	}
+}
+
+/**
+ * Full tunnel flow on loopback signal and pion vnet
+ *	a. register -> login -> create/join/enable/connect-service
+ *	b. concurrent streams of data round-trip by tunnel
+ *	c. disconnect-service -> tunnels closed
+ */
+func TestTunnelFlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("integration of signal, ice and gnet")
+	}
+	for _, mode := range []string{"lan", "nat1to1", "nat-eim", "nat-apdm"} {
+		t.Run(mode, func(t *testing.T) {
+			testTunnelFlow(t, mode)
+		})
+	}
+}
+
+func testTunnelFlow(t *testing.T, mode string) {
+	if !testing.Verbose() {
+		writer := log.Writer()
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(writer)
+	}
+
+	ss, sigaddr, err := StartLoopbackSignal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Shutdown(time.Second)
+	echoAddr := startTestEcho(t)
+	serverNet, clientNet := newTestTunnelNets(t, mode)
+
+	server := NewServer(sigaddr)
+	server.ep.SetIceNet(serverNet)
+	client := NewClient(sigaddr)
+	client.ep.SetIceNet(clientNet)
+	clientAddr := getTestFreeAddr(t)
+
+	run := func(ep *Endpoint, parts ...string) {
+		t.Helper()
+		if _, err := ep.RunCommand(parts); err != nil {
+			t.Fatalf("%s: %v", strings.Join(parts, " "), err)
+		}
+	}
+	ids := util.RandomString(6)
+	serverId, clientId := "owner-"+ids, "member-"+ids
+
+	run(server.ep, kActionConnect, sigaddr)
+	run(client.ep, kActionConnect, sigaddr)
+	pollTest(t, "server connected", func() error { return server.ep.signal.CheckOnline(false) })
+	pollTest(t, "client connected", func() error { return client.ep.signal.CheckOnline(false) })
+	defer run(server.ep, kActionDisconnect)
+	defer run(client.ep, kActionDisconnect)
+
+	run(server.ep, kActionRegister, serverId, kTestPassword)
+	run(client.ep, kActionRegister, clientId, kTestPassword)
+	run(server.ep, kActionLogin, serverId, kTestPassword)
+	run(client.ep, kActionLogin, clientId, kTestPassword)
+	run(server.ep, kActionCreateService, kTestTunnelService, kTestPassword, "echo")
+	run(server.ep, kActionBindService, kTestTunnelService, "tcp", echoAddr)
+	run(server.ep, kActionEnableService, kTestTunnelService, kTestPassword)
+	run(client.ep, kActionJoinService, kTestTunnelService, kTestPassword)
+	run(client.ep, kActionBindService, kTestTunnelService, "tcp", clientAddr)
+	run(client.ep, kActionConnectService, kTestTunnelService, kTestPassword)
+
+	pollTest(t, "server tunnels", tunnelsTest(server.ep, 1))
+	pollTest(t, "client tunnels", tunnelsTest(client.ep, 1))
+
+	// listening after ice connected
+	payload := []byte(strings.Repeat("netpie-tunnel ", 256))
+	pollTest(t, "round-trip", func() error { return roundTripTest(clientAddr, payload) })
+
+	// streams of one tunnel are independent
+	var wg sync.WaitGroup
+	errs := make(chan error, kTestTunnelStreams)
+	for i := 0; i < kTestTunnelStreams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(strings.Repeat(fmt.Sprintf("stream-%d ", i), 8*1024))
+			errs <- roundTripTest(clientAddr, data)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent round-trip: %v", err)
+		}
+	}
+
+	run(client.ep, kActionDisconnectService, kTestTunnelService, kTestPassword)
+	pollTest(t, "server tunnels closed", tunnelsTest(server.ep, 0))
+	pollTest(t, "client tunnels closed", tunnelsTest(client.ep, 0))
+
+	run(client.ep, kActionLogout)
+	run(server.ep, kActionLogout)
+}
+
+// tunnels/tunnel-stats/close-tunnel on local services, without ice
+func TestTunnelCommands(t *testing.T) {
+	e := NewEndpoint(nil, false)
+	e.signal = NewSignalClient()
+	e.signal.id = "me"
+	e.cc = NewShellCompleter()
+	e.cc.Init(false)
+
+	db := NewLocalServiceDB()
+	for _, peerId := range []string{"peer2", "peer1"} {
+		item := NewLocalService("svc", peerId, false)
+		item.proto, item.addr = "tcp", "127.0.0.1:22"
+		db.items[e.GetLocalServiceKey(peerId)] = item
+	}
+	e.services["svc"] = db
+
+	if _, err := e.Tunnels(kActionTunnels, []string{"svc"}); err == nil {
+		t.Error("tunnels with params")
+	}
+	ret, err := e.Tunnels(kActionTunnels, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := ret.Value().([]*LocalServiceStats)
+	if len(items) != 2 || items[0].PeerId != "peer1" || items[1].PeerId != "peer2" {
+		t.Fatalf("tunnels: %v", ret.Value())
+	}
+	if items[0].Role != kLocalRoleProvider || items[0].Bind != "tcp://127.0.0.1:22" {
+		t.Errorf("tunnel: role %s, bind %s", items[0].Role, items[0].Bind)
+	}
+
+	if _, err := e.TunnelStats(kActionTunnelStats, []string{"svc", "nobody"}); err != errTunnelNotExist {
+		t.Errorf("stats of unknown: %v", err)
+	}
+	if ret, err = e.TunnelStats(kActionTunnelStats, []string{"svc", "peer1"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := ret.Value().(*LocalServiceStats); stats == nil || stats.Service != "svc" || stats.PeerId != "peer1" {
+		t.Errorf("stats: %v", ret.Value())
+	}
+	if _, err := e.CloseTunnel(kActionCloseTunnel, []string{"svc", "nobody"}); err != errTunnelNotExist {
+		t.Errorf("close unknown: %v", err)
+	}
+
+	e.CloseServiceTunnels("svc")
+	if items := e.GetTunnelStats(); len(items) != 0 {
+		t.Errorf("tunnels after closed: %d", len(items))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	kTunnelPacketData = 1
+	kTunnelPacketAck  = 2
+
+	kTunnelStreamOpen  = 1
+	kTunnelStreamData  = 2
+	kTunnelStreamClose = 3
+
+	kTunnelPacketHeader = 5 // type + seq/ack
+	kTunnelStreamHeader = 5 // kind + stream id
+	kTunnelMaxChunk     = kIceMaxPayload - kTunnelPacketHeader - kTunnelStreamHeader
+
+	kTunnelWindow     = 128             // packets in flight
+	kTunnelMaxPending = 4 * 1024 * 1024 // bytes queued or in flight
+	kTunnelRto        = 200 * time.Millisecond
+	kTunnelMaxRto     = 3 * time.Second
+	kTunnelMaxRetries = 10
+	kTunnelTickMs     = 20
+)
+
+/**
+ * Reliable and ordered transport of tunnel, over ice conn(udp)
+ *	a. data packet: type(1) + seq(4) + kind(1) + stream id(4) + data,
+ *	   ack packet: type(1) + next expected seq(4)
+ *	b. selective repeat, retransmit by rto with backoff,
+ *	   closed if one packet is retransmitted too many times
+ *	c. receiver reorders by seq, and messages are delivered in order
+ *	d. streams(open/data/close) are multiplexed by stream id
+ *	e. Send never blocks, errTunnelBusy if too many bytes pending
+ */
+type TunnelConn struct {
+	mu        sync.Mutex
+	write     func(pkt []byte) error
+	onMessage func(kind byte, id uint32, data []byte)
+	onClose   func()
+
+	// sender
+	nextSeq  uint32
+	queue    []*tunnelPacket // not sent yet
+	inflight map[uint32]*tunnelPacket
+	pending  int
+
+	// receiver
+	expected uint32
+	received map[uint32][]byte
+
+	closed  bool
+	ch_done chan struct{}
+}
+
+type tunnelPacket struct {
+	seq     uint32
+	data    []byte
+	sent    time.Time
+	rto     time.Duration
+	retries int
+}
+
+// write sends one unreliable packet, onMessage is called in order by Input,
+// onClose is called once if the remote is unreachable.
+func NewTunnelConn(write func(pkt []byte) error, onMessage func(kind byte, id uint32, data []byte), onClose func()) *TunnelConn {
+	tc := &TunnelConn{
+		write:     write,
+		onMessage: onMessage,
+		onClose:   onClose,
+		inflight:  make(map[uint32]*tunnelPacket),
+		received:  make(map[uint32][]byte),
+		ch_done:   make(chan struct{}),
+	}
+	go tc.loop()
+	return tc
+}
+
+// seq a is before b, with wrap-around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (tc *TunnelConn) Close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.closeLocked()
+}
+
+func (tc *TunnelConn) closeLocked() bool {
+	if tc.closed {
+		return false
+	}
+	tc.closed = true
+	tc.queue = nil
+	tc.inflight = nil
+	tc.received = nil
+	close(tc.ch_done)
+	return true
+}
+
+// queue one message of stream, data larger than one packet is split
+func (tc *TunnelConn) Send(kind byte, id uint32, data []byte) error {
+	tc.mu.Lock()
+	if tc.closed {
+		tc.mu.Unlock()
+		return errTunnelClosed
+	}
+	if tc.pending+len(data) > kTunnelMaxPending {
+		tc.mu.Unlock()
+		return errTunnelBusy
+	}
+	for {
+		n := len(data)
+		if n > kTunnelMaxChunk {
+			n = kTunnelMaxChunk
+		}
+		pkt := make([]byte, kTunnelPacketHeader+kTunnelStreamHeader+n)
+		pkt[0] = kTunnelPacketData
+		binary.BigEndian.PutUint32(pkt[1:], tc.nextSeq)
+		pkt[5] = kind
+		binary.BigEndian.PutUint32(pkt[6:], id)
+		copy(pkt[10:], data[:n])
+		tc.queue = append(tc.queue, &tunnelPacket{seq: tc.nextSeq, data: pkt})
+		tc.nextSeq += 1
+		tc.pending += len(pkt)
+		if data = data[n:]; len(data) == 0 {
+			break
+		}
+	}
+	pkts := tc.flushLocked()
+	tc.mu.Unlock()
+
+	tc.writePackets(pkts)
+	return nil
+}
+
+// move queued packets into window, return packets to write
+func (tc *TunnelConn) flushLocked() [][]byte {
+	var pkts [][]byte
+	now := time.Now()
+	for len(tc.queue) > 0 && len(tc.inflight) < kTunnelWindow {
+		p := tc.queue[0]
+		tc.queue[0] = nil
+		tc.queue = tc.queue[1:]
+		p.sent = now
+		p.rto = kTunnelRto
+		tc.inflight[p.seq] = p
+		pkts = append(pkts, p.data)
+	}
+	return pkts
+}
+
+func (tc *TunnelConn) writePackets(pkts [][]byte) {
+	for _, pkt := range pkts {
+		tc.write(pkt)
+	}
+}
+
+// one packet from remote, called by one goroutine
+func (tc *TunnelConn) Input(pkt []byte) {
+	if len(pkt) < kTunnelPacketHeader {
+		return
+	}
+	seq := binary.BigEndian.Uint32(pkt[1:])
+
+	tc.mu.Lock()
+	if tc.closed {
+		tc.mu.Unlock()
+		return
+	}
+	switch pkt[0] {
+	case kTunnelPacketAck:
+		for key, p := range tc.inflight {
+			if seqBefore(key, seq) {
+				delete(tc.inflight, key)
+				tc.pending -= len(p.data)
+			}
+		}
+		pkts := tc.flushLocked()
+		tc.mu.Unlock()
+		tc.writePackets(pkts)
+	case kTunnelPacketData:
+		if len(pkt) < kTunnelPacketHeader+kTunnelStreamHeader {
+			tc.mu.Unlock()
+			return
+		}
+		// duplicated if before expected, dropped if beyond window
+		if !seqBefore(seq, tc.expected) && seq-tc.expected < 2*kTunnelWindow {
+			if _, ok := tc.received[seq]; !ok {
+				tc.received[seq] = pkt[kTunnelPacketHeader:]
+			}
+		}
+		var msgs [][]byte
+		for {
+			msg, ok := tc.received[tc.expected]
+			if !ok {
+				break
+			}
+			delete(tc.received, tc.expected)
+			tc.expected += 1
+			msgs = append(msgs, msg)
+		}
+		ack := make([]byte, kTunnelPacketHeader)
+		ack[0] = kTunnelPacketAck
+		binary.BigEndian.PutUint32(ack[1:], tc.expected)
+		tc.mu.Unlock()
+
+		tc.write(ack)
+		for _, msg := range msgs {
+			tc.onMessage(msg[0], binary.BigEndian.Uint32(msg[1:]), msg[kTunnelStreamHeader:])
+		}
+	default:
+		tc.mu.Unlock()
+	}
+}
+
+// retransmit packets of timeout
+func (tc *TunnelConn) loop() {
+	ticker := time.NewTicker(kTunnelTickMs * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tc.ch_done:
+			return
+		case now := <-ticker.C:
+			var pkts [][]byte
+			dead := false
+			tc.mu.Lock()
+			for _, p := range tc.inflight {
+				if now.Sub(p.sent) < p.rto {
+					continue
+				}
+				if p.retries += 1; p.retries > kTunnelMaxRetries {
+					dead = tc.closeLocked()
+					pkts = nil
+					break
+				}
+				if p.rto *= 2; p.rto > kTunnelMaxRto {
+					p.rto = kTunnelMaxRto
+				}
+				p.sent = now
+				pkts = append(pkts, p.data)
+			}
+			tc.mu.Unlock()
+
+			if dead {
+				if tc.onClose != nil {
+					tc.onClose()
+				}
+				return
+			}
+			tc.writePackets(pkts)
+		}
+	}
+}
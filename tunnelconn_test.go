@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// two tunnels over a lossy pipe, which drops or reorders packets
+func newTestTunnelPair(loss int, onMessage func(kind byte, id uint32, data []byte)) (a, b *TunnelConn) {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(1))
+	pipe := func(to **TunnelConn) func(pkt []byte) error {
+		var input sync.Mutex // Input is serial
+		return func(pkt []byte) error {
+			mu.Lock()
+			drop := rnd.Intn(100) < loss
+			delay := time.Duration(rnd.Intn(5)) * time.Millisecond
+			mu.Unlock()
+			if !drop {
+				data := append([]byte(nil), pkt...)
+				time.AfterFunc(delay, func() {
+					input.Lock()
+					defer input.Unlock()
+					(*to).Input(data)
+				})
+			}
+			return nil
+		}
+	}
+	a = NewTunnelConn(pipe(&b), func(kind byte, id uint32, data []byte) {}, nil)
+	b = NewTunnelConn(pipe(&a), onMessage, nil)
+	return
+}
+
+func TestTunnelConnOrdered(t *testing.T) {
+	var mu sync.Mutex
+	streams := make(map[uint32]*bytes.Buffer)
+	closed := make(chan uint32, 2)
+	a, b := newTestTunnelPair(20, func(kind byte, id uint32, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch kind {
+		case kTunnelStreamOpen:
+			streams[id] = &bytes.Buffer{}
+		case kTunnelStreamData:
+			streams[id].Write(data)
+		case kTunnelStreamClose:
+			closed <- id
+		}
+	})
+	defer a.Close()
+	defer b.Close()
+
+	// interleaved streams, data is larger than one packet
+	payloads := map[uint32][]byte{1: make([]byte, 64*1024), 2: make([]byte, 48*1024)}
+	for id, payload := range payloads {
+		rand.Read(payload)
+		if err := a.Send(kTunnelStreamOpen, id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for off := 0; off < 64*1024; off += 4096 {
+		for id, payload := range payloads {
+			if off < len(payload) {
+				if err := a.Send(kTunnelStreamData, id, payload[off:off+4096]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	for id := range payloads {
+		a.Send(kTunnelStreamClose, id, nil)
+	}
+
+	for range payloads {
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			t.Fatal("streams not closed")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for id, payload := range payloads {
+		if !bytes.Equal(streams[id].Bytes(), payload) {
+			t.Errorf("stream %d: %d bytes mismatch", id, streams[id].Len())
+		}
+	}
+}
+
+func TestTunnelConnBusy(t *testing.T) {
+	// remote never acks
+	tc := NewTunnelConn(func(pkt []byte) error { return nil }, nil, nil)
+	defer tc.Close()
+
+	data := make([]byte, kTunnelMaxPending/4)
+	for i := 0; i < 3; i++ {
+		if err := tc.Send(kTunnelStreamData, 1, data); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := tc.Send(kTunnelStreamData, 1, append(data, data...)); err != errTunnelBusy {
+		t.Fatalf("send over limit: %v, want busy", err)
+	}
+	tc.Close()
+	if err := tc.Send(kTunnelStreamData, 1, nil); err != errTunnelClosed {
+		t.Fatalf("send after close: %v, want closed", err)
+	}
+}
+
+func TestTunnelConnDead(t *testing.T) {
+	if testing.Short() {
+		t.Skip("retransmits for seconds")
+	}
+	ch_close := make(chan struct{})
+	tc := NewTunnelConn(func(pkt []byte) error { return nil }, nil, func() { close(ch_close) })
+	tc.Send(kTunnelStreamOpen, 1, nil)
+
+	select {
+	case <-ch_close:
+	case <-time.After(30 * time.Second):
+		t.Fatal("unreachable tunnel not closed")
+	}
+}
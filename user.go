@@ -1,4 +1,162 @@
 package main
 
+import (
+	util "github.com/PeterXu/goutil"
+)
+
+const (
+	kProfileName    = "name"
+	kProfileContact = "contact"
+
+	kMaxProfileValue = 128
+)
+
+/**
+ * User profile of SignalPeer, stored in SignalDatabase
+ */
 type User struct {
+	DisplayName string
+	Contact     string // e.g. email/phone
+	Ctime       int64
+	LastLogin   int64
+	LastAddr    string // remote addr of last login
+}
+
+/**
+ * Account info, returned to owner by info
+ */
+type AccountInfo struct {
+	Id          string
+	DisplayName string
+	Contact     string
+	Ctime       int64
+	LastLogin   int64
+	LastAddr    string
+	Owned       []string // owned services
+	Joined      []string // joined services
+}
+
+/// signal server operations
+
+// change-password with old one, salt is regenerated by client
+func (ss *SignalServer) ChangePassword(req *SignalRequest, resp *SignalResponse) error {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
+		return err
+	}
+	key := "peer:" + peer.Id
+	if err := ss.CheckAuthLock(key, req.conn); err != nil {
+		return err
+	}
+	if !util.MD5SumVerify([]string{req.PwdMd5, peer.Salt}, peer.PwdMd5) {
+		ss.Warnf("client: %s, wrong password when change\n", req.FromId)
+		ss.OnAuthResult(key, req.conn, false)
+		return errWrongPassword
+	}
+	if len(req.NewPwdMd5) < 32 || len(req.Salt) < 4 {
+		return errInvalidPassword
+	}
+
+	peer.PwdMd5 = util.MD5SumGenerate([]string{req.NewPwdMd5, req.Salt})
+	peer.Salt = req.Salt
+	return nil
+}
+
+// delete-account with password, and logout
+func (ss *SignalServer) DeleteAccount(req *SignalRequest, resp *SignalResponse) error {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
+		return err
+	}
+	key := "peer:" + peer.Id
+	if err := ss.CheckAuthLock(key, req.conn); err != nil {
+		return err
+	}
+	if !util.MD5SumVerify([]string{req.PwdMd5, peer.Salt}, peer.PwdMd5) {
+		ss.Warnf("client: %s, wrong password when delete\n", req.FromId)
+		ss.OnAuthResult(key, req.conn, false)
+		return errWrongPassword
+	}
+
+	ss.RemovePeer(req.FromId)
+	if conn := req.conn; conn != nil {
+		delete(ss.onlines, conn.id)
+		ss.connections[conn] = true
+	}
+	return nil
+}
+
+// remove peer with owned services and memberships
+func (ss *SignalServer) RemovePeer(id string) {
+	for name, service := range ss.db.Services {
+		if service.Owner == id {
+			delete(ss.db.Services, name)
+			for _, item := range ss.db.Peers {
+				if item.InServices[name] {
+					ss.NotifyServiceRevoked(item.Id, service, "deleted")
+				}
+				delete(item.InServices, name)
+			}
+		}
+	}
+	if peer, ok := ss.db.Peers[id]; ok {
+		for name, isIn := range peer.InServices {
+			if isIn {
+				ss.OnTunnelClosed(id, name, "deleted")
+			}
+		}
+	}
+	delete(ss.db.Peers, id)
+	ss.LeaveConferences(id)
+}
+
+// set-profile name|contact value
+func (ss *SignalServer) SetProfile(req *SignalRequest, resp *SignalResponse) error {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
+		return err
+	}
+	if len(req.ProfileValue) > kMaxProfileValue {
+		return errFnInvalidParamters([]string{req.ProfileKey})
+	}
+
+	switch req.ProfileKey {
+	case kProfileName:
+		peer.Profile.DisplayName = req.ProfileValue
+	case kProfileContact:
+		peer.Profile.Contact = req.ProfileValue
+	default:
+		return errFnInvalidParamters([]string{req.ProfileKey})
+	}
+	return nil
+}
+
+func (ss *SignalServer) AccountInfo(req *SignalRequest, resp *SignalResponse) error {
+	peer, err := ss.CheckOnline(req.FromId)
+	if err != nil {
+		return err
+	}
+
+	info := &AccountInfo{
+		Id:          peer.Id,
+		DisplayName: peer.Profile.DisplayName,
+		Contact:     peer.Profile.Contact,
+		Ctime:       peer.Profile.Ctime,
+		LastLogin:   peer.Profile.LastLogin,
+		LastAddr:    peer.Profile.LastAddr,
+		Owned:       []string{},
+		Joined:      []string{},
+	}
+	for name, service := range ss.db.Services {
+		if service.Owner == peer.Id {
+			info.Owned = append(info.Owned, name)
+		}
+	}
+	for name, isIn := range peer.InServices {
+		if isIn {
+			info.Joined = append(info.Joined, name)
+		}
+	}
+	resp.ResultL = append(resp.ResultL, util.JsonEncode(info))
+	return nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	util "github.com/PeterXu/goutil"
+)
+
+func TestChangePassword(t *testing.T) {
+	ss := newTestSignalServer()
+	conn := newTestPeer(t, ss, "alice", "")
+
+	change := func(oldPwd, newPwd string) string {
+		req := NewSignalRequest("alice")
+		req.PwdMd5 = util.MD5SumGenerate([]string{oldPwd})
+		req.NewPwdMd5 = util.MD5SumGenerate([]string{newPwd})
+		req.Salt = util.RandomString(4)
+		return doTestRequest(t, conn, kActionChangePassword, req).ErrorCode
+	}
+	if code := change("wrong", "new-password"); code != ErrorCode(errWrongPassword) {
+		t.Fatalf("change by wrong password: %q", code)
+	}
+	if code := change(kTestPassword, "new-password"); len(code) > 0 {
+		t.Fatalf("change-password: %q", code)
+	}
+
+	if _, code := loginTestFrom(t, ss, "1.2.3.4:1000", "alice", kTestPassword); code != ErrorCode(errWrongPassword) {
+		t.Errorf("login by old password: %q", code)
+	}
+	if _, code := loginTestFrom(t, ss, "1.2.3.4:1000", "alice", "new-password"); len(code) > 0 {
+		t.Errorf("login by new password: %q", code)
+	}
+}
+
+// owned services are removed, and their members are revoked
+func TestDeleteAccountCascade(t *testing.T) {
+	ss := newTestSignalServer()
+	owner, member := newTestService(t, ss)
+
+	req := NewSignalRequest("owner")
+	req.PwdMd5 = util.MD5SumGenerate([]string{"wrong"})
+	if resp := doTestRequest(t, owner, kActionDeleteAccount, req); resp.ErrorCode != ErrorCode(errWrongPassword) {
+		t.Fatalf("delete by wrong password: %q", resp.ErrorCode)
+	}
+	req = NewSignalRequest("owner")
+	req.PwdMd5 = util.MD5SumGenerate([]string{kTestPassword})
+	if resp := doTestRequest(t, owner, kActionDeleteAccount, req); len(resp.Error) > 0 {
+		t.Fatalf("delete-account: %s", resp.Error)
+	}
+
+	if _, ok := ss.db.Peers["owner"]; ok {
+		t.Error("owner not deleted")
+	}
+	if _, ok := ss.db.Services["svc"]; ok {
+		t.Error("owned service not removed")
+	}
+	if _, ok := ss.db.Peers["member"].InServices["svc"]; ok {
+		t.Error("membership of removed service")
+	}
+	if _, ok := ss.onlines["owner"]; ok {
+		t.Error("deleted owner is online")
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-member.ch_send:
+			if ev.Event == kActionEventServiceRevoked && ev.ServiceName == "svc" {
+				if reason := ev.ResultM["reason"]; reason != "deleted" {
+					t.Errorf("revoked reason: %q", reason)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("member not revoked")
+		}
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	ss := newTestSignalServer()
+	conn := newTestPeer(t, ss, "alice", "")
+
+	set := func(key, value string) string {
+		req := NewSignalRequest("alice")
+		req.ProfileKey = key
+		req.ProfileValue = value
+		return doTestRequest(t, conn, kActionSetProfile, req).ErrorCode
+	}
+	if code := set(kProfileName, "Alice"); len(code) > 0 {
+		t.Fatalf("set name: %q", code)
+	}
+	if code := set(kProfileContact, "alice@example.com"); len(code) > 0 {
+		t.Fatalf("set contact: %q", code)
+	}
+	if code := set("unknown", "value"); len(code) == 0 {
+		t.Error("set unknown key")
+	}
+	if code := set(kProfileName, strings.Repeat("a", kMaxProfileValue+1)); len(code) == 0 {
+		t.Error("set too long value")
+	}
+
+	resp := doTestRequest(t, conn, kActionInfo, NewSignalRequest("alice"))
+	if len(resp.ResultL) != 1 {
+		t.Fatalf("info: %v, %s", resp.ResultL, resp.Error)
+	}
+	info := &AccountInfo{}
+	if err := json.Unmarshal([]byte(resp.ResultL[0]), info); err != nil {
+		t.Fatal(err)
+	}
+	if info.DisplayName != "Alice" || info.Contact != "alice@example.com" {
+		t.Errorf("profile: %q, %q", info.DisplayName, info.Contact)
+	}
+}
@@ -116,6 +116,27 @@ func ParseCommandLine(line string) (parts []string, err error) {
 	return
 }
 
+// join parts to command line, reverse of ParseCommandLine
+func JoinCommandLine(parts []string) string {
+	var items []string
+	for _, part := range parts {
+		if len(part) == 0 || strings.ContainsAny(part, " '\\\"") {
+			part = strings.ReplaceAll(part, "\\", "\\\\")
+			part = "\"" + strings.ReplaceAll(part, "\"", "\\\"") + "\""
+		}
+		items = append(items, part)
+	}
+	return strings.Join(items, " ")
+}
+
+// read password from terminal without echo
+func ReadPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	defer fmt.Println("")
+	pwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	return string(pwd), err
+}
+
 func ReadFile(fname string, maxSize int) ([]byte, error) {
 	//content, err := ioutil.ReadFile("text.txt")
 	file, err := os.Open(fname)
@@ -152,6 +173,61 @@ func WriteFile(fname string, data []byte) error {
 	return err
 }
 
+// write to temp file and rename, never leave a partial file
+func WriteFileAtomic(fname string, data []byte) error {
+	tmpname := fname + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpname)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpname)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return os.Rename(tmpname, fname)
+}
+
+// private file of owner only, an existing file or symlink is replaced and never followed
+func WriteFilePrivate(fname string, data []byte) error {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(fname)
+		return err
+	}
+	return file.Close()
+}
+
+// append-only file of owner, created exclusively and never through symlink
+func OpenFileAppendPrivate(fname string) (*os.File, error) {
+	info, err := os.Lstat(fname)
+	if os.IsNotExist(err) {
+		return os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file: %s", fname)
+	}
+	return os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0600)
+}
+
 func GenerateToken(id, pwdMd5 string) string {
 	times := fmt.Sprintf("%d", util.NowMs())
 	value := util.MD5SumGenerate([]string{id, pwdMd5, times})
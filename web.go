@@ -0,0 +1,24 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+/**
+ * Web dashboard of signal server, served at "/"
+ *	a. single page(web/index.html), no build step
+ *	b. talks to /ws?codec=json with the same actions as the shell
+ */
+
+//go:embed web
+var webFiles embed.FS
+
+func webHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
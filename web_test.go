@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	util "github.com/PeterXu/goutil"
+)
+
+func TestWebHandler(t *testing.T) {
+	handler := webHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("index: %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "/ws?codec=json") {
+		t.Errorf("index without json websocket")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing.js", nil))
+	if w.Code != 404 {
+		t.Errorf("missing file: %d", w.Code)
+	}
+}
+
+// actions of dashboard are the ones of shell
+func TestWebActions(t *testing.T) {
+	data, err := webFiles.ReadFile("web/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := newTestSignalServer()
+	re := regexp.MustCompile(`(?:request|serviceAction|ownerAction)\("([a-z-]+)"|"([a-z]+-service)"`)
+	matches := re.FindAllStringSubmatch(string(data), -1)
+	if len(matches) == 0 {
+		t.Fatal("no action in index")
+	}
+	for _, item := range matches {
+		action := item[1] + item[2]
+		if _, ok := ss.actions[action]; !ok {
+			t.Errorf("unknown action of dashboard: %s", action)
+		}
+	}
+}
+
+// request as sent by dashboard, response as read by it
+func TestWebJsonCodec(t *testing.T) {
+	ss := newTestSignalServer()
+	newTestPeer(t, ss, "alice", "")
+	conn := newTestConn(ss)
+	conn.codec = kCodecJson
+
+	text := `{"Action":"login","FromId":"alice","PwdMd5":"` +
+		util.MD5SumGenerate([]string{kTestPassword}) + `","Sequence":"seq-web"}`
+	req := &SignalRequest{}
+	if err := conn.decode([]byte(text), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Action != kActionLogin || req.FromId != "alice" || req.Sequence != "seq-web" {
+		t.Fatalf("decoded request: %+v", req)
+	}
+	req.conn = conn
+	ss.OnReceiveRequest(req)
+
+	resp := <-conn.ch_send
+	_, data, err := conn.encode(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]interface{})
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("not json: %s", data)
+	}
+	if out["Sequence"] != "seq-web" || out["Error"] != "" {
+		t.Errorf("response: %s", data)
+	}
+}